@@ -110,6 +110,23 @@ func TestHttp(t *testing.T) {
 		assert.Equal(t, name, fmt.Sprintf("table%d", i))
 	}
 
+	endpoint = fmt.Sprintf("http://%s/rename_table?db=%s&table=table4&name=table5", httpAddr, dbName)
+	resp, err = util.ConfigdRequest(endpoint)
+	assert.Equal(t, err, nil)
+	endpoint = fmt.Sprintf("http://%s/drop_table?db=%s&table=table5", httpAddr, dbName)
+	resp, err = util.ConfigdRequest(endpoint)
+	assert.Equal(t, err, nil)
+	endpoint = fmt.Sprintf("http://%s/drop_table?db=%s&table=table5", httpAddr, dbName)
+	resp, err = util.ConfigdRequest(endpoint)
+	assert.NotEqual(t, err, nil)
+
+	endpoint = fmt.Sprintf("http://%s/tables?db=%s", httpAddr, dbName)
+	resp, err = util.ConfigdRequest(endpoint)
+	assert.Equal(t, err, nil)
+	tables, err = resp.Get("tables").StringArray()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(tables), 4)
+
 	// test meta
 	endpoint = fmt.Sprintf("http://%s/meta", httpAddr)
 	resp, err = util.ConfigdRequest(endpoint)
@@ -8,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/senarukana/fundb/meta"
+	"github.com/senarukana/fundb/protocol"
 	util "github.com/senarukana/fundb/util/configd"
 
 	"code.google.com/p/goprotobuf/proto"
@@ -34,10 +35,18 @@ func (self *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		self.createDBHandler(w, req)
 	case "/create_table":
 		self.createTableHandler(w, req)
+	case "/drop_table":
+		self.dropTableHandler(w, req)
+	case "/rename_table":
+		self.renameTableHandler(w, req)
+	case "/add_column":
+		self.addColumnHandler(w, req)
+	case "/drop_column":
+		self.dropColumnHandler(w, req)
 	case "/nodes":
 		self.nodesHandler(w, req)
 	default:
-		util.ConfigdResponse(w, 404, "NOT_FOUND", nil)
+		util.ConfigdResponse(w, 404, string(protocol.E_NOT_FOUND), nil)
 	}
 }
 
@@ -77,7 +86,7 @@ func (self *httpServer) metaHandler(w http.ResponseWriter, req *http.Request) {
 func (self *httpServer) createDBHandler(w http.ResponseWriter, req *http.Request) {
 	dbName := req.URL.Query().Get("db")
 	if dbName == "" {
-		util.ConfigdResponse(w, 500, "MISSING_ARG_DB", nil)
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_DB.HTTPStatus(), string(protocol.E_MISSING_ARG_DB), nil)
 		return
 	}
 	glog.V(1).Infof("CREATE DB %s", dbName)
@@ -92,7 +101,7 @@ func (self *httpServer) createDBHandler(w http.ResponseWriter, req *http.Request
 func (self *httpServer) createTableHandler(w http.ResponseWriter, req *http.Request) {
 	dbName := req.URL.Query().Get("db")
 	if dbName == "" {
-		util.ConfigdResponse(w, 500, "MISSING_ARG_DB", nil)
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_DB.HTTPStatus(), string(protocol.E_MISSING_ARG_DB), nil)
 		return
 	}
 	body, err := ioutil.ReadAll(req.Body)
@@ -102,7 +111,7 @@ func (self *httpServer) createTableHandler(w http.ResponseWriter, req *http.Requ
 	}
 	table := &meta.Table{}
 	if err = json.Unmarshal(body, table); err != nil {
-		util.ConfigdResponse(w, 500, "INVALID_TABLE_FORMAT", nil)
+		util.ConfigdResponse(w, protocol.E_INVALID_TABLE_FORMAT.HTTPStatus(), string(protocol.E_INVALID_TABLE_FORMAT), nil)
 		return
 	}
 	glog.V(1).Infof("CREATE Table %s", table)
@@ -114,10 +123,93 @@ func (self *httpServer) createTableHandler(w http.ResponseWriter, req *http.Requ
 	util.ConfigdResponse(w, 200, "OK", nil)
 }
 
+// getTableArgs reads the db and table arguments, it answers the request
+// itself when one is missing
+func getTableArgs(w http.ResponseWriter, req *http.Request) (dbName, tbName string, ok bool) {
+	dbName = req.URL.Query().Get("db")
+	if dbName == "" {
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_DB.HTTPStatus(), string(protocol.E_MISSING_ARG_DB), nil)
+		return "", "", false
+	}
+	tbName = req.URL.Query().Get("table")
+	if tbName == "" {
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_TABLE.HTTPStatus(), string(protocol.E_MISSING_ARG_TABLE), nil)
+		return "", "", false
+	}
+	return dbName, tbName, true
+}
+
+func (self *httpServer) dropTableHandler(w http.ResponseWriter, req *http.Request) {
+	dbName, tbName, ok := getTableArgs(w, req)
+	if !ok {
+		return
+	}
+	glog.V(1).Infof("DROP Table %s", tbName)
+	if err := self.configServer.db.DropTable(dbName, tbName); err != nil {
+		util.ConfigdResponse(w, 500, err.Error(), nil)
+		return
+	}
+	util.ConfigdResponse(w, 200, "OK", nil)
+}
+
+func (self *httpServer) renameTableHandler(w http.ResponseWriter, req *http.Request) {
+	dbName, tbName, ok := getTableArgs(w, req)
+	if !ok {
+		return
+	}
+	newName := req.URL.Query().Get("name")
+	if newName == "" {
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_NAME.HTTPStatus(), string(protocol.E_MISSING_ARG_NAME), nil)
+		return
+	}
+	glog.V(1).Infof("RENAME Table %s TO %s", tbName, newName)
+	if err := self.configServer.db.RenameTable(dbName, tbName, newName); err != nil {
+		util.ConfigdResponse(w, 500, err.Error(), nil)
+		return
+	}
+	util.ConfigdResponse(w, 200, "OK", nil)
+}
+
+func (self *httpServer) addColumnHandler(w http.ResponseWriter, req *http.Request) {
+	dbName, tbName, ok := getTableArgs(w, req)
+	if !ok {
+		return
+	}
+	column := req.URL.Query().Get("column")
+	if column == "" {
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_COLUMN.HTTPStatus(), string(protocol.E_MISSING_ARG_COLUMN), nil)
+		return
+	}
+	glog.V(1).Infof("ADD COLUMN %s to Table %s", column, tbName)
+	if err := self.configServer.db.AddColumn(dbName, tbName, column); err != nil {
+		util.ConfigdResponse(w, 500, err.Error(), nil)
+		return
+	}
+	util.ConfigdResponse(w, 200, "OK", nil)
+}
+
+func (self *httpServer) dropColumnHandler(w http.ResponseWriter, req *http.Request) {
+	dbName, tbName, ok := getTableArgs(w, req)
+	if !ok {
+		return
+	}
+	column := req.URL.Query().Get("column")
+	if column == "" {
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_COLUMN.HTTPStatus(), string(protocol.E_MISSING_ARG_COLUMN), nil)
+		return
+	}
+	glog.V(1).Infof("DROP COLUMN %s of Table %s", column, tbName)
+	if err := self.configServer.db.DropColumn(dbName, tbName, column); err != nil {
+		util.ConfigdResponse(w, 500, err.Error(), nil)
+		return
+	}
+	util.ConfigdResponse(w, 200, "OK", nil)
+}
+
 // func (self *httpServer) createShardHandler(w http.ResponseWriter, req *http.Request) {
 // 	dbName := req.URL.Query().Get("db")
 // 	if dbName == "" {
-// 		util.ConfigdResponse(w, 500, "MISSING_ARG_DB", nil)
+// 		util.ConfigdResponse(w, 500, string(protocol.E_MISSING_ARG_DB), nil)
 // 		return
 // 	}
 // 	body, err := ioutil.ReadAll(req.Body)
@@ -149,7 +241,7 @@ func (self *httpServer) dbsHandler(w http.ResponseWriter, req *http.Request) {
 func (self *httpServer) tablesHandler(w http.ResponseWriter, req *http.Request) {
 	dbName := req.URL.Query().Get("db")
 	if dbName == "" {
-		util.ConfigdResponse(w, 500, "MISSING_ARG_DB", nil)
+		util.ConfigdResponse(w, protocol.E_MISSING_ARG_DB.HTTPStatus(), string(protocol.E_MISSING_ARG_DB), nil)
 		return
 	}
 	tables, err := self.configServer.db.ListTables(dbName)
@@ -3,7 +3,6 @@ package configd
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
 	"strings"
@@ -80,33 +79,33 @@ func (self *ConfigdProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, para
 	case "IDENTIFY":
 		return self.Identify(client, reader, params[1:])
 	}
-	return nil, fmt.Errorf("UNKNOWN COMMAND %s", params[0])
+	return nil, protocol.NewError(protocol.E_INVALID_COMMAND, "UNKNOWN COMMAND %s", params[0])
 }
 
 func (self *ConfigdProtocolV1) Identify(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
 	var err error
 
 	if client.node != nil {
-		return nil, fmt.Errorf("cannot IDENTIFY again")
+		return nil, protocol.NewError(protocol.E_INVALID_COMMAND, "cannot IDENTIFY again")
 	}
 
 	var bodyLen int32
 	err = binary.Read(reader, binary.BigEndian, &bodyLen)
 	if err != nil {
-		return nil, fmt.Errorf("IDENTIFY failed to read body size")
+		return nil, protocol.NewError(protocol.E_BAD_BODY, "IDENTIFY failed to read body size")
 	}
 
 	body := make([]byte, bodyLen)
 	_, err = io.ReadFull(reader, body)
 	if err != nil {
-		return nil, fmt.Errorf("IDENTIFY failed to read body")
+		return nil, protocol.NewError(protocol.E_BAD_BODY, "IDENTIFY failed to read body")
 	}
 
 	// body is a json structure with producer information
 	ni := protocol.NodeInfo{}
 	err = proto.Unmarshal(body, &ni)
 	if err != nil {
-		return nil, fmt.Errorf("IDENTIFY failed to decode node info")
+		return nil, protocol.NewError(protocol.E_BAD_BODY, "IDENTIFY failed to decode node info")
 	}
 	addr := client.RemoteAddr().String()
 	ni.Address = proto.String(addr)
@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 
+	"github.com/senarukana/fundb/protocol"
 	"github.com/senarukana/fundb/util"
 
 	"github.com/golang/glog"
@@ -34,7 +35,7 @@ func (self *tcpServer) Handle(clientConn net.Conn) {
 	case "  V1":
 		prot = &ConfigdProtocolV1{configServer: self.configServer}
 	default:
-		util.SendResponse(clientConn, []byte("E_BAD_PROTOCOL"))
+		util.SendResponse(clientConn, []byte(protocol.E_BAD_PROTOCOL))
 		clientConn.Close()
 		glog.Errorf("client(%s) bad protocol magic '%s'", clientConn.RemoteAddr(), protocolMagic)
 		return
@@ -2,29 +2,42 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
 	"github.com/bmizerany/pat"
 	"github.com/golang/glog"
 )
 
 type HttpServer struct {
-	conn     net.Listener
-	addr     string
-	handler  *QueryEngine
-	exitChan chan int
+	conn       net.Listener
+	addr       string
+	handler    *QueryEngine
+	statements *statementCache
+	exitChan   chan int
 }
 
 func NewHttpServer(addr string, handler *QueryEngine) *HttpServer {
 	return &HttpServer{
-		addr:     addr,
-		handler:  handler,
-		exitChan: make(chan int),
+		addr:       addr,
+		handler:    handler,
+		statements: newStatementCache(),
+		exitChan:   make(chan int),
 	}
 }
 
+// queryRequest is the body of a POST query, params are bound to the ? or $n
+// placeholders of q in order
+type queryRequest struct {
+	Query  string        `json:"q"`
+	Params []interface{} `json:"params"`
+}
+
 func headerHandler(handler http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Add("Access-Control-Allow-Origin", "*")
@@ -48,6 +61,7 @@ func (self *HttpServer) Serve() {
 	p := pat.New()
 
 	p.Get("/db/:db/query", headerHandler(self.query))
+	p.Post("/db/:db/query", headerHandler(self.queryWithParams))
 	p.Post("/db", headerHandler(self.createDatabase))
 	p.Get("/db", headerHandler(self.listDatabase))
 	if err := http.Serve(self.conn, p); err != nil && strings.Contains(err.Error(), "closed network") {
@@ -66,21 +80,106 @@ func (self *HttpServer) query(writer http.ResponseWriter, request *http.Request)
 	db := request.URL.Query().Get(":db")
 	query := request.URL.Query().Get("q")
 
-	response := self.handler.Query(db, query)
+	parsedQuery, err := parser.Parse(query)
+	if err != nil {
+		self.writeError(writer, protocol.E_PARSE_ERROR, err)
+		return
+	}
+	response := self.handler.Execute(db, parsedQuery)
 	self.write(writer, response)
 }
 
-func (self *HttpServer) createDatabase(writer http.ResponseWriter, req *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+func (self *HttpServer) queryWithParams(writer http.ResponseWriter, request *http.Request) {
+	db := request.URL.Query().Get(":db")
+	var body queryRequest
+	decoder := json.NewDecoder(request.Body)
+	// keep integers apart from doubles
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		self.writeError(writer, protocol.E_BAD_BODY, err)
+		return
+	}
+	params, err := toFieldValues(body.Params)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		self.writeError(writer, protocol.E_BAD_PARAMS, err)
 		return
 	}
 
+	stmt, err := self.statements.prepare(body.Query)
+	if err != nil {
+		self.writeError(writer, protocol.E_PARSE_ERROR, err)
+		return
+	}
+	query, err := stmt.Bind(params)
+	if err != nil {
+		self.writeError(writer, protocol.E_BAD_PARAMS, err)
+		return
+	}
+	response := self.handler.Execute(db, query)
+	self.write(writer, response)
 }
 
+func toFieldValues(params []interface{}) ([]*protocol.FieldValue, error) {
+	values := make([]*protocol.FieldValue, len(params))
+	for i, param := range params {
+		switch val := param.(type) {
+		case nil:
+			// NULL
+		case json.Number:
+			if intVal, err := val.Int64(); err == nil {
+				values[i] = &protocol.FieldValue{IntVal: &intVal}
+			} else if doubleVal, err := val.Float64(); err == nil {
+				values[i] = &protocol.FieldValue{DoubleVal: &doubleVal}
+			} else {
+				return nil, fmt.Errorf("invalid number %s in params", val)
+			}
+		case string:
+			values[i] = &protocol.FieldValue{StrVal: &val}
+		case bool:
+			values[i] = &protocol.FieldValue{BoolVal: &val}
+		default:
+			return nil, fmt.Errorf("unsupported value %v in params", param)
+		}
+	}
+	return values, nil
+}
+
+// createDatabase is POST /db?db=name
+func (self *HttpServer) createDatabase(writer http.ResponseWriter, req *http.Request) {
+	db := req.URL.Query().Get("db")
+	if db == "" {
+		self.writeError(writer, protocol.E_MISSING_ARG_DB, fmt.Errorf("missing db"))
+		return
+	}
+	if err := self.handler.CreateDatabase(db); err != nil {
+		self.writeError(writer, protocol.E_BAD_PARAMS, err)
+		return
+	}
+	self.write(writer, &Response{})
+}
+
+// listDatabase is SHOW DATABASES
 func (self *HttpServer) listDatabase(writer http.ResponseWriter, req *http.Request) {
+	query := &parser.Query{
+		Type:      parser.QUERY_SHOW,
+		Statement: &parser.ShowQuery{Type: parser.SHOW_DATABASES},
+	}
+	response := self.handler.Execute("", query)
+	self.write(writer, response)
+}
 
+// writeError answers with the status of the code, a syntax error also
+// carries its position and the expected tokens
+func (self *HttpServer) writeError(writer http.ResponseWriter, code protocol.ErrorCode, err error) {
+	response := &Response{Error: err.Error(), Code: code}
+	if parseError, ok := err.(parser.ParserError); ok {
+		response.Code = protocol.E_PARSE_ERROR
+		response.ParseError = &parseError
+	} else if code == protocol.E_PARSE_ERROR {
+		// parsed fine but the query is not valid
+		response.Code = protocol.E_INVALID_QUERY
+	}
+	self.write(writer, response)
 }
 
 func (self *HttpServer) write(writer http.ResponseWriter, response *Response) {
@@ -91,6 +190,10 @@ func (self *HttpServer) write(writer http.ResponseWriter, response *Response) {
 		return
 	}
 	writer.Header().Add("content-type", "application/json")
-	writer.WriteHeader(http.StatusOK)
+	if response.Code != "" {
+		writer.WriteHeader(response.Code.HTTPStatus())
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
 	writer.Write(data)
 }
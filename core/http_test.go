@@ -0,0 +1,149 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	abstract "github.com/senarukana/fundb/engine/interface"
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+// fakeStore answers the introspection calls of a database holding tables,
+// every other call panics on the nil StoreEngine
+type fakeStore struct {
+	abstract.StoreEngine
+	tables map[string]int64
+}
+
+func (self *fakeStore) ListTables() ([]string, error) {
+	var tables []string
+	for table := range self.tables {
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (self *fakeStore) DescribeTable(table string) (*protocol.RecordList, error) {
+	column := "_id"
+	return &protocol.RecordList{
+		Name:   &table,
+		Fields: []string{"column"},
+		Values: []*protocol.Record{&protocol.Record{Values: []*protocol.FieldValue{&protocol.FieldValue{StrVal: &column}}}},
+	}, nil
+}
+
+func (self *fakeStore) TableStatus(table string) (*protocol.RecordList, error) {
+	name, records := table, self.tables[table]
+	return &protocol.RecordList{
+		Name:   &name,
+		Fields: []string{"table", "records", "size"},
+		Values: []*protocol.Record{&protocol.Record{Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StrVal: &name},
+			&protocol.FieldValue{IntVal: &records},
+			&protocol.FieldValue{IntVal: &records},
+		}}},
+	}, nil
+}
+
+func newTestServer(t *testing.T) (*HttpServer, func()) {
+	dataPath, err := ioutil.TempDir("", "fundb")
+	assert.Equal(t, err, nil)
+	engine, err := newQueryEngine(dataPath, func(string) (abstract.StoreEngine, error) {
+		return &fakeStore{tables: map[string]int64{"users": 3, "user_log": 10, "orders": 7}}, nil
+	})
+	assert.Equal(t, err, nil)
+	return NewHttpServer("", engine), func() { os.RemoveAll(dataPath) }
+}
+
+func serve(t *testing.T, handler http.HandlerFunc, method, target string) (int, *Response) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(method, target, nil))
+	var response Response
+	assert.Equal(t, json.Unmarshal(recorder.Body.Bytes(), &response), nil)
+	return recorder.Code, &response
+}
+
+// query is GET /db/:db/query, the router passes :db in the query string
+func query(t *testing.T, server *HttpServer, db, sql string) (int, *Response) {
+	return serve(t, server.query, "GET", "/db/"+db+"/query?:db="+url.QueryEscape(db)+"&q="+url.QueryEscape(sql))
+}
+
+func columnValues(results *protocol.RecordList, column int) []interface{} {
+	var values []interface{}
+	for _, record := range results.Values {
+		values = append(values, record.Values[column].GetValue())
+	}
+	return values
+}
+
+func TestShowStatements(t *testing.T) {
+	server, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, db := range []string{"shop", "archive", "shop_old"} {
+		code, response := serve(t, server.createDatabase, "POST", "/db?db="+db)
+		assert.Equal(t, code, http.StatusOK, response.Error)
+	}
+	code, response := serve(t, server.createDatabase, "POST", "/db?db=shop")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Equal(t, response.Error, "DATABASE shop already existed")
+
+	code, response = serve(t, server.listDatabase, "GET", "/db")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, response.Results.Fields, []string{"database"})
+	assert.Equal(t, columnValues(response.Results, 0), []interface{}{"archive", "shop", "shop_old"})
+
+	for sql, expected := range map[string][]interface{}{
+		"SHOW DATABASES LIKE 'shop%'":        []interface{}{"shop", "shop_old"},
+		"SHOW DATABASES LIKE 'shop'":         []interface{}{"shop"},
+		"SHOW TABLES":                        []interface{}{"orders", "user_log", "users"},
+		"SHOW TABLES LIKE 'user%'":           []interface{}{"user_log", "users"},
+		"SHOW TABLES LIKE 'user\\_%'":        []interface{}{"user_log"},
+		"SHOW TABLES LIKE 'none%'":           nil,
+		"SHOW TABLE STATUS LIKE '%s'":        []interface{}{"orders", "users"},
+		"SHOW TABLE STATUS LIKE 'orders'":    []interface{}{"orders"},
+		"DESCRIBE orders":                    []interface{}{"_id"},
+		"SHOW TABLE STATUS LIKE 'user_log'":  []interface{}{"user_log"},
+		"SHOW TABLE STATUS LIKE 'user%_log'": []interface{}{"user_log"},
+	} {
+		code, response := query(t, server, "shop", sql)
+		assert.Equal(t, code, http.StatusOK, sql+": "+response.Error)
+		assert.Equal(t, columnValues(response.Results, 0), expected, sql)
+	}
+
+	_, response = query(t, server, "shop", "SHOW TABLE STATUS LIKE 'users'")
+	assert.Equal(t, response.Results.Fields, []string{"table", "records", "size"})
+	assert.Equal(t, columnValues(response.Results, 1), []interface{}{int64(3)})
+
+	code, response = query(t, server, "missing", "SHOW TABLES")
+	assert.Equal(t, code, http.StatusNotFound)
+	assert.Equal(t, response.Code, protocol.E_NOT_FOUND)
+	code, response = query(t, server, "..", "SHOW TABLES")
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestQuery(t *testing.T) {
+	server, cleanup := newTestServer(t)
+	defer cleanup()
+	engine := server.handler
+	assert.Equal(t, engine.CreateDatabase("shop"), nil)
+
+	response := engine.Query("shop", "SHOW TABLES LIKE 'user%'")
+	assert.Equal(t, response.Error, "")
+	assert.Equal(t, columnValues(response.Results, 0), []interface{}{"user_log", "users"})
+
+	response = engine.Query("shop", "SHOW TABLES LIKE")
+	assert.Equal(t, response.Code, protocol.E_PARSE_ERROR)
+	assert.NotEqual(t, response.ParseError, (*parser.ParserError)(nil))
+
+	response = engine.Query("missing", "SHOW TABLES")
+	assert.Equal(t, response.Code, protocol.E_NOT_FOUND)
+}
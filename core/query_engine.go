@@ -0,0 +1,268 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/senarukana/fundb/engine"
+	abstract "github.com/senarukana/fundb/engine/interface"
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/golang/glog"
+)
+
+var (
+	defaultDirPerm os.FileMode = 0755
+)
+
+type storeOpenFunc func(dataPath string) (abstract.StoreEngine, error)
+
+// QueryEngine runs the parsed statements, every database is a store engine
+// of its own in a directory of dataPath, opened on its first query
+type QueryEngine struct {
+	sync.Mutex
+	dataPath string
+	open     storeOpenFunc
+	dbs      map[string]abstract.StoreEngine
+}
+
+func NewQueryEngine(engineName, dataPath string) (*QueryEngine, error) {
+	return newQueryEngine(dataPath, func(dataPath string) (abstract.StoreEngine, error) {
+		return engine.NewEngineManager(engineName, dataPath)
+	})
+}
+
+func newQueryEngine(dataPath string, open storeOpenFunc) (*QueryEngine, error) {
+	if err := os.MkdirAll(dataPath, defaultDirPerm); err != nil {
+		return nil, err
+	}
+	return &QueryEngine{
+		dataPath: dataPath,
+		open:     open,
+		dbs:      make(map[string]abstract.StoreEngine),
+	}, nil
+}
+
+func validDatabaseName(db string) bool {
+	return db != "" && db != "." && db != ".." && filepath.Base(db) == db
+}
+
+// CreateDatabase makes the directory of db and opens its store
+func (self *QueryEngine) CreateDatabase(db string) error {
+	if !validDatabaseName(db) {
+		return fmt.Errorf("invalid DATABASE name %q", db)
+	}
+	self.Lock()
+	defer self.Unlock()
+	dbPath := filepath.Join(self.dataPath, db)
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("DATABASE %s already existed", db)
+	}
+	if err := os.Mkdir(dbPath, defaultDirPerm); err != nil {
+		return err
+	}
+	store, err := self.open(dbPath)
+	if err != nil {
+		return err
+	}
+	self.dbs[db] = store
+	return nil
+}
+
+// ListDatabases returns the databases in name order
+func (self *QueryEngine) ListDatabases() ([]string, error) {
+	infos, err := ioutil.ReadDir(self.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var dbs []string
+	for _, info := range infos {
+		if info.IsDir() {
+			dbs = append(dbs, info.Name())
+		}
+	}
+	sort.Strings(dbs)
+	return dbs, nil
+}
+
+func (self *QueryEngine) getDatabase(db string) (abstract.StoreEngine, error) {
+	self.Lock()
+	defer self.Unlock()
+	if store, ok := self.dbs[db]; ok {
+		return store, nil
+	}
+	if !validDatabaseName(db) {
+		return nil, fmt.Errorf("DATABASE %s not existed", db)
+	}
+	dbPath := filepath.Join(self.dataPath, db)
+	if info, err := os.Stat(dbPath); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("DATABASE %s not existed", db)
+	}
+	glog.V(1).Infof("open database %s", db)
+	store, err := self.open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	self.dbs[db] = store
+	return store, nil
+}
+
+// Execute runs query on the database db, SHOW DATABASES is the only
+// statement that doesn't need one
+func (self *QueryEngine) Execute(db string, query *parser.Query) *Response {
+	if show, ok := query.Statement.(*parser.ShowQuery); ok && show.Type == parser.SHOW_DATABASES {
+		dbs, err := self.ListDatabases()
+		if err != nil {
+			return errorResponse(protocol.E_INTERNAL, err)
+		}
+		return &Response{Results: nameList("databases", "database", dbs, show)}
+	}
+	store, err := self.getDatabase(db)
+	if err != nil {
+		return errorResponse(protocol.E_NOT_FOUND, err)
+	}
+	results, rows, err := execute(store, query)
+	if err != nil {
+		return errorResponse(protocol.E_INVALID_QUERY, err)
+	}
+	return &Response{Results: results, RowsAffected: uint64(rows)}
+}
+
+// Query parses sql and runs it on the database db, a syntax error is
+// answered with its position and the expected tokens
+func (self *QueryEngine) Query(db, sql string) *Response {
+	query, err := parser.Parse(sql)
+	if err != nil {
+		response := errorResponse(protocol.E_INVALID_QUERY, err)
+		if parseError, ok := err.(parser.ParserError); ok {
+			response.Code = protocol.E_PARSE_ERROR
+			response.ParseError = &parseError
+		}
+		return response
+	}
+	return self.Execute(db, query)
+}
+
+func errorResponse(code protocol.ErrorCode, err error) *Response {
+	return &Response{Error: err.Error(), Code: code}
+}
+
+// execute dispatches a statement to the store, it returns the records
+// read or the number of records written
+func execute(store abstract.StoreEngine, query *parser.Query) (*protocol.RecordList, int64, error) {
+	switch statement := query.Statement.(type) {
+	case *parser.SelectQuery:
+		results, err := store.Fetch(statement)
+		return results, 0, err
+	case *parser.InsertQuery:
+		if statement.Select != nil {
+			rows, err := store.InsertSelect(statement)
+			return nil, rows, err
+		}
+		recordList := insertRecordList(statement)
+		if err := store.Insert(recordList, statement.OnConflict); err != nil {
+			return nil, 0, err
+		}
+		return nil, int64(len(recordList.Values)), nil
+	case *parser.DeleteQuery:
+		rows, err := store.Delete(statement)
+		return nil, rows, err
+	case *parser.UpdateQuery:
+		rows, err := store.Update(statement)
+		return nil, rows, err
+	case *parser.CreateTableQuery:
+		if err := store.CreateTable(statement.Name, statement.Type); err != nil {
+			return nil, 0, err
+		}
+		if schema := statement.GetSchema(); schema != nil {
+			return nil, 0, store.SetSchema(statement.Name, schema)
+		}
+		return nil, 0, nil
+	case *parser.DropTableQuery:
+		return nil, 0, store.DropTable(statement.Name)
+	case *parser.TruncateTableQuery:
+		return nil, 0, store.TruncateTable(statement.Name)
+	case *parser.AlterTableQuery:
+		switch statement.Type {
+		case parser.ALTER_ADD_COLUMN:
+			return nil, 0, store.AddColumn(statement.Name, statement.GetColumn())
+		case parser.ALTER_DROP_COLUMN:
+			return nil, 0, store.DropColumn(statement.Name, statement.Column)
+		default:
+			return nil, 0, store.RenameTable(statement.Name, statement.NewName)
+		}
+	case *parser.ShowQuery:
+		results, err := show(store, statement)
+		return results, 0, err
+	case *parser.ExplainQuery:
+		results, err := store.Explain(statement)
+		return results, 0, err
+	}
+	return nil, 0, fmt.Errorf("%v is not supported", query.Type)
+}
+
+func insertRecordList(query *parser.InsertQuery) *protocol.RecordList {
+	records := make([]*protocol.Record, len(query.Values))
+	for i, items := range query.Values {
+		values := make([]*protocol.FieldValue, len(items.Items))
+		for j, item := range items.Items {
+			values[j] = item.GetVal()
+		}
+		records[i] = &protocol.Record{Values: values}
+	}
+	return &protocol.RecordList{
+		Name:   &query.Table,
+		Fields: query.Fields,
+		Values: records,
+	}
+}
+
+// show runs SHOW TABLES, SHOW TABLE STATUS and DESCRIBE, the tables listed
+// are those LIKE matches
+func show(store abstract.StoreEngine, query *parser.ShowQuery) (*protocol.RecordList, error) {
+	if query.Type == parser.SHOW_COLUMNS {
+		return store.DescribeTable(query.Table)
+	}
+	tables, err := store.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tables)
+	if query.Type == parser.SHOW_TABLES {
+		return nameList("tables", "table", tables, query), nil
+	}
+
+	name := "table status"
+	res := &protocol.RecordList{Name: &name, Fields: []string{"table", "records", "size"}}
+	for _, table := range tables {
+		if !query.MatchName(table) {
+			continue
+		}
+		status, err := store.TableStatus(table)
+		if err != nil {
+			return nil, err
+		}
+		res.Values = append(res.Values, status.Values...)
+	}
+	return res, nil
+}
+
+// nameList is a single column of the names LIKE matches
+func nameList(name, field string, names []string, query *parser.ShowQuery) *protocol.RecordList {
+	res := &protocol.RecordList{Name: &name, Fields: []string{field}}
+	for _, item := range names {
+		if !query.MatchName(item) {
+			continue
+		}
+		value := item
+		res.Values = append(res.Values, &protocol.Record{Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StrVal: &value},
+		}})
+	}
+	return res
+}
@@ -1,11 +1,15 @@
 package core
 
 import (
+	"github.com/senarukana/fundb/parser"
 	"github.com/senarukana/fundb/protocol"
 )
 
 type Response struct {
-	Error        string
+	Error string
+	// Code is set with Error, clients should match on it
+	Code         protocol.ErrorCode  `json:",omitempty"`
+	ParseError   *parser.ParserError `json:",omitempty"`
 	RowsAffected uint64
 	Results      *protocol.RecordList
 }
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/senarukana/fundb/parser"
+)
+
+const (
+	maxCachedStatements = 1024
+)
+
+// statementCache keeps prepared statements by their SQL text, so clients
+// sending the same statement with different params only parse it once
+type statementCache struct {
+	sync.Mutex
+	statements map[string]*parser.PreparedStatement
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{
+		statements: make(map[string]*parser.PreparedStatement),
+	}
+}
+
+func (self *statementCache) prepare(sql string) (*parser.PreparedStatement, error) {
+	self.Lock()
+	stmt, ok := self.statements[sql]
+	self.Unlock()
+	if ok {
+		return stmt, nil
+	}
+
+	stmt, err := parser.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	self.Lock()
+	if len(self.statements) >= maxCachedStatements {
+		// simply start over, statements are cheap to prepare again
+		self.statements = make(map[string]*parser.PreparedStatement)
+	}
+	self.statements[sql] = stmt
+	self.Unlock()
+	return stmt, nil
+}
@@ -8,8 +8,30 @@ import (
 type StoreEngine interface {
 	Init(dataPath string) error
 	CreateTable(table string, idtype parser.TableIdType) error
-	Insert(recordList *protocol.RecordList) error
+	// SetSchema makes a table typed, tables without one are schemaless
+	SetSchema(table string, schema protocol.Schema) error
+	DropTable(table string) error
+	TruncateTable(table string) error
+	RenameTable(table, newName string) error
+	// AddColumn extends the schema of a typed table, the column needs a
+	// type then. A schemaless table has nothing to store.
+	AddColumn(table string, column *protocol.Column) error
+	DropColumn(table, column string) error
+	ListTables() ([]string, error)
+	// DescribeTable lists the columns with their internal column ids
+	DescribeTable(table string) (*protocol.RecordList, error)
+	// TableStatus reports the records and bytes stored for the table
+	TableStatus(table string) (*protocol.RecordList, error)
+	// Insert writes records, onConflict tells what to do with those whose
+	// _id already exists
+	Insert(recordList *protocol.RecordList, onConflict parser.ConflictAction) error
+	// InsertSelect copies the rows of an INSERT ... SELECT in batches
+	InsertSelect(query *parser.InsertQuery) (int64, error)
 	Fetch(query *parser.SelectQuery) (*protocol.RecordList, error)
 	Delete(query *parser.DeleteQuery) (int64, error)
+	Update(query *parser.UpdateQuery) (int64, error)
+	// Explain returns the plan of a SELECT or DELETE, with ANALYZE it runs
+	// the query and reports the rows, keys and time of every step
+	Explain(query *parser.ExplainQuery) (*protocol.RecordList, error)
 	Close() error
 }
@@ -0,0 +1,251 @@
+package leveldb
+
+import (
+	"fmt"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+)
+
+type aggregator interface {
+	add(value parser.LiteralNode) error
+	result() *protocol.FieldValue
+}
+
+type countAggregator struct {
+	isStar bool
+	count  int64
+}
+
+func (self *countAggregator) add(value parser.LiteralNode) error {
+	if self.isStar || value.GetType() != protocol.NULL {
+		self.count++
+	}
+	return nil
+}
+
+func (self *countAggregator) result() *protocol.FieldValue {
+	count := self.count
+	return &protocol.FieldValue{IntVal: &count}
+}
+
+// sumAggregator sums in int64 until it sees the first double
+type sumAggregator struct {
+	hasValue  bool
+	isDouble  bool
+	intSum    int64
+	doubleSum float64
+}
+
+func (self *sumAggregator) add(value parser.LiteralNode) error {
+	switch value.GetType() {
+	case protocol.NULL:
+		return nil
+	case protocol.INT:
+		self.intSum += value.GetVal().GetIntVal()
+		self.doubleSum += float64(value.GetVal().GetIntVal())
+	case protocol.DOUBLE:
+		self.isDouble = true
+		self.doubleSum += value.GetVal().GetDoubleVal()
+	default:
+		return fmt.Errorf("SUM/AVG on non numeric value %v", value.GetVal().GetValue())
+	}
+	self.hasValue = true
+	return nil
+}
+
+func (self *sumAggregator) result() *protocol.FieldValue {
+	if !self.hasValue {
+		return &protocol.FieldValue{}
+	}
+	if self.isDouble {
+		sum := self.doubleSum
+		return &protocol.FieldValue{DoubleVal: &sum}
+	}
+	sum := self.intSum
+	return &protocol.FieldValue{IntVal: &sum}
+}
+
+type avgAggregator struct {
+	sum   sumAggregator
+	count int64
+}
+
+func (self *avgAggregator) add(value parser.LiteralNode) error {
+	if value.GetType() == protocol.NULL {
+		return nil
+	}
+	self.count++
+	return self.sum.add(value)
+}
+
+func (self *avgAggregator) result() *protocol.FieldValue {
+	if self.count == 0 {
+		return &protocol.FieldValue{}
+	}
+	avg := self.sum.doubleSum / float64(self.count)
+	return &protocol.FieldValue{DoubleVal: &avg}
+}
+
+type minMaxAggregator struct {
+	isMax bool
+	value parser.LiteralNode
+}
+
+func (self *minMaxAggregator) add(value parser.LiteralNode) error {
+	if value.GetType() == protocol.NULL {
+		return nil
+	}
+	if self.value == nil {
+		self.value = value
+		return nil
+	}
+	cmp := compareLiteral(value, self.value)
+	if (self.isMax && cmp > 0) || (!self.isMax && cmp < 0) {
+		self.value = value
+	}
+	return nil
+}
+
+func (self *minMaxAggregator) result() *protocol.FieldValue {
+	if self.value == nil {
+		return &protocol.FieldValue{}
+	}
+	return self.value.GetVal()
+}
+
+func newAggregator(function *parser.FunctionCall) aggregator {
+	switch function.Name {
+	case "COUNT":
+		return &countAggregator{isStar: function.IsStar}
+	case "SUM":
+		return &sumAggregator{}
+	case "AVG":
+		return &avgAggregator{}
+	case "MIN":
+		return &minMaxAggregator{isMax: false}
+	case "MAX":
+		return &minMaxAggregator{isMax: true}
+	default:
+		panic(fmt.Sprintf("UNKNOWN AGGREGATE FUNCTION %s", function.Name))
+	}
+}
+
+type group struct {
+	values      []*protocol.FieldValue
+	aggregators []aggregator
+}
+
+func newGroup(values []*protocol.FieldValue, aggregates []*parser.FunctionCall) *group {
+	g := &group{
+		values:      values,
+		aggregators: make([]aggregator, len(aggregates)),
+	}
+	for i, aggregate := range aggregates {
+		g.aggregators[i] = newAggregator(aggregate)
+	}
+	return g
+}
+
+// aggregateRecords hash-aggregates records by the GROUP BY columns. Every
+// output record holds the group values followed by the aggregate results,
+// the returned fields name them by column and by the aggregate call.
+func aggregateRecords(query *parser.SelectQuery, records []*protocol.Record, fields []string) ([]*protocol.Record, []string, error) {
+	var groupFields []string
+	if query.GroupBy != nil {
+		groupFields = query.GroupBy.Fields
+	}
+	aggregates := query.GetAggregates()
+
+	groupIdxs := make([]int, len(groupFields))
+	for i, groupField := range groupFields {
+		groupIdxs[i] = -1
+		for j, field := range fields {
+			if field == groupField {
+				groupIdxs[i] = j
+				break
+			}
+		}
+		if groupIdxs[i] == -1 {
+			return nil, nil, fmt.Errorf("GROUP BY field %s not existed", groupField)
+		}
+	}
+
+	var groups []*group
+	buckets := make(map[string][]*group)
+	for _, record := range records {
+		values := make([]*protocol.FieldValue, len(groupIdxs))
+		for i, idx := range groupIdxs {
+			values[i] = record.Values[idx]
+		}
+		key := valuesKey(values)
+		var g *group
+		for _, other := range buckets[key] {
+			if valuesEqual(values, other.values) {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = newGroup(values, aggregates)
+			buckets[key] = append(buckets[key], g)
+			groups = append(groups, g)
+		}
+
+		for i, aggregate := range aggregates {
+			var value parser.LiteralNode
+			if aggregate.IsStar {
+				value = NewLiteral(nil)
+			} else {
+				var err error
+				value, err = getExpressionValue(record, aggregate.GetArgs()[0], fields)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			if err := g.aggregators[i].add(value); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	// without GROUP BY the whole table is one group, even when it is empty
+	if len(groups) == 0 && len(groupFields) == 0 {
+		groups = append(groups, newGroup(nil, aggregates))
+	}
+
+	aggregateFields := make([]string, 0, len(groupFields)+len(aggregates))
+	aggregateFields = append(aggregateFields, groupFields...)
+	for _, aggregate := range aggregates {
+		aggregateFields = append(aggregateFields, aggregate.String())
+	}
+	res := make([]*protocol.Record, 0, len(groups))
+	for _, g := range groups {
+		values := make([]*protocol.FieldValue, 0, len(aggregateFields))
+		values = append(values, g.values...)
+		for _, aggregator := range g.aggregators {
+			values = append(values, aggregator.result())
+		}
+		res = append(res, &protocol.Record{Values: values})
+	}
+	return res, aggregateFields, nil
+}
+
+// isTableCount reports whether the query is a plain COUNT(*) over the whole
+// table, which the records counter of the meta already answers. LIMIT 0 and
+// OFFSET drop the one row it returns, they go through the general path.
+func isTableCount(query *parser.SelectQuery) bool {
+	if query.Join != nil || query.WhereExpression != nil || query.GroupBy != nil || query.Having != nil || query.IsStar ||
+		query.Offset > 0 || query.Limit == 0 {
+		return false
+	}
+	for _, scalar := range query.ScalarList.ScalarList {
+		if scalar.Type != parser.SCALAR_FUNCTION {
+			return false
+		}
+		function := scalar.Val.(*parser.FunctionCall)
+		if function.Name != "COUNT" || !function.IsStar {
+			return false
+		}
+	}
+	return true
+}
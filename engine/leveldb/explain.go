@@ -0,0 +1,261 @@
+package leveldb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+	"github.com/senarukana/fundb/util"
+)
+
+// planStep is one step of a query plan, in the order the engine runs them
+type planStep struct {
+	name   string
+	detail string
+}
+
+// stepStats is what EXPLAIN ANALYZE measures for a step
+type stepStats struct {
+	rows    int
+	keys    int
+	elapsed time.Duration
+}
+
+// queryTrace collects the stats of every step run, by step name. Queries
+// run without EXPLAIN ANALYZE have a nil trace, which records nothing.
+type queryTrace map[string]*stepStats
+
+func (self queryTrace) record(step string, start time.Time, rows, keys int) {
+	if self == nil {
+		return
+	}
+	self[step] = &stepStats{rows, keys, time.Since(start)}
+}
+
+// scan records the scan and the residual filter, which is evaluated record by
+// record during the scan, so its time is part of the scan's
+func (self queryTrace) scan(start time.Time, result *fetchResult) {
+	if self == nil {
+		return
+	}
+	self.record("scan", start, result.scanned, result.keysRead)
+	self["filter"] = &stepStats{rows: len(result.records)}
+}
+
+func (self *LevelDBEngine) Explain(query *parser.ExplainQuery) (*protocol.RecordList, error) {
+	folded, err := parser.Fold(query)
+	if err != nil {
+		return nil, err
+	}
+	query = folded.(*parser.ExplainQuery)
+	var steps []*planStep
+	switch q := query.Query.Statement.(type) {
+	case *parser.SelectQuery:
+		steps, err = self.planSelect(q)
+	case *parser.DeleteQuery:
+		steps, err = planDelete(q)
+	default:
+		return nil, fmt.Errorf("EXPLAIN of %v is not supported", query.Query.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	table := query.GetTableName()
+	if !query.Analyze {
+		return planRecordList(table, steps), nil
+	}
+
+	// the query really runs, EXPLAIN ANALYZE DELETE deletes the records
+	trace := make(queryTrace)
+	start := time.Now()
+	rows := 0
+	switch q := query.Query.Statement.(type) {
+	case *parser.SelectQuery:
+		var res *protocol.RecordList
+		res, err = self.fetchQuery(q, trace)
+		if res != nil {
+			rows = len(res.Values)
+		}
+	case *parser.DeleteQuery:
+		var deleted int64
+		deleted, err = self.deleteQuery(q, trace)
+		rows = int(deleted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	trace.record("total", start, rows, 0)
+	steps = append(steps, &planStep{"total", ""})
+	return analyzeRecordList(table, steps, trace), nil
+}
+
+func (self *LevelDBEngine) planSelect(query *parser.SelectQuery) ([]*planStep, error) {
+	if isTableCount(query) {
+		return []*planStep{&planStep{"count", fmt.Sprintf("records counter of table %s, nothing is read", query.Table)}}, nil
+	}
+	_, fetchFields, err := self.getSelectAndFetchFields(query)
+	if err != nil {
+		return nil, err
+	}
+	var steps []*planStep
+	if query.Join != nil {
+		plan := planJoin(query, fetchFields)
+		steps = append(steps, &planStep{"scan", scanDetail(plan.outer.table, []*parser.IdRange{&parser.IdRange{Start: 0, End: parser.MaximumRange}}, plan.outer.fields, nil)})
+		steps = append(steps, &planStep{"join", plan.String()})
+		if query.WhereExpression != nil {
+			steps = append(steps, &planStep{"filter", query.WhereExpression.String()})
+		}
+	} else {
+		condition, idRanges, err := parser.GetIdCondition(query.WhereExpression)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, &planStep{"scan", scanDetail(query.Table, idRanges, fetchFields, query.GetSelectFields())})
+		if condition != nil {
+			steps = append(steps, &planStep{"filter", condition.String()})
+		}
+	}
+	if query.IsAggregate() {
+		names := make([]string, 0)
+		for _, aggregate := range query.GetAggregates() {
+			names = append(names, aggregate.String())
+		}
+		detail := "one group"
+		if query.GroupBy != nil {
+			detail = "group by " + strings.Join(query.GroupBy.Fields, ", ")
+		}
+		if len(names) > 0 {
+			detail += ": " + strings.Join(names, ", ")
+		}
+		steps = append(steps, &planStep{"aggregate", detail})
+		if query.Having != nil {
+			steps = append(steps, &planStep{"having", query.Having.String()})
+		}
+	}
+	if query.OrderByList != nil {
+		orders := make([]string, len(query.OrderBys))
+		for i, orderBy := range query.OrderBys {
+			orders[i] = orderBy.Field
+			if orderBy.Order == parser.ORDER_DESC {
+				orders[i] += " DESC"
+			}
+		}
+		steps = append(steps, &planStep{"sort", strings.Join(orders, ", ")})
+	}
+	steps = append(steps, &planStep{"project", projectDetail(query)})
+	if query.Distinct {
+		steps = append(steps, &planStep{"distinct", ""})
+	}
+	if query.Offset > 0 || query.Limit != -1 {
+		detail := fmt.Sprintf("offset %d", query.Offset)
+		if query.Limit != -1 {
+			detail += fmt.Sprintf(", limit %d", query.Limit)
+			if stop := query.Limit + query.Offset; isIdOrdered(query) && stop >= 0 {
+				detail += fmt.Sprintf(", the scan stops after %d matches", stop)
+			}
+		}
+		steps = append(steps, &planStep{"limit", detail})
+	}
+	return steps, nil
+}
+
+func planDelete(query *parser.DeleteQuery) ([]*planStep, error) {
+	if query.WhereExpression == nil {
+		return nil, fmt.Errorf("NO WHERE EXPRESSION IN DELETE")
+	}
+	condition, idRanges, err := parser.GetIdCondition(query.WhereExpression)
+	if err != nil {
+		return nil, err
+	}
+	steps := []*planStep{&planStep{"scan", scanDetail(query.Table, idRanges, query.WhereExpression.GetConditionFields(), nil)}}
+	if condition != nil {
+		steps = append(steps, &planStep{"filter", condition.String()})
+	}
+	return append(steps, &planStep{"delete", "every column of the matched records"}), nil
+}
+
+// scanDetail tells the _id ranges read, or that the whole table is, and the
+// columns fetched, marking those only fetched for the filter
+func scanDetail(table string, idRanges []*parser.IdRange, fetchFields, outputFields []string) string {
+	var ranges string
+	switch {
+	case len(idRanges) == 0:
+		ranges = "no _id can match, nothing is read"
+	case len(idRanges) == 1 && idRanges[0].Start == 0 && idRanges[0].End == parser.MaximumRange:
+		ranges = "full scan, no index"
+	default:
+		names := make([]string, len(idRanges))
+		for i, idRange := range idRanges {
+			names[i] = idRange.String()
+		}
+		ranges = "index _id, ranges " + strings.Join(names, ", ")
+	}
+
+	outputSet := util.NewStringSetFromStrings(outputFields)
+	var filterOnly []string
+	for _, field := range fetchFields {
+		if outputFields != nil && !outputSet.Exists(field) {
+			filterOnly = append(filterOnly, field)
+		}
+	}
+	detail := fmt.Sprintf("table %s, %s, fetch %s", table, ranges, strings.Join(fetchFields, ", "))
+	if len(filterOnly) > 0 {
+		detail += fmt.Sprintf(" (not projected: %s)", strings.Join(filterOnly, ", "))
+	}
+	return detail
+}
+
+func projectDetail(query *parser.SelectQuery) string {
+	if query.IsStar {
+		return "*"
+	}
+	names := make([]string, len(query.ScalarList.ScalarList))
+	for i, scalar := range query.ScalarList.ScalarList {
+		names[i] = scalar.String()
+		if scalar.Alias != "" {
+			names[i] += " AS " + scalar.Alias
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func planRecordList(table string, steps []*planStep) *protocol.RecordList {
+	records := make([]*protocol.Record, len(steps))
+	for i, step := range steps {
+		name, detail := step.name, step.detail
+		records[i] = &protocol.Record{Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StrVal: &name},
+			&protocol.FieldValue{StrVal: &detail},
+		}}
+	}
+	return &protocol.RecordList{
+		Name:   &table,
+		Fields: []string{"step", "detail"},
+		Values: records,
+	}
+}
+
+// analyzeRecordList adds the rows out of every step, the keys it read and
+// its time to the plan, steps that didn't run are left NULL
+func analyzeRecordList(table string, steps []*planStep, trace queryTrace) *protocol.RecordList {
+	res := planRecordList(table, steps)
+	res.Fields = append(res.Fields, "rows", "keys", "time_ms")
+	for i, step := range steps {
+		record := res.Values[i]
+		stats, ok := trace[step.name]
+		if !ok {
+			record.Values = append(record.Values, nil, nil, nil)
+			continue
+		}
+		rows, keys := int64(stats.rows), int64(stats.keys)
+		elapsed := float64(stats.elapsed) / float64(time.Millisecond)
+		record.Values = append(record.Values,
+			&protocol.FieldValue{IntVal: &rows},
+			&protocol.FieldValue{IntVal: &keys},
+			&protocol.FieldValue{DoubleVal: &elapsed},
+		)
+	}
+	return res
+}
@@ -1,44 +1,16 @@
 package leveldb
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/senarukana/fundb/parser"
 	"github.com/senarukana/fundb/protocol"
-	"github.com/senarukana/fundb/util"
-
-	"github.com/golang/glog"
 )
 
 func NewLiteral(field *protocol.FieldValue) parser.LiteralNode {
-	var literal parser.LiteralNode
-	if field.IntVal != nil {
-		literal = &parser.IntNode{
-			protocol.INT,
-			field,
-		}
-	} else if field.DoubleVal != nil {
-		literal = &parser.DoubleNode{
-			protocol.DOUBLE,
-			field,
-		}
-	} else if field.BoolVal != nil {
-		literal = &parser.BoolNode{
-			protocol.BOOL,
-			field,
-		}
-	} else if field.StrVal != nil {
-		literal = &parser.StringNode{
-			protocol.STRING,
-			field,
-		}
-	} else {
-		literal = &parser.NullNode{
-			protocol.NULL,
-			field,
-		}
-	}
-	return literal
+	// a nil field means the record has no value for this column
+	return parser.NewFieldLiteral(field)
 }
 
 func getFieldValue(record *protocol.Record, fieldName string, fields []string) (parser.LiteralNode, error) {
@@ -56,68 +28,229 @@ func getFieldValue(record *protocol.Record, fieldName string, fields []string) (
 	return NewLiteral(record.Values[fieldIdx]), nil
 }
 
-func getScalarValue(record *protocol.Record, scalar *parser.Scalar) (parser.LiteralNode, error) {
-	if scalar.Type != parser.SCLAR_LITERAL {
-		panic("NOT SUPPORTED SCALAR TYPE")
+func getScalarValue(record *protocol.Record, scalar *parser.Scalar, fields []string) (parser.LiteralNode, error) {
+	switch scalar.Type {
+	case parser.SCLAR_LITERAL:
+		return scalar.Val.(parser.LiteralNode), nil
+	case parser.SCALAR_IDENT:
+		return getFieldValue(record, scalar.Val.(string), fields)
+	case parser.SCALAR_FUNCTION:
+		function := scalar.Val.(*parser.FunctionCall)
+		if function.IsAggregate() {
+			// aggregates are computed before HAVING is evaluated and stored under their name
+			return getFieldValue(record, scalar.String(), fields)
+		}
+		args := make([]parser.LiteralNode, len(function.GetArgs()))
+		for i, arg := range function.GetArgs() {
+			val, err := getScalarValue(record, arg, fields)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return function.Call(args)
+	case parser.SCALAR_EXPRESSION:
+		expr := scalar.Val.(*parser.ArithmeticExpression)
+		left, err := getScalarValue(record, expr.Left, fields)
+		if err != nil {
+			return nil, err
+		}
+		var right parser.LiteralNode
+		if expr.Right != nil {
+			right, err = getScalarValue(record, expr.Right, fields)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return parser.Arithmetic(expr.Op, left, right)
+	default:
+		panic(fmt.Sprintf("UNKNOWN SCALAR TYPE %d", scalar.Type))
 	}
-	return scalar.Val.(parser.LiteralNode), nil
 }
 
 func getExpressionValue(record *protocol.Record, expression interface{}, fields []string) (parser.LiteralNode, error) {
 	if fieldName, ok := expression.(string); ok {
 		return getFieldValue(record, fieldName, fields)
 	} else if scalar, ok := expression.(*parser.Scalar); ok {
-		return getScalarValue(record, scalar)
+		return getScalarValue(record, scalar, fields)
 	} else {
 		panic(fmt.Sprintf("unsupported expression value %v", expression))
 	}
 }
 
-func matchComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (bool, error) {
+// matchResult is the three valued result of a predicate, a row is only
+// selected when its condition is matchTrue
+type matchResult int
+
+const (
+	matchFalse matchResult = iota
+	matchTrue
+	matchUnknown
+)
+
+func toMatchResult(matched bool) matchResult {
+	if matched {
+		return matchTrue
+	}
+	return matchFalse
+}
+
+func matchComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
 	leftVal, err := getExpressionValue(record, condition.Left, fields)
 	if err != nil {
-		return false, err
+		return matchFalse, err
 	}
 	rightVal, err := getExpressionValue(record, condition.Right, fields)
 	if err != nil {
-		return false, err
+		return matchFalse, err
+	}
+	if parser.IsNull(leftVal) || parser.IsNull(rightVal) {
+		return matchUnknown, nil
 	}
-	// glog.Errorf("left:%v, right:%v\n", leftVal, rightVal)
-	return leftVal.Compare(parser.ComparisonMap[condition.Token.Src], rightVal), nil
+	return toMatchResult(leftVal.Compare(parser.ComparisonMap[condition.Token.Src], rightVal)), nil
 }
 
-func betweenComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (bool, error) {
+func betweenComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
 	recordVal, err := getExpressionValue(record, condition.Left, fields)
 	if err != nil {
-		return false, err
+		return matchFalse, err
 	}
 
 	betweenExpr := condition.Right.(*parser.BetweenExpression)
-	if betweenExpr.Left.Type != parser.SCLAR_LITERAL || betweenExpr.Right.Type != parser.SCLAR_LITERAL {
-		panic("NOT SUPPORTED SCALAR TYPE")
+	leftVal, err := getScalarValue(record, betweenExpr.Left, fields)
+	if err != nil {
+		return matchFalse, err
+	}
+	rightVal, err := getScalarValue(record, betweenExpr.Right, fields)
+	if err != nil {
+		return matchFalse, err
+	}
+	if parser.IsNull(recordVal) || parser.IsNull(leftVal) || parser.IsNull(rightVal) {
+		return matchUnknown, nil
 	}
-	leftVal := betweenExpr.Left.Val.(parser.LiteralNode)
-	rightVal := betweenExpr.Right.Val.(parser.LiteralNode)
 
 	if recordVal.Compare(parser.GREATEREQ, leftVal) && recordVal.Compare(parser.SMALLER, rightVal) {
-		return true, nil
+		return matchTrue, nil
 	} else {
-		return false, nil
+		return matchFalse, nil
+	}
+}
+
+// inComparison is unknown rather than false when the value is NULL, or when
+// nothing matched and the list holds a NULL
+func inComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
+	recordVal, err := getExpressionValue(record, condition.Left, fields)
+	if err != nil {
+		return matchFalse, err
+	}
+	if parser.IsNull(recordVal) {
+		return matchUnknown, nil
+	}
+	result := matchFalse
+	for _, item := range condition.Right.(*parser.ScalarList).ScalarList {
+		itemVal, err := getScalarValue(record, item, fields)
+		if err != nil {
+			return matchFalse, err
+		}
+		if parser.IsNull(itemVal) {
+			result = matchUnknown
+		} else if recordVal.Compare(parser.EQUAL, itemVal) {
+			return matchTrue, nil
+		}
 	}
+	return result, nil
 }
 
-func match(record *protocol.Record, condition *parser.WhereExpression, fields []string) (bool, error) {
+// subqueryComparison probes the set an IN subquery returned, the subquery
+// has been run once by ResolveSubqueries before the scan
+func subqueryComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
+	result := condition.Right.(*parser.Subquery).Result
+	if result == nil {
+		return matchFalse, fmt.Errorf("subquery has not been run")
+	}
+	if condition.Type == parser.WHERE_EXISTS {
+		return toMatchResult(result.Exists()), nil
+	}
+	recordVal, err := getExpressionValue(record, condition.Left, fields)
+	if err != nil {
+		return matchFalse, err
+	}
+	found, unknown := result.Contains(recordVal)
+	if unknown {
+		return matchUnknown, nil
+	}
+	return toMatchResult(found), nil
+}
+
+func patternComparison(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
+	recordVal, err := getExpressionValue(record, condition.Left, fields)
+	if err != nil {
+		return matchFalse, err
+	}
+	if parser.IsNull(recordVal) {
+		return matchUnknown, nil
+	}
+	return toMatchResult(condition.Right.(*parser.PatternExpression).Match(recordVal)), nil
+}
+
+func match(record *protocol.Record, condition *parser.WhereExpression, fields []string) (matchResult, error) {
 	switch condition.Type {
+	case parser.WHERE_IN:
+		return inComparison(record, condition, fields)
+	case parser.WHERE_IN_SUBQUERY, parser.WHERE_EXISTS:
+		return subqueryComparison(record, condition, fields)
+	case parser.WHERE_LIKE, parser.WHERE_REGEXP:
+		return patternComparison(record, condition, fields)
+	case parser.WHERE_IS_NULL:
+		recordVal, err := getExpressionValue(record, condition.Left, fields)
+		if err != nil {
+			return matchFalse, err
+		}
+		return toMatchResult(parser.IsNull(recordVal)), nil
 	case parser.WHERE_BETWEEN:
 		return betweenComparison(record, condition, fields)
 	case parser.WHERE_COMPARISON:
 		return matchComparison(record, condition, fields)
 	case parser.WHERE_AND:
-		if matched, err := match(record, condition.Left.(*parser.WhereExpression), fields); !matched || err != nil {
-			return matched, err
-		} else {
-			return match(record, condition.Right.(*parser.WhereExpression), fields)
+		// false wins over unknown
+		left, err := match(record, condition.Left.(*parser.WhereExpression), fields)
+		if left == matchFalse || err != nil {
+			return left, err
+		}
+		right, err := match(record, condition.Right.(*parser.WhereExpression), fields)
+		if right == matchFalse || err != nil {
+			return right, err
+		}
+		if left == matchUnknown || right == matchUnknown {
+			return matchUnknown, nil
+		}
+		return matchTrue, nil
+	case parser.WHERE_OR:
+		// true wins over unknown
+		left, err := match(record, condition.Left.(*parser.WhereExpression), fields)
+		if left == matchTrue || err != nil {
+			return left, err
+		}
+		right, err := match(record, condition.Right.(*parser.WhereExpression), fields)
+		if right == matchTrue || err != nil {
+			return right, err
+		}
+		if left == matchUnknown || right == matchUnknown {
+			return matchUnknown, nil
+		}
+		return matchFalse, nil
+	case parser.WHERE_NOT:
+		matched, err := match(record, condition.Left.(*parser.WhereExpression), fields)
+		if err != nil {
+			return matchFalse, err
+		}
+		switch matched {
+		case matchTrue:
+			return matchFalse, nil
+		case matchFalse:
+			return matchTrue, nil
 		}
+		return matchUnknown, nil
 	default:
 		panic(fmt.Errorf("UNKNOWN Where Type"))
 	}
@@ -125,17 +258,98 @@ func match(record *protocol.Record, condition *parser.WhereExpression, fields []
 }
 
 func filterFields(records []*protocol.Record, selectFields, fetchFields []string) []*protocol.Record {
-	selectFieldSet := util.NewStringSetFromStrings(selectFields)
+	fieldIdxs := make([]int, len(selectFields))
+	for i, selectField := range selectFields {
+		fieldIdxs[i] = -1
+		for j, field := range fetchFields {
+			if field == selectField {
+				fieldIdxs[i] = j
+				break
+			}
+		}
+	}
+	for _, record := range records {
+		newValues := make([]*protocol.FieldValue, len(selectFields))
+		for i, idx := range fieldIdxs {
+			if idx != -1 {
+				newValues[i] = record.Values[idx]
+			}
+		}
+		record.Values = newValues
+	}
+	return records
+}
+
+// projectRecords evaluates the select list against every record
+func projectRecords(records []*protocol.Record, scalars []*parser.Scalar, fields []string) ([]*protocol.Record, error) {
 	for _, record := range records {
-		newValues := make([]*protocol.FieldValue, 0, len(selectFields))
-		for i, field := range fetchFields {
-			if !selectFieldSet.Exists(field) {
-				continue
+		newValues := make([]*protocol.FieldValue, len(scalars))
+		for i, scalar := range scalars {
+			val, err := getScalarValue(record, scalar, fields)
+			if err != nil {
+				return nil, err
 			}
-			newValues = append(newValues, record.Values[i])
+			newValues[i] = val.GetVal()
 		}
 		record.Values = newValues
 	}
+	return records, nil
+}
+
+func valuesEqual(left, right []*protocol.FieldValue) bool {
+	for i, value := range left {
+		if !NewLiteral(value).Equal(NewLiteral(right[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesKey prints the values for bucketing, equal values always get the same
+// key. An INT equals a DOUBLE of the same value, so numbers print as floats
+func valuesKey(values []*protocol.FieldValue) string {
+	keyBuffer := bytes.NewBuffer(make([]byte, 0, 32))
+	for _, value := range values {
+		if value != nil && value.IntVal != nil {
+			fmt.Fprintf(keyBuffer, "%v|", float64(value.GetIntVal()))
+		} else {
+			fmt.Fprintf(keyBuffer, "%v|", NewLiteral(value).GetVal().GetValue())
+		}
+	}
+	return keyBuffer.String()
+}
+
+// distinctRecords keeps the first of every group of equal records. Records are
+// bucketed by their printed values, so only records in the same bucket get compared
+func distinctRecords(records []*protocol.Record) []*protocol.Record {
+	buckets := make(map[string][]*protocol.Record)
+	res := make([]*protocol.Record, 0, len(records))
+	for _, record := range records {
+		key := valuesKey(record.Values)
+		duplicated := false
+		for _, other := range buckets[key] {
+			if valuesEqual(record.Values, other.Values) {
+				duplicated = true
+				break
+			}
+		}
+		if !duplicated {
+			buckets[key] = append(buckets[key], record)
+			res = append(res, record)
+		}
+	}
+	return res
+}
+
+// pageRecords skips the first offset records and keeps at most limit of the rest
+func pageRecords(records []*protocol.Record, offset, limit int) []*protocol.Record {
+	if offset >= len(records) {
+		return records[:0]
+	}
+	records = records[offset:]
+	if limit != -1 && len(records) > limit {
+		records = records[:limit]
+	}
 	return records
 }
 
@@ -146,14 +360,11 @@ func filterCondition(records []*protocol.Record, condition *parser.WhereExpressi
 	} else {
 		var res []*protocol.Record
 		for _, record := range records {
-			for _, value := range record.GetValues() {
-				glog.Errorln(value.String())
-			}
 			matched, err := match(record, condition, fields)
 			if err != nil {
 				return nil, err
 			}
-			if matched {
+			if matched == matchTrue {
 				res = append(res, record)
 			}
 		}
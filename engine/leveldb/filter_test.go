@@ -0,0 +1,96 @@
+package leveldb
+
+import (
+	"testing"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func newRecord(values ...interface{}) *protocol.Record {
+	record := &protocol.Record{Values: make([]*protocol.FieldValue, len(values))}
+	for i, value := range values {
+		switch v := value.(type) {
+		case int:
+			val := int64(v)
+			record.Values[i] = &protocol.FieldValue{IntVal: &val}
+		case float64:
+			record.Values[i] = &protocol.FieldValue{DoubleVal: &v}
+		case string:
+			record.Values[i] = &protocol.FieldValue{StrVal: &v}
+		}
+	}
+	return record
+}
+
+func recordValues(records []*protocol.Record) [][]interface{} {
+	res := make([][]interface{}, len(records))
+	for i, record := range records {
+		for _, value := range record.Values {
+			res[i] = append(res[i], NewLiteral(value).GetVal().GetValue())
+		}
+	}
+	return res
+}
+
+func TestDistinctRecords(t *testing.T) {
+	for _, c := range []struct {
+		in, out []*protocol.Record
+	}{
+		{[]*protocol.Record{}, []*protocol.Record{}},
+		{
+			[]*protocol.Record{newRecord(1, "a"), newRecord(2, "a"), newRecord(1, "a"), newRecord(1, "b")},
+			[]*protocol.Record{newRecord(1, "a"), newRecord(2, "a"), newRecord(1, "b")},
+		},
+		// NULLs are equal to each other and to nothing else
+		{
+			[]*protocol.Record{newRecord(nil), newRecord(0), newRecord(nil), newRecord("")},
+			[]*protocol.Record{newRecord(nil), newRecord(0), newRecord("")},
+		},
+		// an INT and a DOUBLE of the same value are the same, the first one is kept
+		{
+			[]*protocol.Record{newRecord(1), newRecord(1.0), newRecord(1.5), newRecord(1000000000000000000), newRecord(1e18)},
+			[]*protocol.Record{newRecord(1), newRecord(1.5), newRecord(1000000000000000000)},
+		},
+		{
+			[]*protocol.Record{newRecord(2.0, "x"), newRecord(2, "x"), newRecord(2, "2")},
+			[]*protocol.Record{newRecord(2.0, "x"), newRecord(2, "2")},
+		},
+	} {
+		assert.Equal(t, recordValues(distinctRecords(c.in)), recordValues(c.out))
+	}
+}
+
+func TestPageRecords(t *testing.T) {
+	records := []*protocol.Record{newRecord(1), newRecord(2), newRecord(3)}
+	for _, c := range []struct {
+		offset, limit int
+		out           []*protocol.Record
+	}{
+		{0, -1, records},
+		{0, 2, records[:2]},
+		{1, -1, records[1:]},
+		{1, 1, records[1:2]},
+		{2, 5, records[2:]},
+		{3, -1, records[:0]},
+		{5, 1, records[:0]},
+		{0, 0, records[:0]},
+	} {
+		assert.Equal(t, pageRecords(records, c.offset, c.limit), c.out)
+	}
+}
+
+func TestProjectRecords(t *testing.T) {
+	query, err := parser.Parse("SELECT a AS p1, price * 2 AS double_price, a AS p2, 1 AS one, NULL FROM t")
+	assert.Equal(t, err, nil)
+	scalars := query.Statement.(*parser.SelectQuery).ScalarList.ScalarList
+	records := []*protocol.Record{newRecord("x", 1.5), newRecord("y", nil)}
+	records, err = projectRecords(records, scalars, []string{"a", "price"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recordValues(records), [][]interface{}{
+		{"x", 3.0, "x", int64(1), nil},
+		{"y", nil, "y", int64(1), nil},
+	})
+}
@@ -54,6 +54,16 @@ func genereateColumnId(table, column string) []byte {
 	return idBuffer.Bytes()
 }
 
+// generateRecordKey builds the key of a cell: column id | _id | timestamp | sequence
+func generateRecordKey(columnId []byte, id, timestamp int64, sequenceNum uint32) []byte {
+	keyBuffer := bytes.NewBuffer(make([]byte, 0, 28))
+	keyBuffer.Write(columnId)
+	binary.Write(keyBuffer, binary.BigEndian, id)
+	binary.Write(keyBuffer, binary.BigEndian, timestamp)
+	binary.Write(keyBuffer, binary.BigEndian, sequenceNum)
+	return keyBuffer.Bytes()
+}
+
 func genereateMetaTableKey(table string) []byte {
 	return []byte(table)
 }
@@ -67,6 +77,37 @@ func appendReversedIdFieldsIfNeeded(fields []string) []string {
 	return append(fields, RESERVED_ID_COLUMN)
 }
 
+// splitTimestampField returns the stored columns among fields and where the
+// _timestamp pseudo-column is, -1 if it isn't. The pseudo-column is the
+// timestamp of the _id cell, which every insert and update writes, so _id is
+// read along with it, last when it wasn't asked for.
+func splitTimestampField(fields []string) ([]string, int) {
+	columns := make([]string, 0, len(fields))
+	timestampIdx := -1
+	for i, field := range fields {
+		if field == RESERVED_TIMESTAMP_COLUMN {
+			timestampIdx = i
+		} else {
+			columns = append(columns, field)
+		}
+	}
+	if len(columns) == 0 || timestampIdx != -1 {
+		columns = appendReversedIdFieldsIfNeeded(columns)
+	}
+	return columns, timestampIdx
+}
+
+// insertTimestamp returns the values of record with its write timestamp at
+// timestampIdx, fieldCount is the number of fields asked for and an _id read
+// only for the timestamp is left out
+func insertTimestamp(record *protocol.Record, timestampIdx, fieldCount int) []*protocol.FieldValue {
+	ts := record.GetTimestamp()
+	values := make([]*protocol.FieldValue, 0, fieldCount)
+	values = append(values, record.Values[:timestampIdx]...)
+	values = append(values, &protocol.FieldValue{TimestampVal: &ts})
+	return append(values, record.Values[timestampIdx:fieldCount-1]...)
+}
+
 func getIdsFromRecords(fields []string, records []*protocol.Record) (res []int64) {
 	res = make([]int64, 0, len(records))
 	idIdx := -1
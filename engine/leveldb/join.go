@@ -0,0 +1,183 @@
+package leveldb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+)
+
+// joinSide is one table of a join, the columns read from it and where each
+// of them goes in the joined record, -1 for the key only read to join
+type joinSide struct {
+	table  string
+	key    string
+	keyIdx int
+	fields []string
+	slots  []int
+}
+
+func (self *joinSide) addField(column string, slot int) int {
+	for i, field := range self.fields {
+		if field == column {
+			if slot != -1 {
+				self.slots[i] = slot
+			}
+			return i
+		}
+	}
+	self.fields = append(self.fields, column)
+	self.slots = append(self.slots, slot)
+	return len(self.fields) - 1
+}
+
+func (self *joinSide) fill(values []*protocol.FieldValue, record *protocol.Record) {
+	for i, slot := range self.slots {
+		if slot != -1 {
+			values[slot] = record.Values[i]
+		}
+	}
+}
+
+// joinPlan tells how the two tables of a join are read. The inner table is
+// read by _id when the join is on its _id, seeking to the ids the outer
+// records refer to, otherwise both are scanned and the inner one is hashed.
+type joinPlan struct {
+	outer, inner *joinSide
+	byId         bool
+}
+
+// planJoin splits the qualified fetchFields between the tables of the join
+func planJoin(query *parser.SelectQuery, fetchFields []string) *joinPlan {
+	_, leftKey := parser.SplitColumn(query.Join.Left)
+	_, rightKey := parser.SplitColumn(query.Join.Right)
+	plan := &joinPlan{
+		outer: &joinSide{table: query.Table, key: leftKey},
+		inner: &joinSide{table: query.Join.Table, key: rightKey},
+	}
+	if leftKey == RESERVED_ID_COLUMN && rightKey != RESERVED_ID_COLUMN {
+		plan.outer, plan.inner = plan.inner, plan.outer
+	}
+	plan.byId = plan.inner.key == RESERVED_ID_COLUMN
+	for i, field := range fetchFields {
+		table, column := parser.SplitColumn(field)
+		for _, side := range []*joinSide{plan.outer, plan.inner} {
+			if side.table == table {
+				side.addField(column, i)
+			}
+		}
+	}
+	for _, side := range []*joinSide{plan.outer, plan.inner} {
+		side.keyIdx = side.addField(side.key, -1)
+	}
+	return plan
+}
+
+func (self *joinPlan) String() string {
+	on := parser.QualifyColumn(self.outer.table, self.outer.key) + " = " + parser.QualifyColumn(self.inner.table, self.inner.key)
+	if self.byId {
+		return fmt.Sprintf("index nested loop on %s, seek table %s by _id, fetch %v", on, self.inner.table, self.inner.fields)
+	}
+	return fmt.Sprintf("hash join on %s, scan and hash table %s, fetch %v", on, self.inner.table, self.inner.fields)
+}
+
+// joinId is the _id a key refers to, an _id is never NULL and only equals
+// integers
+func joinId(value *protocol.FieldValue) (int64, bool) {
+	node := parser.NewFieldLiteral(value)
+	switch node.GetType() {
+	case protocol.INT:
+		return node.GetVal().GetIntVal(), node.GetVal().GetIntVal() >= 0
+	case protocol.DOUBLE:
+		val := node.GetVal().GetDoubleVal()
+		return int64(val), val >= 0 && val == float64(int64(val))
+	}
+	return 0, false
+}
+
+// fetchJoin reads both tables of a join and returns the joined records
+// matching the WHERE condition, their fields are fetchFields
+func (self *LevelDBEngine) fetchJoin(query *parser.SelectQuery, fetchFields []string, trace queryTrace) (*fetchResult, error) {
+	condition, err := parser.ResolveSubqueries(query.WhereExpression, self.Fetch)
+	if err != nil {
+		return nil, err
+	}
+	plan := planJoin(query, fetchFields)
+	outer, inner := plan.outer, plan.inner
+
+	allIds := []*parser.IdRange{&parser.IdRange{Start: 0, End: parser.MaximumRange}}
+	start := time.Now()
+	outerResult, err := self.fetchAll(nil, outer.table, outer.fields, allIds)
+	if err != nil {
+		return nil, err
+	}
+	trace.record("scan", start, outerResult.scanned, outerResult.keysRead)
+
+	start = time.Now()
+	var innerResult *fetchResult
+	// the inner records an outer key matches, by parser.HashKey or by _id
+	matches := make(map[string][]*protocol.Record)
+	if plan.byId {
+		ids := make([]int64, 0, len(outerResult.records))
+		for _, record := range outerResult.records {
+			if id, ok := joinId(record.Values[outer.keyIdx]); ok {
+				ids = append(ids, id)
+			}
+		}
+		idRanges := parser.IdRangesOf(ids)
+		if innerResult, err = self.fetchAll(nil, inner.table, inner.fields, idRanges); err != nil {
+			return nil, err
+		}
+		for _, record := range innerResult.records {
+			key := fmt.Sprint(record.GetId())
+			matches[key] = append(matches[key], record)
+		}
+	} else {
+		if innerResult, err = self.fetchAll(nil, inner.table, inner.fields, allIds); err != nil {
+			return nil, err
+		}
+		for _, record := range innerResult.records {
+			// NULL equals nothing, not even NULL
+			if node := parser.NewFieldLiteral(record.Values[inner.keyIdx]); !parser.IsNull(node) {
+				key := parser.HashKey(node)
+				matches[key] = append(matches[key], record)
+			}
+		}
+	}
+
+	result := &fetchResult{
+		scanned:  outerResult.scanned + innerResult.scanned,
+		keysRead: outerResult.keysRead + innerResult.keysRead,
+	}
+	for _, outerRecord := range outerResult.records {
+		var key string
+		if plan.byId {
+			id, ok := joinId(outerRecord.Values[outer.keyIdx])
+			if !ok {
+				continue
+			}
+			key = fmt.Sprint(id)
+		} else {
+			node := parser.NewFieldLiteral(outerRecord.Values[outer.keyIdx])
+			if parser.IsNull(node) {
+				continue
+			}
+			key = parser.HashKey(node)
+		}
+		for _, innerRecord := range matches[key] {
+			values := make([]*protocol.FieldValue, len(fetchFields))
+			outer.fill(values, outerRecord)
+			inner.fill(values, innerRecord)
+			result.records = append(result.records, &protocol.Record{Values: values})
+		}
+	}
+	trace.record("join", start, len(result.records), innerResult.keysRead)
+
+	start = time.Now()
+	if result.records, err = filterCondition(result.records, condition, fetchFields); err != nil {
+		return nil, err
+	}
+	trace.record("filter", start, len(result.records), 0)
+	return result, nil
+}
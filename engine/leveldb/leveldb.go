@@ -5,10 +5,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"time"
 
 	abstract "github.com/senarukana/fundb/engine/interface"
 	"github.com/senarukana/fundb/parser"
 	"github.com/senarukana/fundb/protocol"
+	"github.com/senarukana/fundb/util"
 
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/golang/glog"
@@ -21,25 +23,34 @@ const (
 	LEVELDB_BLOOM_FILTER_BITS = 64
 	LEVELDB_MAX_RECORD_NUM    = 100000
 	LEVELDB_MAX_FETCH_SIZE    = 1024 * 1024 // 1MB
+	INSERT_SELECT_BATCH_SIZE  = 1000
 	LEVELDB_META_NUM          = 4
 	SEPERATOR                 = '|'
 	SEED                      = 987654
 	RESERVED_ID_COLUMN        = "_id"
+	RESERVED_TIMESTAMP_COLUMN = parser.TIMESTAMP_COLUMN
 )
 
 var (
 	EMPTYBYTE             = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 	LEVELDB_META_PREFIX   = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	LEVELDB_SCHEMA_PREFIX = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
 	LEVELDB_FIELDS_PREFIX = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10}
 )
 
 type LevelDBEngine struct {
 	*levigo.DB
-	meta *meta
+	// table is the one the engine was opened with, meta holds its counters
+	table string
+	meta  *meta
+	// schemas of the typed tables, schemaless tables have none
+	schemas map[string]protocol.Schema
 }
 
 func NewLevelDBEngine() abstract.StoreEngine {
-	leveldbEngine := &LevelDBEngine{}
+	leveldbEngine := &LevelDBEngine{
+		schemas: make(map[string]protocol.Schema),
+	}
 	return leveldbEngine
 }
 
@@ -96,8 +107,8 @@ func (self *LevelDBEngine) Init(dataPath string, tableName string) error {
 	if err != nil {
 		return err
 	}
-	self.meta = meta
-	return nil
+	self.table, self.meta = tableName, meta
+	return self.loadSchemas()
 }
 
 // func (self *LevelDBEngine) updateMeta(table string) error {
@@ -147,16 +158,27 @@ func (self *LevelDBEngine) Init(dataPath string, tableName string) error {
 // }
 
 func (self *LevelDBEngine) insertOrDelete(recordList *protocol.RecordList, isDelete bool, ids []int64) error {
-	var id int64
-
+	tableMeta, err := self.tableMeta(recordList.GetName())
+	if err != nil {
+		return err
+	}
 	size := 0
 	wo := levigo.NewWriteOptions()
 	wb := levigo.NewWriteBatch()
 	defer wo.Close()
 	defer wb.Close()
 
+	var it *levigo.Iterator
+	if isDelete {
+		ro := levigo.NewReadOptions()
+		defer ro.Close()
+		it = self.NewIterator(ro)
+		defer it.Close()
+	}
+
 	for i, record := range recordList.Values {
-		if isDelete {
+		var id int64
+		if ids != nil {
 			id = ids[i]
 		}
 		for fieldIndex, field := range recordList.Fields {
@@ -164,13 +186,7 @@ func (self *LevelDBEngine) insertOrDelete(recordList *protocol.RecordList, isDel
 				record.Values[fieldIndex].IntVal = &id
 			}
 			columnId := ti.GetFieldValAndUpdate(field)
-			idBuffer := bytes.NewBuffer(make([]byte, 0, 8))
-			tsBuffer := bytes.NewBuffer(make([]byte, 0, 8))
-			sequenceNumberBuffer := bytes.NewBuffer(make([]byte, 0, 4))
-			binary.Write(idBuffer, binary.BigEndian, id)
-			binary.Write(tsBuffer, binary.BigEndian, record.GetTimestamp())
-			binary.Write(sequenceNumberBuffer, binary.BigEndian, record.GetSequenceNum())
-			recordKey := append(append(columnId, idBuffer.Bytes()...), append(tsBuffer.Bytes(), sequenceNumberBuffer.Bytes()...)...)
+			recordKey := generateRecordKey(columnId, id, record.GetTimestamp(), record.GetSequenceNum())
 
 			if !isDelete {
 				glog.V(2).Infof("Insert : %s, recordKey: %v", record.Values[fieldIndex].String(), recordKey)
@@ -181,8 +197,13 @@ func (self *LevelDBEngine) insertOrDelete(recordList *protocol.RecordList, isDel
 				wb.Put(recordKey, data)
 				size += len(data) + len(recordKey)
 			} else {
-				glog.V(2).Infof("Delete, recordKey : %v", recordKey)
-				wb.Delete(recordKey)
+				// a cell may hold several versions after an UPDATE, remove all of them
+				cellPrefix := recordKey[:16]
+				for it.Seek(cellPrefix); it.Valid() && bytes.HasPrefix(it.Key(), cellPrefix); it.Next() {
+					glog.V(2).Infof("Delete, recordKey : %v", it.Key())
+					wb.Delete(it.Key())
+					size += len(it.Value()) + len(it.Key())
+				}
 			}
 		}
 	}
@@ -190,13 +211,13 @@ func (self *LevelDBEngine) insertOrDelete(recordList *protocol.RecordList, isDel
 		return err
 	}
 	if !isDelete {
-		self.meta.size += size
-		self.meta.records += len(recordList.Values)
+		tableMeta.size += size
+		tableMeta.records += len(recordList.Values)
 	} else {
-		self.meta.size -= size
-		self.meta.records -= len(recordList.Values)
+		tableMeta.size -= size
+		tableMeta.records -= len(recordList.Values)
 	}
-	if err := self.meta.Sync(self); err != nil {
+	if err := tableMeta.Sync(self); err != nil {
 		return err
 	}
 	return nil
@@ -236,9 +257,26 @@ func (self *LevelDBEngine) deleteObsoleteRecord(iterators []*levigo.Iterator, re
 	return self.Write(wo, wb)
 }
 
-func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName string, fetchFields []string, idStart, idEnd int64, limit int) ([]*protocol.Record, error) {
-	if !self.schema.Exist(tableName) {
-		return nil, fmt.Errorf("Table %s not existed", tableName)
+// fetchResult holds the records a scan matched and where the scan stopped
+type fetchResult struct {
+	records []*protocol.Record
+	// lastId is the last _id scanned, whether it matched or not
+	lastId int64
+	// truncated is set when the scan stopped at LEVELDB_MAX_FETCH_SIZE
+	truncated bool
+	// scanned counts the records read and keysRead the cells, for EXPLAIN ANALYZE
+	scanned  int
+	keysRead int
+}
+
+// fetch scans the ids in [idStart, idEnd] and keeps the records matching
+// condition, limit counts matched records and -1 is no limit
+func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName string, fetchFields []string, idStart, idEnd int64, limit int) (*fetchResult, error) {
+	// the column ids are those of the table read, a join or a subquery
+	// reads another table than the one the engine was opened with
+	tableMeta, err := self.tableMeta(tableName)
+	if err != nil {
+		return nil, err
 	}
 
 	idStartBytesBuffer := bytes.NewBuffer(make([]byte, 0, 8))
@@ -248,12 +286,19 @@ func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName st
 	idStartBytes := idStartBytesBuffer.Bytes()
 	idEndBytes := idEndBytesBuffer.Bytes()
 
-	fieldPairs, err := self.meta.GetFieldPairs(fetchFields)
+	columns, timestampIdx := splitTimestampField(fetchFields)
+	fieldPairs, err := tableMeta.GetFieldPairs(columns)
 	if err != nil {
 		return nil, err
 	}
 	fieldCount := len(fieldPairs)
 	iterators := make([]*levigo.Iterator, fieldCount, fieldCount)
+	idIdx := -1
+	for i, column := range columns {
+		if column == RESERVED_ID_COLUMN {
+			idIdx = i
+		}
+	}
 
 	// start the iterators to go through the series data
 	for i, fieldPair := range fieldPairs {
@@ -264,14 +309,10 @@ func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName st
 		defer iterators[i].Close()
 	}
 
-	var records []*protocol.Record
+	result := &fetchResult{}
 	rawRecordValues := make([]*rawRecordValue, fieldCount, fieldCount)
 	isValid := true
 
-	if limit == -1 {
-		limit = LEVELDB_MAX_RECORD_NUM
-	}
-
 	resultByteCount := 0
 
 	for isValid {
@@ -309,7 +350,10 @@ func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName st
 				var id, ts int64
 				var sequence uint32
 				isValid = true
+				// deleteObsoleteRecord left the iterator on the newest version of the cell
+				rawRecordValues[i] = &rawRecordValue{recordKey: newRecordKey(it.Key()), value: it.Value()}
 				it.Next()
+				result.keysRead++
 				fv := &protocol.FieldValue{}
 				err := proto.Unmarshal(rawRecordValues[i].value, fv)
 				if err != nil {
@@ -322,38 +366,261 @@ func (self *LevelDBEngine) fetch(condition *parser.WhereExpression, tableName st
 
 				record.Values[i] = fv
 				record.Id = &id
-				record.Timestamp = &ts
+				// every write of a record writes its _id cell, without it
+				// the newest cell read is the best guess
+				if i == idIdx || (idIdx == -1 && (record.Timestamp == nil || ts > record.GetTimestamp())) {
+					record.Timestamp = &ts
+				}
 				record.SequenceNum = &sequence
 				rawRecordValues[i] = nil
 			}
 		}
 		if isValid {
-			limit--
-			records = append(records, record)
+			if timestampIdx != -1 {
+				record.Values = insertTimestamp(record, timestampIdx, len(fetchFields))
+			}
+			result.scanned++
+			result.lastId = record.GetId()
+			matched := matchTrue
+			if condition != nil {
+				matched, err = match(record, condition, fetchFields)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if matched == matchTrue {
+				if limit != -1 {
+					limit--
+				}
+				result.records = append(result.records, record)
+			}
 
 			// add byte count for the timestamp and the sequence
 			resultByteCount += 16
 
 			// check if we should send the batch along
 			if resultByteCount > LEVELDB_MAX_FETCH_SIZE {
+				result.truncated = true
 				break
 			}
 		}
-		if limit < 1 {
+		if limit == 0 {
 			break
 		}
 	}
 
-	glog.Errorf("filtered results = %d", len(records))
-	return filterCondition(records, condition, fetchFields)
+	glog.Errorf("filtered results = %d", len(result.records))
+	return result, nil
 }
 
-func (self *LevelDBEngine) Insert(recordList *protocol.RecordList) error {
-	return self.insertOrDelete(recordList, false, nil)
+// fetchRanges seeks to every id range in turn instead of scanning the gaps between them
+func (self *LevelDBEngine) fetchRanges(condition *parser.WhereExpression, tableName string, fetchFields []string, idRanges []*parser.IdRange, limit int) (*fetchResult, error) {
+	result := &fetchResult{}
+	for _, idRange := range idRanges {
+		rangeResult, err := self.fetch(condition, tableName, fetchFields, idRange.Start, idRange.End, limit)
+		if err != nil {
+			return nil, err
+		}
+		result.records = append(result.records, rangeResult.records...)
+		result.lastId = rangeResult.lastId
+		result.scanned += rangeResult.scanned
+		result.keysRead += rangeResult.keysRead
+		if rangeResult.truncated {
+			result.truncated = true
+			break
+		}
+		if limit != -1 {
+			limit -= len(rangeResult.records)
+			if limit < 1 {
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// fetchAll is fetchRanges without a limit for the callers that need every
+// matching record, a scan stopped at LEVELDB_MAX_FETCH_SIZE is resumed after
+// the last _id it read
+func (self *LevelDBEngine) fetchAll(condition *parser.WhereExpression, tableName string, fetchFields []string, idRanges []*parser.IdRange) (*fetchResult, error) {
+	result := &fetchResult{}
+	for len(idRanges) > 0 {
+		partResult, err := self.fetchRanges(condition, tableName, fetchFields, idRanges, -1)
+		if err != nil {
+			return nil, err
+		}
+		result.records = append(result.records, partResult.records...)
+		result.lastId = partResult.lastId
+		result.scanned += partResult.scanned
+		result.keysRead += partResult.keysRead
+		if !partResult.truncated {
+			break
+		}
+		idRanges = idRangesAfter(idRanges, partResult.lastId)
+	}
+	return result, nil
+}
+
+// idRangesAfter returns the part of idRanges after id
+func idRangesAfter(idRanges []*parser.IdRange, id int64) []*parser.IdRange {
+	var res []*parser.IdRange
+	for _, idRange := range idRanges {
+		if idRange.End <= id {
+			continue
+		}
+		if idRange.Start <= id {
+			idRange = &parser.IdRange{Start: id + 1, End: idRange.End}
+		}
+		res = append(res, idRange)
+	}
+	return res
+}
+
+func (self *LevelDBEngine) Insert(recordList *protocol.RecordList, onConflict parser.ConflictAction) error {
+	if schema, ok := self.schemas[recordList.GetName()]; ok {
+		if err := checkSchema(schema, recordList); err != nil {
+			return err
+		}
+	}
+	var ids []int64
+	for _, field := range recordList.Fields {
+		if field == RESERVED_ID_COLUMN {
+			ids = getIdsFromRecords(recordList.Fields, recordList.Values)
+			break
+		}
+	}
+	if ids != nil {
+		if err := self.resolveConflicts(recordList.GetName(), ids, onConflict); err != nil {
+			return err
+		}
+	}
+	return self.insertOrDelete(recordList, false, ids)
+}
+
+// resolveConflicts looks up the records of table whose _id is among ids,
+// writing a cell again would silently add a newer version of it. It fails on
+// the first one found unless they are to be overwritten: REPLACE deletes them
+// first, ON CONFLICT DO UPDATE writes over the columns inserted and keeps the
+// others.
+func (self *LevelDBEngine) resolveConflicts(table string, ids []int64, onConflict parser.ConflictAction) error {
+	idSet := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		if idSet[id] && onConflict == parser.CONFLICT_FAIL {
+			return fmt.Errorf("_id %d is inserted twice into table %s", id, table)
+		}
+		idSet[id] = true
+	}
+	result, err := self.fetchAll(nil, table, []string{RESERVED_ID_COLUMN}, parser.IdRangesOf(ids))
+	if err != nil {
+		return err
+	}
+	if len(result.records) == 0 {
+		return nil
+	}
+	switch onConflict {
+	case parser.CONFLICT_REPLACE:
+		return self.deleteRecords(table, result.records, getIdsFromRecords([]string{RESERVED_ID_COLUMN}, result.records))
+	case parser.CONFLICT_UPDATE:
+		// the records are counted already
+		tableMeta, err := self.tableMeta(table)
+		if err != nil {
+			return err
+		}
+		tableMeta.records -= len(result.records)
+		return nil
+	}
+	return fmt.Errorf("_id %d already exists in table %s, use ON CONFLICT(_id) DO UPDATE or REPLACE INTO to overwrite it",
+		result.records[0].GetId(), table)
+}
+
+// InsertSelect runs the SELECT of query and inserts its rows, an _id ordered
+// SELECT is read a batch at a time, resuming after the last _id copied
+func (self *LevelDBEngine) InsertSelect(query *parser.InsertQuery) (int64, error) {
+	// folded once, so that every batch sees the same NOW()
+	folded, err := parser.Fold(query.Select)
+	if err != nil {
+		return 0, err
+	}
+	source := folded.(*parser.SelectQuery)
+	paged := isIdOrdered(source)
+	// nextPage reads the rows after cursor, the LIMIT of the SELECT counts the
+	// rows of every batch and its OFFSET only skips rows in the first one
+	nextPage := func(cursor int64, copied int64) *parser.SelectQuery {
+		limit := INSERT_SELECT_BATCH_SIZE
+		if source.Limit != -1 && int64(source.Limit)-copied < int64(limit) {
+			limit = source.Limit - int(copied)
+		}
+		page := source.After(cursor, limit)
+		if cursor != -1 {
+			page.Offset = 0
+		}
+		return page
+	}
+	page := source
+	if paged {
+		page = nextPage(-1, 0)
+	}
+	var inserted int64
+	for {
+		res, err := self.Fetch(page)
+		if err != nil {
+			return inserted, err
+		}
+		fields := query.GetSelectFields(res.Fields)
+		if len(fields) != len(res.Fields) {
+			return inserted, fmt.Errorf("Incompatible fields(%d) and selected values(%d)", len(fields), len(res.Fields))
+		}
+		if !util.NewStringSetFromStrings(fields).Exists(RESERVED_ID_COLUMN) {
+			return inserted, fmt.Errorf("INSERT ... SELECT needs the _id of the rows copied")
+		}
+		for start := 0; start < len(res.Values); start += INSERT_SELECT_BATCH_SIZE {
+			end := start + INSERT_SELECT_BATCH_SIZE
+			if end > len(res.Values) {
+				end = len(res.Values)
+			}
+			// the copies are new writes, not versions of the rows read
+			ts := time.Now().UnixNano()
+			for i, record := range res.Values[start:end] {
+				sequence := uint32(i)
+				record.Timestamp, record.SequenceNum = &ts, &sequence
+			}
+			recordList := &protocol.RecordList{
+				Name:   &query.Table,
+				Fields: fields,
+				Values: res.Values[start:end],
+			}
+			if err := self.Insert(recordList, query.OnConflict); err != nil {
+				return inserted, err
+			}
+			inserted += int64(end - start)
+		}
+		if !paged || res.NextCursor == nil || (source.Limit != -1 && inserted >= int64(source.Limit)) {
+			return inserted, nil
+		}
+		page = nextPage(res.GetNextCursor(), inserted)
+	}
+}
+
+// getIdCondition runs the subqueries of condition once, their results are
+// probed for every record scanned, then splits out the _id ranges to scan
+func (self *LevelDBEngine) getIdCondition(condition *parser.WhereExpression) (*parser.WhereExpression, []*parser.IdRange, error) {
+	condition, err := parser.ResolveSubqueries(condition, self.Fetch)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parser.GetIdCondition(condition)
 }
 
 func (self *LevelDBEngine) Delete(query *parser.DeleteQuery) (int64, error) {
-	condition, idStart, idEnd, err := parser.GetIdCondition(query.WhereExpression)
+	folded, err := parser.Fold(query)
+	if err != nil {
+		return -1, err
+	}
+	return self.deleteQuery(folded.(*parser.DeleteQuery), nil)
+}
+
+func (self *LevelDBEngine) deleteQuery(query *parser.DeleteQuery, trace queryTrace) (int64, error) {
+	condition, idRanges, err := self.getIdCondition(query.WhereExpression)
 	if err != nil {
 		return -1, err
 	}
@@ -365,58 +632,355 @@ func (self *LevelDBEngine) Delete(query *parser.DeleteQuery) (int64, error) {
 
 	fields := query.WhereExpression.GetConditionFields()
 
-	glog.V(1).Infof("table %s, fields %v, start %d, end %d", query.Table, fields, idStart, idEnd)
-	records, err := self.fetch(condition, query.Table, fields, idStart, idEnd, -1)
+	glog.V(1).Infof("table %s, fields %v, ranges %v", query.Table, fields, idRanges)
+	start := time.Now()
+	result, err := self.fetchAll(condition, query.Table, fields, idRanges)
 	if err != nil {
 		return -1, err
 	}
+	trace.scan(start, result)
+	records := result.records
 
 	ids := getIdsFromRecords(fields, records)
+	start = time.Now()
+
+	if err := self.deleteRecords(query.Table, records, ids); err != nil {
+		return -1, err
+	} else {
+		trace.record("delete", start, len(records), 0)
+		return int64(len(records)), nil
+	}
+}
 
-	// delete all fields
-	deleteFields := ti.GetAllFields()
+// deleteRecords removes every column of the records with ids
+func (self *LevelDBEngine) deleteRecords(table string, records []*protocol.Record, ids []int64) error {
+	fields, err := self.tableFields(table)
+	if err != nil {
+		return err
+	}
 	recordList := &protocol.RecordList{
-		Name:   &query.Table,
-		Fields: deleteFields,
+		Name:   &table,
+		Fields: fields,
 		Values: records,
 	}
-	if err := self.insertOrDelete(recordList, true, ids); err != nil {
+	return self.insertOrDelete(recordList, true, ids)
+}
+
+func (self *LevelDBEngine) Update(query *parser.UpdateQuery) (int64, error) {
+	folded, err := parser.Fold(query)
+	if err != nil {
 		return -1, err
-	} else {
-		return int64(len(recordList.Values)), nil
 	}
+	query = folded.(*parser.UpdateQuery)
+	// a typed table checks and coerces the values assigned like those inserted
+	var columns []*protocol.Column
+	if schema, ok := self.schemas[query.Table]; ok {
+		if columns, err = schemaColumns(schema, query.Table, query.GetUpdateFields()); err != nil {
+			return -1, err
+		}
+	}
+	condition, idRanges, err := self.getIdCondition(query.WhereExpression)
+	if err != nil {
+		return -1, err
+	}
+
+	fieldSet := util.NewStringSet()
+	if query.WhereExpression != nil {
+		for _, field := range query.WhereExpression.GetConditionFields() {
+			fieldSet.Insert(field)
+		}
+	}
+	// assigned values may be computed from the current row, e.g. SET a = a + 1
+	for _, assignment := range query.Assignments {
+		for _, field := range assignment.Val.GetFields() {
+			fieldSet.Insert(field)
+		}
+	}
+	fields := appendReversedIdFieldsIfNeeded(fieldSet.ConvertToStrings())
+
+	glog.V(1).Infof("table %s, fields %v, ranges %v", query.Table, fields, idRanges)
+	result, err := self.fetchAll(condition, query.Table, fields, idRanges)
+	if err != nil {
+		return -1, err
+	}
+	records := result.records
+	ids := getIdsFromRecords(fields, records)
+
+	// the _id cell is written again as well, _timestamp is the time it was
+	// last written
+	tableMeta, err := self.tableMeta(query.Table)
+	if err != nil {
+		return -1, err
+	}
+	fieldPairs, err := tableMeta.GetFieldPairs(append(query.GetUpdateFields(), RESERVED_ID_COLUMN))
+	if err != nil {
+		return -1, err
+	}
+
+	size := 0
+	wo := levigo.NewWriteOptions()
+	wb := levigo.NewWriteBatch()
+	defer wo.Close()
+	defer wb.Close()
+
+	for i, record := range records {
+		// the new version has to sort after every existing version of the cell
+		ts := time.Now().UnixNano()
+		if ts <= record.GetTimestamp() {
+			ts = record.GetTimestamp() + 1
+		}
+		for j, fieldPair := range fieldPairs {
+			val := &protocol.FieldValue{IntVal: &ids[i]}
+			if j < len(query.Assignments) {
+				literal, err := getScalarValue(record, query.Assignments[j].Val, fields)
+				if err != nil {
+					return -1, err
+				}
+				val = literal.GetVal()
+				if columns != nil {
+					if val, err = columns[j].Coerce(val); err != nil {
+						return -1, err
+					}
+				}
+			}
+			data, err := proto.Marshal(val)
+			if err != nil {
+				return -1, err
+			}
+			recordKey := generateRecordKey(fieldPair.Id, ids[i], ts, record.GetSequenceNum())
+			glog.V(2).Infof("Update : %s, recordKey: %v", val.String(), recordKey)
+			wb.Put(recordKey, data)
+			size += len(data) + len(recordKey)
+		}
+	}
+	if err := self.Write(wo, wb); err != nil {
+		return -1, err
+	}
+	tableMeta.size += size
+	if err := tableMeta.Sync(self); err != nil {
+		return -1, err
+	}
+	return int64(len(records)), nil
 }
 
-func (self *LevelDBEngine) getSelectAndFetchFields(query *parser.SelectQuery) ([]string, []string) {
+func (self *LevelDBEngine) getSelectAndFetchFields(query *parser.SelectQuery) ([]string, []string, error) {
+	if query.IsAggregate() {
+		// every row is read, so the fetch needs at least one column
+		return getSelectNames(query), appendReversedIdFieldsIfNeeded(query.GetSelectAndConditionFields()), nil
+	}
 	if !query.IsStar {
-		return query.GetSelectFields(), query.GetSelectAndConditionFields()
+		fetchFields := query.GetSelectAndConditionFields()
+		if len(fetchFields) == 0 {
+			// a select list of constants still needs one column to produce a row per record
+			fetchFields = []string{RESERVED_ID_COLUMN}
+		}
+		return getSelectNames(query), fetchFields, nil
+	}
+	tables := []string{query.Table}
+	if query.Join != nil {
+		tables = append(tables, query.Join.Table)
+	}
+	var allFields []string
+	for _, table := range tables {
+		fields, err := self.tableFields(table)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, field := range fields {
+			if query.Join != nil {
+				// the columns of a join are qualified with their table
+				field = parser.QualifyColumn(table, field)
+			}
+			allFields = append(allFields, field)
+		}
+	}
+	return allFields, allFields, nil
+}
+
+// tableFields returns every column stored for the table, _id first. Those
+// of a typed table are its schema, those of a schemaless table are registered
+// in its meta by the first write of them
+func (self *LevelDBEngine) tableFields(table string) ([]string, error) {
+	var columns []string
+	if schema, ok := self.schemas[table]; ok {
+		for _, column := range schema {
+			columns = append(columns, column.Name)
+		}
+	} else {
+		tableMeta, err := self.tableMeta(table)
+		if err != nil {
+			return nil, err
+		}
+		columns = tableMeta.GetAllFields()
 	}
-	ti := self.schema.GetTableInfo(query.Table)
-	allFields := ti.GetAllFields()
-	return allFields, allFields
+	fields := make([]string, 0, len(columns)+1)
+	fields = append(fields, RESERVED_ID_COLUMN)
+	for _, column := range columns {
+		if column != RESERVED_ID_COLUMN {
+			fields = append(fields, column)
+		}
+	}
+	return fields, nil
+}
+
+func getSelectNames(query *parser.SelectQuery) []string {
+	names := make([]string, 0, len(query.ScalarList.ScalarList))
+	for _, scalar := range query.ScalarList.ScalarList {
+		names = append(names, scalar.Name())
+	}
+	return names
+}
+
+func (self *LevelDBEngine) countTable(query *parser.SelectQuery) (*protocol.RecordList, error) {
+	tableMeta, err := self.tableMeta(query.Table)
+	if err != nil {
+		return nil, err
+	}
+	count := int64(tableMeta.records)
+	values := make([]*protocol.FieldValue, len(query.ScalarList.ScalarList))
+	for i := range values {
+		values[i] = &protocol.FieldValue{IntVal: &count}
+	}
+	return &protocol.RecordList{
+		Name:   &query.Table,
+		Fields: getSelectNames(query),
+		Values: []*protocol.Record{&protocol.Record{Values: values}},
+	}, nil
 }
 
+// Fetch runs a SELECT, the PerStatement functions of a query that isn't
+// folded yet, like NOW(), are evaluated once here
 func (self *LevelDBEngine) Fetch(query *parser.SelectQuery) (*protocol.RecordList, error) {
-	condition, idStart, idEnd, err := parser.GetIdCondition(query.WhereExpression)
-	selectFields, fetchFields := self.getSelectAndFetchFields(query)
+	folded, err := parser.Fold(query)
+	if err != nil {
+		return nil, err
+	}
+	return self.fetchQuery(folded.(*parser.SelectQuery), nil)
+}
 
-	glog.V(1).Infof("table %s, selectFields %v, fetchFields %v, start %d, end %d, limit %d", query.Table, selectFields, fetchFields, idStart, idEnd, query.Limit)
+// fetchQuery runs a SELECT, trace is only given by EXPLAIN ANALYZE
+func (self *LevelDBEngine) fetchQuery(query *parser.SelectQuery, trace queryTrace) (*protocol.RecordList, error) {
+	start := time.Now()
+	if isTableCount(query) {
+		res, err := self.countTable(query)
+		if err != nil {
+			return nil, err
+		}
+		trace.record("count", start, 1, 0)
+		return res, nil
+	}
 
-	records, err := self.fetch(condition, query.Table, fetchFields, idStart, idEnd, query.Limit)
+	selectFields, fetchFields, err := self.getSelectAndFetchFields(query)
 	if err != nil {
 		return nil, err
 	}
+	limit := query.Limit
+	if limit != -1 {
+		// the rows skipped by OFFSET are fetched as well, a sum past the
+		// largest int wraps around and then nothing is left to limit
+		if limit += query.Offset; limit < 0 {
+			limit = -1
+		}
+	}
+	idOrdered := isIdOrdered(query)
+	if !idOrdered {
+		// the limit applies to the grouped, sorted and de-duplicated result, so fetch every matching record
+		limit = -1
+	}
+	var result *fetchResult
+	if query.Join != nil {
+		glog.V(1).Infof("table %s %v, selectFields %v, fetchFields %v", query.Table, query.Join, selectFields, fetchFields)
+		if result, err = self.fetchJoin(query, fetchFields, trace); err != nil {
+			return nil, err
+		}
+	} else {
+		condition, idRanges, err := self.getIdCondition(query.WhereExpression)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(1).Infof("table %s, selectFields %v, fetchFields %v, ranges %v, limit %d", query.Table, selectFields, fetchFields, idRanges, limit)
+		if idOrdered {
+			// a truncated scan is resumed by the client with NextCursor
+			result, err = self.fetchRanges(condition, query.Table, fetchFields, idRanges, limit)
+		} else {
+			result, err = self.fetchAll(condition, query.Table, fetchFields, idRanges)
+		}
+		if err != nil {
+			return nil, err
+		}
+		trace.scan(start, result)
+	}
+	records := result.records
+
+	if query.IsAggregate() {
+		start = time.Now()
+		records, fetchFields, err = aggregateRecords(query, records, fetchFields)
+		if err != nil {
+			return nil, err
+		}
+		trace.record("aggregate", start, len(records), 0)
+		if query.Having != nil {
+			start = time.Now()
+			records, err = filterCondition(records, query.Having, fetchFields)
+			if err != nil {
+				return nil, err
+			}
+			trace.record("having", start, len(records), 0)
+		}
+	}
+
+	if query.OrderByList != nil {
+		start = time.Now()
+		if err := sortRecords(records, query, fetchFields); err != nil {
+			return nil, err
+		}
+		trace.record("sort", start, len(records), 0)
+	}
 
-	filteredResult := filterFields(records, selectFields, fetchFields)
+	start = time.Now()
+	var filteredResult []*protocol.Record
+	if query.IsStar {
+		filteredResult = filterFields(records, selectFields, fetchFields)
+	} else {
+		filteredResult, err = projectRecords(records, query.ScalarList.ScalarList, fetchFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	trace.record("project", start, len(filteredResult), 0)
+	if query.Distinct {
+		start = time.Now()
+		filteredResult = distinctRecords(filteredResult)
+		trace.record("distinct", start, len(filteredResult), 0)
+	}
+	if query.Offset > 0 || query.Limit != -1 {
+		start = time.Now()
+		filteredResult = pageRecords(filteredResult, query.Offset, query.Limit)
+		trace.record("limit", start, len(filteredResult), 0)
+	}
 
 	res := &protocol.RecordList{
 		Name:   &query.Table,
 		Fields: selectFields,
 		Values: filteredResult,
 	}
+	if result.truncated {
+		res.Truncated = proto.Bool(true)
+	}
+	// the scan stopped early, an _id ordered result can be resumed after the last _id read
+	if idOrdered && (result.truncated || (limit != -1 && len(result.records) >= limit)) {
+		res.NextCursor = proto.Int64(result.lastId)
+	}
 	return res, nil
 }
 
+// isIdOrdered is true when the rows of a query come back in _id order, the
+// limit is then applied by the scan
+func isIdOrdered(query *parser.SelectQuery) bool {
+	// unless they are sorted, grouped, de-duplicated or joined
+	return query.OrderByList == nil && !query.Distinct && !query.IsAggregate() && query.Join == nil
+}
+
 func (self *LevelDBEngine) Close() error {
 	return self.Close()
 }
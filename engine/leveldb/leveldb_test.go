@@ -0,0 +1,63 @@
+package leveldb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func newTestEngine(t *testing.T, table string) (*LevelDBEngine, func()) {
+	dataPath, err := ioutil.TempDir("", "fundb")
+	assert.Equal(t, err, nil)
+	engine := &LevelDBEngine{}
+	assert.Equal(t, engine.Init(dataPath, table), nil)
+	return engine, func() {
+		engine.Close()
+		os.RemoveAll(dataPath)
+	}
+}
+
+func insertRecords(t *testing.T, engine *LevelDBEngine, table string, fields []string, records ...*protocol.Record) {
+	recordList := &protocol.RecordList{Name: &table, Fields: fields, Values: records}
+	assert.Equal(t, engine.Insert(recordList, parser.CONFLICT_FAIL), nil)
+}
+
+func fetchSQL(t *testing.T, engine *LevelDBEngine, sql string) [][]interface{} {
+	query, err := parser.Parse(sql)
+	assert.Equal(t, err, nil, sql)
+	result, err := engine.Fetch(query.Statement.(*parser.SelectQuery))
+	assert.Equal(t, err, nil, sql)
+	return recordValues(result.Values)
+}
+
+// the columns of a table other than the one the engine was opened with are
+// read with the ids of that table, whatever the order they were created in
+func TestFetchOtherTable(t *testing.T) {
+	engine, cleanup := newTestEngine(t, "users")
+	defer cleanup()
+	for _, table := range []string{"users", "orders"} {
+		assert.Equal(t, engine.CreateTable(table, parser.TABLE_ID_RANDOM), nil)
+	}
+	insertRecords(t, engine, "users", []string{"_id", "name", "city"},
+		newRecord(1, "ann", "paris"), newRecord(2, "bob", "rome"))
+	insertRecords(t, engine, "orders", []string{"_id", "city", "user_id", "name"},
+		newRecord(10, "oslo", 2, "pen"), newRecord(11, "lima", 1, "ink"))
+
+	assert.Equal(t, fetchSQL(t, engine, "SELECT name, city FROM orders ORDER BY _id"), [][]interface{}{
+		{"pen", "oslo"},
+		{"ink", "lima"},
+	})
+	assert.Equal(t, fetchSQL(t, engine,
+		"SELECT users.name, orders.name, orders.city FROM users JOIN orders ON users._id = orders.user_id ORDER BY users.name"),
+		[][]interface{}{
+			{"ann", "ink", "lima"},
+			{"bob", "pen", "oslo"},
+		})
+	assert.Equal(t, fetchSQL(t, engine, "SELECT name FROM users WHERE _id IN (SELECT user_id FROM orders WHERE city = 'oslo')"),
+		[][]interface{}{{"bob"}})
+}
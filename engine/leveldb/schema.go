@@ -0,0 +1,413 @@
+package leveldb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/senarukana/fundb/protocol"
+	"github.com/senarukana/fundb/util"
+
+	"github.com/golang/glog"
+	"github.com/jmhodges/levigo"
+)
+
+// every cell of a column is stored under its column id, so dropping or
+// moving a column is a scan over that prefix
+const LEVELDB_SCHEMA_BATCH_SIZE = 1024 * 1024 // 1MB
+
+// prefixLimit is the first key after every key starting with prefix,
+// nil when there is none
+func prefixLimit(prefix []byte) []byte {
+	limit := append([]byte{}, prefix...)
+	for i := len(limit) - 1; i >= 0; i-- {
+		if limit[i] != 0xff {
+			limit[i]++
+			return limit[:i+1]
+		}
+	}
+	return nil
+}
+
+// rewriteColumn deletes every cell of a column, and writes it again under
+// toColumnId unless it is nil. The freed space is compacted afterwards.
+// It returns the bytes removed.
+func (self *LevelDBEngine) rewriteColumn(columnId, toColumnId []byte) (int, error) {
+	ro := levigo.NewReadOptions()
+	wo := levigo.NewWriteOptions()
+	wb := levigo.NewWriteBatch()
+	defer ro.Close()
+	defer wo.Close()
+	defer func() { wb.Close() }()
+	// the iterator reads a snapshot, the batches written meanwhile don't disturb it
+	ro.SetFillCache(false)
+	it := self.NewIterator(ro)
+	defer it.Close()
+
+	size, batchSize := 0, 0
+	for it.Seek(columnId); it.Valid() && bytes.HasPrefix(it.Key(), columnId); it.Next() {
+		key, value := it.Key(), it.Value()
+		wb.Delete(key)
+		if toColumnId != nil {
+			wb.Put(append(append([]byte{}, toColumnId...), key[len(columnId):]...), value)
+		}
+		size += len(key) + len(value)
+		batchSize += len(key) + len(value)
+		if batchSize > LEVELDB_SCHEMA_BATCH_SIZE {
+			if err := self.Write(wo, wb); err != nil {
+				return size, err
+			}
+			wb.Close()
+			wb = levigo.NewWriteBatch()
+			batchSize = 0
+		}
+	}
+	if err := self.Write(wo, wb); err != nil {
+		return size, err
+	}
+	self.CompactRange(levigo.Range{Start: columnId, Limit: prefixLimit(columnId)})
+	return size, nil
+}
+
+func (self *LevelDBEngine) deleteColumns(table string) error {
+	columns, err := self.tableFields(table)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		glog.V(1).Infof("delete column %s of table %s", column, table)
+		if _, err := self.rewriteColumn(genereateColumnId(table, column), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableExists tells whether the table has a meta record
+func (self *LevelDBEngine) tableExists(table string) (bool, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	data, err := self.Get(ro, append(LEVELDB_META_PREFIX, genereateMetaTableKey(table)...))
+	if err != nil {
+		return false, err
+	}
+	return data != nil, nil
+}
+
+// tableMeta returns the counters of table, those of the table the engine
+// was opened with are kept in memory and the others are read
+func (self *LevelDBEngine) tableMeta(table string) (*meta, error) {
+	if exists, err := self.tableExists(table); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("Table %s not existed", table)
+	}
+	if table == self.table {
+		return self.meta, nil
+	}
+	return newMeta(table, self)
+}
+
+// TruncateTable removes every record and keeps the table
+func (self *LevelDBEngine) TruncateTable(table string) error {
+	tableMeta, err := self.tableMeta(table)
+	if err != nil {
+		return err
+	}
+	if err := self.deleteColumns(table); err != nil {
+		return err
+	}
+	tableMeta.records = 0
+	tableMeta.size = 0
+	return tableMeta.Sync(self)
+}
+
+func (self *LevelDBEngine) DropTable(table string) error {
+	if exists, err := self.tableExists(table); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("Table %s not existed", table)
+	}
+	if err := self.deleteColumns(table); err != nil {
+		return err
+	}
+	wo := levigo.NewWriteOptions()
+	wb := levigo.NewWriteBatch()
+	defer wo.Close()
+	defer wb.Close()
+	wo.SetSync(true)
+	wb.Delete(append(LEVELDB_META_PREFIX, genereateMetaTableKey(table)...))
+	wb.Delete(append(LEVELDB_SCHEMA_PREFIX, genereateMetaTableKey(table)...))
+	if err := self.Write(wo, wb); err != nil {
+		return err
+	}
+	delete(self.schemas, table)
+	return nil
+}
+
+// RenameTable moves every cell, the column ids are derived from the table
+// name. Moving them onto a table that exists would merge the two.
+func (self *LevelDBEngine) RenameTable(table, newName string) error {
+	if exists, err := self.tableExists(table); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("Table %s not existed", table)
+	}
+	if exists, err := self.tableExists(newName); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("Table %s already existed", newName)
+	}
+	columns, err := self.tableFields(table)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		glog.V(1).Infof("move column %s of table %s to %s", column, table, newName)
+		if _, err := self.rewriteColumn(genereateColumnId(table, column), genereateColumnId(newName, column)); err != nil {
+			return err
+		}
+	}
+
+	ro := levigo.NewReadOptions()
+	wo := levigo.NewWriteOptions()
+	wb := levigo.NewWriteBatch()
+	defer ro.Close()
+	defer wo.Close()
+	defer wb.Close()
+	wo.SetSync(true)
+	metaKey := append(LEVELDB_META_PREFIX, genereateMetaTableKey(table)...)
+	data, err := self.Get(ro, metaKey)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		wb.Delete(metaKey)
+		wb.Put(append(LEVELDB_META_PREFIX, genereateMetaTableKey(newName)...), data)
+	}
+	schema, typed := self.schemas[table]
+	if typed {
+		data, err := json.Marshal(schema)
+		if err != nil {
+			return err
+		}
+		wb.Delete(append(LEVELDB_SCHEMA_PREFIX, genereateMetaTableKey(table)...))
+		wb.Put(append(LEVELDB_SCHEMA_PREFIX, genereateMetaTableKey(newName)...), data)
+	}
+	if err := self.Write(wo, wb); err != nil {
+		return err
+	}
+	if typed {
+		delete(self.schemas, table)
+		self.schemas[newName] = schema
+	}
+	if table == self.table {
+		// the counters are read again under the new name
+		meta, err := newMeta(newName, self)
+		if err != nil {
+			return err
+		}
+		self.table, self.meta = newName, meta
+	}
+	return nil
+}
+
+// AddColumn stores the column in the schema of a typed table. A column's
+// cells are written by the first insert or update of it and the records
+// without it read as NULL, so a schemaless table has nothing to store.
+func (self *LevelDBEngine) AddColumn(table string, column *protocol.Column) error {
+	tableMeta, err := self.tableMeta(table)
+	if err != nil {
+		return err
+	}
+	schema, typed := self.schemas[table]
+	if !typed {
+		return nil
+	}
+	extended, err := schema.AddColumn(column)
+	if err != nil {
+		return err
+	}
+	if column.NotNull && tableMeta.records > 0 {
+		// the DEFAULT isn't written into the records already there
+		return fmt.Errorf("COLUMN %s can't be NOT NULL, the records of TABLE %s have no value for it", column.Name, table)
+	}
+	return self.SetSchema(table, extended)
+}
+
+func (self *LevelDBEngine) DropColumn(table, column string) error {
+	if column == RESERVED_ID_COLUMN {
+		return fmt.Errorf("CAN'T DROP COLUMN %s", RESERVED_ID_COLUMN)
+	}
+	tableMeta, err := self.tableMeta(table)
+	if err != nil {
+		return err
+	}
+	size, err := self.rewriteColumn(genereateColumnId(table, column), nil)
+	if err != nil {
+		return err
+	}
+	if schema, ok := self.schemas[table]; ok {
+		remaining := make(protocol.Schema, 0, len(schema))
+		for _, col := range schema {
+			if col.Name != column {
+				remaining = append(remaining, col)
+			}
+		}
+		if err := self.SetSchema(table, remaining); err != nil {
+			return err
+		}
+	}
+	tableMeta.size -= size
+	return tableMeta.Sync(self)
+}
+
+// ListTables finds the tables by their meta records
+func (self *LevelDBEngine) ListTables() ([]string, error) {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	it := self.NewIterator(ro)
+	defer it.Close()
+
+	var tables []string
+	for it.Seek(LEVELDB_META_PREFIX); it.Valid() && bytes.HasPrefix(it.Key(), LEVELDB_META_PREFIX); it.Next() {
+		tables = append(tables, string(it.Key()[len(LEVELDB_META_PREFIX):]))
+	}
+	return tables, nil
+}
+
+// DescribeTable lists the columns stored for the table, also those of a
+// schemaless table that were never declared
+func (self *LevelDBEngine) DescribeTable(table string) (*protocol.RecordList, error) {
+	if exists, err := self.tableExists(table); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("Table %s not existed", table)
+	}
+	columns, err := self.tableFields(table)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*protocol.Record, len(columns))
+	for i, column := range columns {
+		name := column
+		columnId := fmt.Sprintf("%x", genereateColumnId(table, column))
+		records[i] = &protocol.Record{Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StrVal: &name},
+			&protocol.FieldValue{StrVal: &columnId},
+		}}
+	}
+	return &protocol.RecordList{
+		Name:   &table,
+		Fields: []string{"column", "column_id"},
+		Values: records,
+	}, nil
+}
+
+func (self *LevelDBEngine) TableStatus(table string) (*protocol.RecordList, error) {
+	tableMeta, err := self.tableMeta(table)
+	if err != nil {
+		return nil, err
+	}
+	records := int64(tableMeta.records)
+	size := int64(tableMeta.size)
+	return &protocol.RecordList{
+		Name:   &table,
+		Fields: []string{"table", "records", "size"},
+		Values: []*protocol.Record{&protocol.Record{Values: []*protocol.FieldValue{
+			&protocol.FieldValue{StrVal: &table},
+			&protocol.FieldValue{IntVal: &records},
+			&protocol.FieldValue{IntVal: &size},
+		}}},
+	}, nil
+}
+
+// SetSchema makes a table typed, inserts into it are checked and coerced
+// against the schema from then on
+func (self *LevelDBEngine) SetSchema(table string, schema protocol.Schema) error {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wo.SetSync(true)
+	if err := self.Put(wo, append(LEVELDB_SCHEMA_PREFIX, genereateMetaTableKey(table)...), data); err != nil {
+		return err
+	}
+	self.schemas[table] = schema
+	return nil
+}
+
+func (self *LevelDBEngine) loadSchemas() error {
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	it := self.NewIterator(ro)
+	defer it.Close()
+
+	for it.Seek(LEVELDB_SCHEMA_PREFIX); it.Valid() && bytes.HasPrefix(it.Key(), LEVELDB_SCHEMA_PREFIX); it.Next() {
+		var schema protocol.Schema
+		if err := json.Unmarshal(it.Value(), &schema); err != nil {
+			return err
+		}
+		table := string(it.Key()[len(LEVELDB_SCHEMA_PREFIX):])
+		self.schemas[table] = schema
+		glog.V(2).Infof("schema of table %s: %d columns", table, len(schema))
+	}
+	return nil
+}
+
+// checkSchema validates the records inserted into a typed table and coerces
+// their values, the columns left out are added with their default
+func checkSchema(schema protocol.Schema, recordList *protocol.RecordList) error {
+	columns, err := schemaColumns(schema, recordList.GetName(), recordList.Fields)
+	if err != nil {
+		return err
+	}
+	given := util.NewStringSetFromStrings(recordList.Fields)
+	var missing []*protocol.Column
+	for _, column := range schema {
+		if !given.Exists(column.Name) {
+			missing = append(missing, column)
+		}
+	}
+
+	for _, record := range recordList.Values {
+		for i, column := range columns {
+			if column == nil {
+				continue
+			}
+			val, err := column.Coerce(record.Values[i])
+			if err != nil {
+				return err
+			}
+			record.Values[i] = val
+		}
+		for _, column := range missing {
+			val, err := column.DefaultValue()
+			if err != nil {
+				return err
+			}
+			record.Values = append(record.Values, val)
+		}
+	}
+	for _, column := range missing {
+		recordList.Fields = append(recordList.Fields, column.Name)
+	}
+	return nil
+}
+
+// schemaColumns returns the column of each field written, nil for _id
+func schemaColumns(schema protocol.Schema, table string, fields []string) ([]*protocol.Column, error) {
+	columns := make([]*protocol.Column, len(fields))
+	for i, field := range fields {
+		if field == RESERVED_ID_COLUMN {
+			continue
+		}
+		columns[i] = schema.GetColumn(field)
+		if columns[i] == nil {
+			return nil, fmt.Errorf("COLUMN %s not existed in TABLE %s", field, table)
+		}
+	}
+	return columns, nil
+}
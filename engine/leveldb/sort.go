@@ -0,0 +1,88 @@
+package leveldb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+)
+
+// recordSorter sorts the records by their keys, keys[i] holds the value of
+// every ORDER BY of records[i]
+type recordSorter struct {
+	records  []*protocol.Record
+	keys     [][]parser.LiteralNode
+	orderBys []*parser.OrderBy
+}
+
+func (self *recordSorter) Len() int {
+	return len(self.records)
+}
+
+func (self *recordSorter) Swap(i, j int) {
+	self.records[i], self.records[j] = self.records[j], self.records[i]
+	self.keys[i], self.keys[j] = self.keys[j], self.keys[i]
+}
+
+func (self *recordSorter) Less(i, j int) bool {
+	for k, orderBy := range self.orderBys {
+		cmp := compareLiteral(self.keys[i][k], self.keys[j][k])
+		if cmp == 0 {
+			continue
+		}
+		if orderBy.Order == parser.ORDER_DESC {
+			cmp = -cmp
+		}
+		return cmp < 0
+	}
+	return false
+}
+
+// compareLiteral orders NULL before any other value,
+// values of incomparable types are treated as equal
+func compareLiteral(left, right parser.LiteralNode) int {
+	switch {
+	case left.Less(right):
+		return -1
+	case right.Less(left):
+		return 1
+	}
+	return 0
+}
+
+// sortRecords sorts the records by the ORDER BY of query, an alias of the
+// select list is sorted on the value of its expression
+func sortRecords(records []*protocol.Record, query *parser.SelectQuery, fields []string) error {
+	keyScalars := make([]*parser.Scalar, len(query.OrderBys))
+	for i, orderBy := range query.OrderBys {
+		if keyScalars[i] = query.GetOrderByScalar(orderBy); keyScalars[i] != nil {
+			continue
+		}
+		exists := false
+		for _, field := range fields {
+			if field == orderBy.Field {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			return fmt.Errorf("ORDER BY field %s not existed", orderBy.Field)
+		}
+		keyScalars[i] = &parser.Scalar{Type: parser.SCALAR_IDENT, Val: orderBy.Field}
+	}
+	keys := make([][]parser.LiteralNode, len(records))
+	for i, record := range records {
+		keys[i] = make([]parser.LiteralNode, len(keyScalars))
+		for k, scalar := range keyScalars {
+			key, err := getScalarValue(record, scalar, fields)
+			if err != nil {
+				return err
+			}
+			keys[i][k] = key
+		}
+	}
+	// stable, so rows with equal keys keep their _id order
+	sort.Stable(&recordSorter{records, keys, query.OrderBys})
+	return nil
+}
@@ -0,0 +1,54 @@
+package leveldb
+
+import (
+	"testing"
+
+	"github.com/senarukana/fundb/parser"
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func parseSelect(t *testing.T, sql string) *parser.SelectQuery {
+	query, err := parser.Parse(sql)
+	assert.Equal(t, err, nil, sql)
+	return query.Statement.(*parser.SelectQuery)
+}
+
+func TestSortRecords(t *testing.T) {
+	fields := []string{"price", "qty", "name"}
+	for _, c := range []struct {
+		sql string
+		out [][]interface{}
+	}{
+		// NULL sorts first
+		{"SELECT name FROM t ORDER BY name", [][]interface{}{{nil}, {"a"}, {"b"}, {"c"}}},
+		{"SELECT name FROM t ORDER BY qty DESC, name", [][]interface{}{{"b"}, {"a"}, {"c"}, {nil}}},
+		// an alias is sorted on the value of its expression
+		{"SELECT price * qty AS total, name FROM t ORDER BY total DESC", [][]interface{}{
+			{10.0, "c"}, {6.0, "b"}, {3.0, "a"}, {nil, nil},
+		}},
+		{"SELECT name AS qty, qty AS n FROM t ORDER BY qty", [][]interface{}{{nil, nil}, {"a", int64(2)}, {"b", int64(3)}, {"c", int64(1)}}},
+	} {
+		query := parseSelect(t, c.sql)
+		records := []*protocol.Record{newRecord(2.0, 3, "b"), newRecord(10.0, 1, "c"), newRecord(1.5, 2, "a"), newRecord(nil, nil, nil)}
+		assert.Equal(t, sortRecords(records, query, fields), nil, c.sql)
+		records, err := projectRecords(records, query.ScalarList.ScalarList, fields)
+		assert.Equal(t, err, nil, c.sql)
+		assert.Equal(t, recordValues(records), c.out, c.sql)
+	}
+
+	query := parseSelect(t, "SELECT name FROM t ORDER BY city")
+	assert.NotEqual(t, sortRecords([]*protocol.Record{newRecord(1.0, 1, "a")}, query, fields), nil)
+}
+
+func TestSortAggregateAlias(t *testing.T) {
+	query := parseSelect(t, "SELECT city, COUNT(*) AS n FROM t GROUP BY city ORDER BY n DESC")
+	records := []*protocol.Record{newRecord("b"), newRecord("c"), newRecord("a"), newRecord("c"), newRecord("b"), newRecord("c")}
+	records, fields, err := aggregateRecords(query, records, []string{"city"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, sortRecords(records, query, fields), nil)
+	records, err = projectRecords(records, query.ScalarList.ScalarList, fields)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recordValues(records), [][]interface{}{{"c", int64(3)}, {"b", int64(2)}, {"a", int64(1)}})
+}
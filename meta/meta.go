@@ -44,11 +44,36 @@ func (self *tableset) createTable(table *Table) error {
 func (self *tableset) getTable(tbName string) (*Table, error) {
 	tb, ok := self.Tables[tbName]
 	if !ok {
-		return nil, fmt.Errorf("TABLE %s not existed", tb)
+		return nil, fmt.Errorf("TABLE %s not existed", tbName)
 	}
 	return tb, nil
 }
 
+func (self *tableset) dropTable(tbName string) error {
+	if _, err := self.getTable(tbName); err != nil {
+		return err
+	}
+	delete(self.Tables, tbName)
+	return nil
+}
+
+func (self *tableset) renameTable(tbName, newName string) error {
+	tb, err := self.getTable(tbName)
+	if err != nil {
+		return err
+	}
+	if _, ok := self.Tables[newName]; ok {
+		return fmt.Errorf("TABLE %s already existed", newName)
+	}
+	delete(self.Tables, tbName)
+	tb.Name = newName
+	for _, shard := range tb.Shards {
+		shard.TableName = newName
+	}
+	self.Tables[newName] = tb
+	return nil
+}
+
 func (self *tableset) listTable() (Tables []*Table) {
 	Tables = make([]*Table, 0, len(self.Tables))
 	for _, tb := range self.Tables {
@@ -161,6 +186,64 @@ func (self *MetaData) GetTable(dbName, tbName string) (tb *Table, err error) {
 	return tb, err
 }
 
+func (self *MetaData) DropTable(dbName, tbName string) (err error) {
+	self.withLock(func() {
+		var tbSet *tableset
+		tbSet, err = self.getTableSet(dbName)
+		if err != nil {
+			return
+		}
+		err = tbSet.dropTable(tbName)
+	})
+	return err
+}
+
+func (self *MetaData) RenameTable(dbName, tbName, newName string) (err error) {
+	self.withLock(func() {
+		var tbSet *tableset
+		tbSet, err = self.getTableSet(dbName)
+		if err != nil {
+			return
+		}
+		err = tbSet.renameTable(tbName, newName)
+	})
+	return err
+}
+
+func (self *MetaData) AddColumn(dbName, tbName, column string) (err error) {
+	self.withLock(func() {
+		var tbSet *tableset
+		tbSet, err = self.getTableSet(dbName)
+		if err != nil {
+			return
+		}
+		var tb *Table
+		tb, err = tbSet.getTable(tbName)
+		if err != nil {
+			return
+		}
+		err = tb.AddColumn(column)
+	})
+	return err
+}
+
+func (self *MetaData) DropColumn(dbName, tbName, column string) (err error) {
+	self.withLock(func() {
+		var tbSet *tableset
+		tbSet, err = self.getTableSet(dbName)
+		if err != nil {
+			return
+		}
+		var tb *Table
+		tb, err = tbSet.getTable(tbName)
+		if err != nil {
+			return
+		}
+		err = tb.DropColumn(column)
+	})
+	return err
+}
+
 func (self *MetaData) GetShard(dbName, tbName string, shardId uint32) (shard *Shard, err error) {
 	self.withRLock(func() {
 		tbSet, err := self.getTableSet(dbName)
@@ -3,12 +3,17 @@ package meta
 import (
 	"fmt"
 	"math"
+
+	"github.com/senarukana/fundb/protocol"
 )
 
 type Table struct {
-	Name        string
-	PrimaryKey  string
-	SplitKey    string
+	Name       string
+	PrimaryKey string
+	SplitKey   string
+	Columns    []string
+	// Schema is nil for a schemaless table
+	Schema      protocol.Schema
 	NextShardId int
 	Shards      []*Shard
 }
@@ -19,6 +24,7 @@ func NewTable(name string, primaryKey, splitKey string) *Table {
 		Name:       name,
 		PrimaryKey: primaryKey,
 		SplitKey:   splitKey,
+		Columns:    []string{primaryKey},
 		Shards:     []*Shard{shard},
 	}
 }
@@ -32,6 +38,55 @@ func (self *Table) GetShard(id uint32) (*Shard, error) {
 	return nil, fmt.Errorf("CAN'T FIND SHARD %d", id)
 }
 
+// SetSchema makes the table typed, its columns are the schema's
+func (self *Table) SetSchema(schema protocol.Schema) {
+	self.Schema = schema
+	for _, column := range schema {
+		if !self.HasColumn(column.Name) {
+			self.Columns = append(self.Columns, column.Name)
+		}
+	}
+}
+
+func (self *Table) HasColumn(column string) bool {
+	for _, col := range self.Columns {
+		if col == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Table) AddColumn(column string) error {
+	if self.HasColumn(column) {
+		return fmt.Errorf("COLUMN %s already existed in TABLE %s", column, self.Name)
+	}
+	if self.Schema != nil {
+		return fmt.Errorf("TABLE %s has a schema, COLUMN %s needs a type", self.Name, column)
+	}
+	self.Columns = append(self.Columns, column)
+	return nil
+}
+
+func (self *Table) DropColumn(column string) error {
+	if column == self.PrimaryKey {
+		return fmt.Errorf("CAN'T DROP PRIMARY KEY %s of TABLE %s", column, self.Name)
+	}
+	for i, col := range self.Schema {
+		if col.Name == column {
+			self.Schema = append(self.Schema[:i], self.Schema[i+1:]...)
+			break
+		}
+	}
+	for i, col := range self.Columns {
+		if col == column {
+			self.Columns = append(self.Columns[:i], self.Columns[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("COLUMN %s not existed in TABLE %s", column, self.Name)
+}
+
 func (self *Table) String() string {
 	return fmt.Sprintf("TABLE: [NAME %s, PK %s, SPK: %s, SHARDS: %v]",
 		self.Name, self.PrimaryKey, self.SplitKey, self.Shards)
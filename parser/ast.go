@@ -1,7 +1,10 @@
 package parser
 
 import (
-// "fmt"
+	"fmt"
+
+	"github.com/senarukana/fundb/protocol"
+	"github.com/senarukana/fundb/util"
 )
 
 type ScalarType int
@@ -9,6 +12,8 @@ type ScalarType int
 const (
 	SCALAR_IDENT ScalarType = iota
 	SCLAR_LITERAL
+	SCALAR_FUNCTION
+	SCALAR_EXPRESSION
 )
 
 type WhereType int
@@ -17,6 +22,15 @@ const (
 	WHERE_AND WhereType = iota
 	WHERE_COMPARISON
 	WHERE_BETWEEN
+	WHERE_OR
+	WHERE_NOT
+	WHERE_IN
+	WHERE_LIKE
+	WHERE_REGEXP
+	WHERE_IS_NULL
+	// WHERE_IN_SUBQUERY has a *Subquery on the right, WHERE_EXISTS only that
+	WHERE_IN_SUBQUERY
+	WHERE_EXISTS
 )
 
 type TableIdType int
@@ -26,6 +40,13 @@ const (
 	TABLE_ID_INCREMENT
 )
 
+// OrderBy.Order, NULLs are the smallest values in either direction
+const (
+	ORDER_NONE = iota
+	ORDER_ASC
+	ORDER_DESC
+)
+
 type WhereExpression struct {
 	Left  interface{}
 	Right interface{}
@@ -38,6 +59,84 @@ type TableExpression struct {
 	*WhereExpression
 }
 
+func (self *WhereExpression) String() string {
+	return self.Format()
+}
+
+func (self *WhereExpression) Format() string {
+	return self.format(false)
+}
+
+// format prints the condition, negated puts the NOT where SQL writes it,
+// as in a NOT IN (1, 2) and a IS NOT NULL
+func (self *WhereExpression) format(negated bool) string {
+	operand := func(expr interface{}) string {
+		switch e := expr.(type) {
+		case string:
+			return formatColumn(e)
+		case *Scalar:
+			return e.Format()
+		default:
+			panic(fmt.Sprintf("UNKNOWN OPERAND %T", expr))
+		}
+	}
+	// AND binds tighter than OR, and NOT tighter than both. Both are left
+	// associative, so a right operand of the same kind keeps its parentheses.
+	condition := func(expr interface{}, parenthesize bool) string {
+		if parenthesize {
+			return "(" + expr.(*WhereExpression).Format() + ")"
+		}
+		return expr.(*WhereExpression).Format()
+	}
+	not := ""
+	if negated {
+		not = "NOT "
+	}
+
+	switch self.Type {
+	case WHERE_AND:
+		right := self.Right.(*WhereExpression).Type
+		return condition(self.Left, self.Left.(*WhereExpression).Type == WHERE_OR) + " AND " +
+			condition(self.Right, right == WHERE_OR || right == WHERE_AND)
+	case WHERE_OR:
+		return condition(self.Left, false) + " OR " +
+			condition(self.Right, self.Right.(*WhereExpression).Type == WHERE_OR)
+	case WHERE_NOT:
+		inner := self.Left.(*WhereExpression)
+		switch inner.Type {
+		case WHERE_IN, WHERE_IN_SUBQUERY, WHERE_LIKE, WHERE_REGEXP, WHERE_IS_NULL:
+			return inner.format(!negated)
+		case WHERE_AND, WHERE_OR:
+			return "NOT " + condition(inner, true)
+		}
+		return "NOT " + inner.Format()
+	case WHERE_COMPARISON:
+		op := self.Token.Src
+		if ComparisonMap[op] == NOTEQUAL {
+			op = "!="
+		}
+		return operand(self.Left) + " " + op + " " + operand(self.Right)
+	case WHERE_BETWEEN:
+		return operand(self.Left) + " " + self.Right.(*BetweenExpression).Format()
+	case WHERE_IN:
+		return operand(self.Left) + " " + not + "IN (" + self.Right.(*ScalarList).Format() + ")"
+	case WHERE_LIKE, WHERE_REGEXP:
+		return operand(self.Left) + " " + not + self.Right.(*PatternExpression).Format()
+	case WHERE_IS_NULL:
+		return operand(self.Left) + " IS " + not + "NULL"
+	case WHERE_IN_SUBQUERY:
+		return operand(self.Left) + " " + not + "IN (" + self.Right.(*Subquery).Format() + ")"
+	case WHERE_EXISTS:
+		return "EXISTS (" + self.Right.(*Subquery).Format() + ")"
+	default:
+		panic(fmt.Sprintf("UNKNOWN WHERE TYPE %d", self.Type))
+	}
+}
+
+func (self *TableExpression) GetTableName() string {
+	return self.Table
+}
+
 type BetweenExpression struct {
 	Left  *Scalar
 	Right *Scalar
@@ -55,10 +154,197 @@ type ScalarList struct {
 type Scalar struct {
 	Type ScalarType
 	Val  interface{}
+	// Alias is the output name given with AS in the select list
+	Alias string
+}
+
+// Name is the name of the scalar as an output column
+func (self *Scalar) Name() string {
+	if self.Alias != "" {
+		return self.Alias
+	}
+	return self.String()
+}
+
+func (self *Scalar) String() string {
+	switch self.Type {
+	case SCALAR_IDENT:
+		return self.Val.(string)
+	case SCLAR_LITERAL:
+		if IsNull(self.Val.(LiteralNode)) {
+			return "NULL"
+		}
+		return fmt.Sprint(self.Val.(LiteralNode).GetVal().GetValue())
+	case SCALAR_FUNCTION:
+		return self.Val.(*FunctionCall).String()
+	case SCALAR_EXPRESSION:
+		return self.Val.(*ArithmeticExpression).String()
+	default:
+		panic(fmt.Sprintf("UNKNOWN SCALAR TYPE %d", self.Type))
+	}
+}
+
+func (self *ArithmeticExpression) String() string {
+	operand := func(scalar *Scalar) string {
+		if scalar.Type == SCALAR_EXPRESSION {
+			return "(" + scalar.String() + ")"
+		}
+		return scalar.String()
+	}
+	if self.Op == UMINUS {
+		return "-" + operand(self.Left)
+	}
+	return operand(self.Left) + " " + ArithmeticOpMap[self.Op] + " " + operand(self.Right)
+}
+
+func (self *ArithmeticExpression) operands() []*Scalar {
+	if self.Right == nil {
+		return []*Scalar{self.Left}
+	}
+	return []*Scalar{self.Left, self.Right}
+}
+
+func (self *Scalar) HasAggregate() bool {
+	if self.Type == SCALAR_EXPRESSION {
+		for _, operand := range self.Val.(*ArithmeticExpression).operands() {
+			if operand.HasAggregate() {
+				return true
+			}
+		}
+		return false
+	}
+	if self.Type != SCALAR_FUNCTION {
+		return false
+	}
+	function := self.Val.(*FunctionCall)
+	if function.IsAggregate() {
+		return true
+	}
+	for _, arg := range function.GetArgs() {
+		if arg.HasAggregate() {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Scalar) getAggregates(aggregates []*FunctionCall) []*FunctionCall {
+	if self.Type == SCALAR_EXPRESSION {
+		for _, operand := range self.Val.(*ArithmeticExpression).operands() {
+			aggregates = operand.getAggregates(aggregates)
+		}
+		return aggregates
+	}
+	if self.Type != SCALAR_FUNCTION {
+		return aggregates
+	}
+	function := self.Val.(*FunctionCall)
+	if !function.IsAggregate() {
+		for _, arg := range function.GetArgs() {
+			aggregates = arg.getAggregates(aggregates)
+		}
+		return aggregates
+	}
+	name := function.String()
+	for _, aggregate := range aggregates {
+		if aggregate.String() == name {
+			return aggregates
+		}
+	}
+	return append(aggregates, function)
+}
+
+func (self *Scalar) Validate() error {
+	switch self.Type {
+	case SCALAR_FUNCTION:
+		return self.Val.(*FunctionCall).Validate()
+	case SCALAR_EXPRESSION:
+		for _, operand := range self.Val.(*ArithmeticExpression).operands() {
+			if err := operand.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// staticType is the type of the scalar when it is known without reading a
+// row, NULL otherwise. Columns have no type but _id and _timestamp.
+func (self *Scalar) staticType() protocol.FieldType {
+	switch self.Type {
+	case SCALAR_IDENT:
+		switch self.Val.(string) {
+		case "_id":
+			return protocol.INT
+		case TIMESTAMP_COLUMN:
+			return protocol.TIMESTAMP
+		}
+	case SCLAR_LITERAL:
+		return self.Val.(LiteralNode).GetType()
+	case SCALAR_FUNCTION:
+		function := self.Val.(*FunctionCall)
+		if function.Name == "COUNT" {
+			return protocol.INT
+		}
+		if scalarFunction, ok := scalarFunctions[function.Name]; ok {
+			return scalarFunction.Return
+		}
+	case SCALAR_EXPRESSION:
+		expr := self.Val.(*ArithmeticExpression)
+		left := expr.Left.staticType()
+		if expr.Right == nil {
+			return left
+		}
+		right := expr.Right.staticType()
+		switch {
+		case left == protocol.INT && right == protocol.INT:
+			return protocol.INT
+		case (left == protocol.INT || left == protocol.DOUBLE) && (right == protocol.INT || right == protocol.DOUBLE):
+			return protocol.DOUBLE
+		}
+	}
+	return protocol.NULL
+}
+
+// getFields collects the columns the scalar reads, including those inside
+// aggregate calls unless skipAggregate is set
+func (self *Scalar) getFields(columnSet util.StringSet, skipAggregate bool) {
+	switch self.Type {
+	case SCALAR_IDENT:
+		columnSet.Insert(self.Val.(string))
+	case SCALAR_FUNCTION:
+		function := self.Val.(*FunctionCall)
+		if skipAggregate && function.IsAggregate() {
+			return
+		}
+		for _, arg := range function.GetArgs() {
+			arg.getFields(columnSet, skipAggregate)
+		}
+	case SCALAR_EXPRESSION:
+		for _, operand := range self.Val.(*ArithmeticExpression).operands() {
+			operand.getFields(columnSet, skipAggregate)
+		}
+	}
+}
+
+func (self *Scalar) GetFields() []string {
+	columnSet := util.NewStringSet()
+	self.getFields(columnSet, false)
+	return columnSet.ConvertToStrings()
 }
 
+// ArithmeticExpression is the value of a SCALAR_EXPRESSION, Right is nil for UMINUS
+type ArithmeticExpression struct {
+	Op    int
+	Left  *Scalar
+	Right *Scalar
+}
+
+// FromExpression is the table read, Join is set when another table is
+// joined to it
 type FromExpression struct {
 	Table string
+	Join  *JoinExpression
 }
 
 type OrderByList struct {
@@ -82,6 +368,82 @@ type ColumnFields struct {
 	Fields []string
 }
 
+type Assignment struct {
+	Field string
+	Val   *Scalar
+}
+
+type AssignmentList struct {
+	Assignments []*Assignment
+}
+
+func NewArithmeticScalar(op int, left, right *Scalar) *Scalar {
+	return &Scalar{
+		Type: SCALAR_EXPRESSION,
+		Val: &ArithmeticExpression{
+			Op:    op,
+			Left:  left,
+			Right: right,
+		},
+	}
+}
+
+// NewComparisonExpression keeps a plain column on the left as its name,
+// which is what the _id range detection looks for
+func NewComparisonExpression(token Token, left, right *Scalar) *WhereExpression {
+	var leftExpr interface{} = left
+	if left.Type == SCALAR_IDENT {
+		leftExpr = left.Val.(string)
+	}
+	return &WhereExpression{
+		Type:  WHERE_COMPARISON,
+		Left:  leftExpr,
+		Right: right,
+		Token: token,
+	}
+}
+
+// NewInExpression builds field IN (...), NOT IN is a WHERE_NOT around it
+func NewInExpression(token Token, left *Scalar, items *ScalarList) *WhereExpression {
+	var leftExpr interface{} = left
+	if left.Type == SCALAR_IDENT {
+		leftExpr = left.Val.(string)
+	}
+	return &WhereExpression{
+		Type:  WHERE_IN,
+		Left:  leftExpr,
+		Right: items,
+		Token: token,
+	}
+}
+
+// NewPatternExpression builds LIKE and REGEXP predicates, NOT LIKE is a WHERE_NOT around it
+func NewPatternExpression(whereType WhereType, token Token, left *Scalar, pattern LiteralNode) *WhereExpression {
+	var leftExpr interface{} = left
+	if left.Type == SCALAR_IDENT {
+		leftExpr = left.Val.(string)
+	}
+	return &WhereExpression{
+		Type:  whereType,
+		Left:  leftExpr,
+		Right: newPatternExpression(pattern, whereType == WHERE_LIKE),
+		Token: token,
+	}
+}
+
+// NewNullExpression builds IS NULL, IS NOT NULL is a WHERE_NOT around it
+func NewNullExpression(token Token, left *Scalar) *WhereExpression {
+	var leftExpr interface{} = left
+	if left.Type == SCALAR_IDENT {
+		leftExpr = left.Val.(string)
+	}
+	return &WhereExpression{
+		Type:  WHERE_IS_NULL,
+		Left:  leftExpr,
+		Token: token,
+	}
+}
+
 func NewBetweenExpression(token Token, field string, left, right *Scalar) *WhereExpression {
 	return &WhereExpression{
 		Type:  WHERE_BETWEEN,
@@ -136,6 +498,20 @@ func ColumnFieldsAppend(columnFields *ColumnFields, field string) *ColumnFields
 	return columnFields
 }
 
+func NewAssignmentList(assignment *Assignment) *AssignmentList {
+	return &AssignmentList{
+		Assignments: []*Assignment{assignment},
+	}
+}
+
+func AssignmentListAppend(assignmentList *AssignmentList, assignment *Assignment) *AssignmentList {
+	if assignmentList == nil {
+		return NewAssignmentList(assignment)
+	}
+	assignmentList.Assignments = append(assignmentList.Assignments, assignment)
+	return assignmentList
+}
+
 func NewValueItem(item LiteralNode) *ValueItems {
 	return &ValueItems{
 		Items: []LiteralNode{item},
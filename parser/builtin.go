@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+func init() {
+	RegisterFunction("LOWER", &Function{Args: []protocol.FieldType{protocol.STRING}, Return: protocol.STRING, Call: lower})
+	RegisterFunction("UPPER", &Function{Args: []protocol.FieldType{protocol.STRING}, Return: protocol.STRING, Call: upper})
+	RegisterFunction("LENGTH", &Function{Args: []protocol.FieldType{protocol.STRING}, Return: protocol.INT, Call: length})
+	RegisterFunction("SUBSTR", &Function{
+		Args:     []protocol.FieldType{protocol.STRING, protocol.INT, protocol.INT},
+		Optional: 1,
+		Return:   protocol.STRING,
+		Call:     substr,
+	})
+	RegisterFunction("ABS", &Function{Args: []protocol.FieldType{protocol.DOUBLE}, Call: abs})
+	RegisterFunction("ROUND", &Function{
+		Args:     []protocol.FieldType{protocol.DOUBLE, protocol.INT},
+		Optional: 1,
+		Call:     round,
+	})
+	RegisterFunction("COALESCE", &Function{
+		Args:       []protocol.FieldType{protocol.NULL},
+		Variadic:   true,
+		Call:       coalesce,
+		CallOnNull: true,
+	})
+	RegisterFunction("IFNULL", &Function{
+		Args:       []protocol.FieldType{protocol.NULL, protocol.NULL},
+		Call:       coalesce,
+		CallOnNull: true,
+	})
+	RegisterFunction("NOW", &Function{Return: protocol.TIMESTAMP, Call: now, PerStatement: true})
+	RegisterFunction("DATE_TRUNC", &Function{
+		Args:   []protocol.FieldType{protocol.STRING, protocol.TIMESTAMP},
+		Return: protocol.TIMESTAMP,
+		Call:   dateTrunc,
+		Check:  checkDateTrunc,
+	})
+}
+
+func newStringNode(val string) LiteralNode {
+	return &StringNode{protocol.STRING, &protocol.FieldValue{StrVal: &val}}
+}
+
+func lower(args []LiteralNode) (LiteralNode, error) {
+	return newStringNode(strings.ToLower(args[0].GetVal().GetStrVal())), nil
+}
+
+func upper(args []LiteralNode) (LiteralNode, error) {
+	return newStringNode(strings.ToUpper(args[0].GetVal().GetStrVal())), nil
+}
+
+// length counts characters, not bytes
+func length(args []LiteralNode) (LiteralNode, error) {
+	return newIntNode(int64(utf8.RuneCountInString(args[0].GetVal().GetStrVal()))), nil
+}
+
+// substr is SUBSTR(str, start[, length]), start counts characters from 1
+func substr(args []LiteralNode) (LiteralNode, error) {
+	runes := []rune(args[0].GetVal().GetStrVal())
+	start := int64(0)
+	if pos := args[1].GetVal().GetIntVal(); pos > 1 {
+		start = pos - 1
+	}
+	if start > int64(len(runes)) {
+		start = int64(len(runes))
+	}
+	end := int64(len(runes))
+	if len(args) == 3 {
+		// n is compared with the runes left, start+n may overflow
+		if n := args[2].GetVal().GetIntVal(); n < 0 {
+			end = start
+		} else if n < end-start {
+			end = start + n
+		}
+	}
+	return newStringNode(string(runes[start:end])), nil
+}
+
+// abs keeps the type of its argument
+func abs(args []LiteralNode) (LiteralNode, error) {
+	if args[0].GetType() == protocol.INT {
+		if val := args[0].GetVal().GetIntVal(); val == math.MinInt64 {
+			// its opposite is one past the largest INT
+			return nil, ErrIntegerOverflow
+		} else if val < 0 {
+			return newIntNode(-val), nil
+		}
+		return args[0], nil
+	}
+	return newDoubleNode(math.Abs(args[0].GetVal().GetDoubleVal())), nil
+}
+
+// round is ROUND(x[, digits]), halves are rounded away from zero. An INT
+// stays an INT, there is nothing to round.
+func round(args []LiteralNode) (LiteralNode, error) {
+	if args[0].GetType() == protocol.INT {
+		return args[0], nil
+	}
+	digits := int64(0)
+	if len(args) == 2 {
+		digits = args[1].GetVal().GetIntVal()
+	}
+	switch {
+	case digits > 308:
+		// no DOUBLE has a digit that far
+		return args[0], nil
+	case digits < -308:
+		// and none is that large
+		return newDoubleNode(0), nil
+	}
+	scale := math.Pow(10, float64(digits))
+	val := args[0].GetVal().GetDoubleVal() * scale
+	if math.IsInf(val, 0) {
+		// a value that large has no digit that far either
+		return args[0], nil
+	}
+	if val < 0 {
+		val = -math.Floor(-val + 0.5)
+	} else {
+		val = math.Floor(val + 0.5)
+	}
+	return newDoubleNode(val / scale), nil
+}
+
+// coalesce returns its first argument that isn't NULL
+func coalesce(args []LiteralNode) (LiteralNode, error) {
+	for _, arg := range args {
+		if !IsNull(arg) {
+			return arg, nil
+		}
+	}
+	return args[len(args)-1], nil
+}
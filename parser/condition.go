@@ -24,11 +24,20 @@ func (self *WhereExpression) getIdFromBetween() (int64, int64, error) {
 	}
 	betweenExpr := self.Right.(*BetweenExpression)
 	if betweenExpr.Left.Type != SCLAR_LITERAL || betweenExpr.Right.Type != SCLAR_LITERAL {
-		panic("NOT SUPPORTED SCALAR TYPE")
+		// bounds computed per record can't narrow the scan
+		return 0, MaximumRange, ErrNotIdField
 	}
 	leftField := betweenExpr.Left.Val.(LiteralNode)
 	rightField := betweenExpr.Right.Val.(LiteralNode)
 
+	if IsNull(leftField) || IsNull(rightField) {
+		// a NULL bound is never true, the range is empty
+		return 1, 0, nil
+	}
+	if leftField.GetType() == protocol.DOUBLE || rightField.GetType() == protocol.DOUBLE {
+		// a fractional bound is compared per record
+		return 0, MaximumRange, ErrNotIdField
+	}
 	if leftField.GetType() != protocol.INT || rightField.GetType() != protocol.INT {
 		return MaximumRange, MaximumRange, fmt.Errorf("Invalid _id type %v, exptected INT", leftField.GetType())
 	}
@@ -37,19 +46,32 @@ func (self *WhereExpression) getIdFromBetween() (int64, int64, error) {
 	if idStart > idEnd {
 		return MaximumRange, MaximumRange, fmt.Errorf("Range of Between is invalid, %d is bigger than %d", idStart, idEnd)
 	}
+	if idEnd == math.MinInt64 {
+		// idEnd-1 would wrap around, the range is empty
+		return 1, 0, nil
+	}
 	return idStart, idEnd - 1, nil
 }
 
 func (self *WhereExpression) getIdFromComparison() (int64, int64, error) {
-	fieldName := self.Left.(string)
-	if fieldName != "_id" {
+	fieldName, ok := self.Left.(string)
+	if !ok || fieldName != "_id" {
 		return 0, MaximumRange, ErrNotIdField
 	}
 	rightScalar := self.Right.(*Scalar)
 	if rightScalar.Type != SCLAR_LITERAL {
-		panic("NOT SUPPORTED SCALAR TYPE")
+		// e.g. _id = other_column, evaluated per record
+		return 0, MaximumRange, ErrNotIdField
 	}
 	rightNode := rightScalar.Val.(LiteralNode)
+	if IsNull(rightNode) {
+		// _id compared with NULL is never true
+		return 1, 0, nil
+	}
+	if rightNode.GetType() == protocol.DOUBLE {
+		// e.g. _id > 1.5, compared per record
+		return 0, MaximumRange, ErrNotIdField
+	}
 	if rightNode.GetType() != protocol.INT {
 		return 0, MaximumRange, fmt.Errorf("Invalid _id type %v, exptected INT", rightNode.GetType())
 	}
@@ -58,135 +80,318 @@ func (self *WhereExpression) getIdFromComparison() (int64, int64, error) {
 	case EQUAL:
 		return val, val, nil
 	case GREATER:
+		if val == math.MaxInt64 {
+			// no _id is greater, val+1 would wrap around
+			return 1, 0, nil
+		}
 		return val + 1, MaximumRange, nil
 	case GREATEREQ:
 		return val, MaximumRange, nil
 	case SMALLER:
+		if val == math.MinInt64 {
+			// no _id is smaller, val-1 would wrap around
+			return 1, 0, nil
+		}
 		return 0, val - 1, nil
 	case SMALLEREQ:
 		return 0, val, nil
+	case NOTEQUAL:
+		// everything but one value, not worth two ranges
+		return 0, MaximumRange, ErrNotIdField
 	default:
 		panic("Invalid token type")
 	}
 	panic("shouldn't go here")
 }
 
-func GetIdCondition(condition *WhereExpression) (*WhereExpression, int64, int64, error) {
+func (self *WhereExpression) getIdsFromIn() ([]*IdRange, error) {
+	fieldName, ok := self.Left.(string)
+	if !ok || fieldName != "_id" {
+		return fullIdRanges(), ErrNotIdField
+	}
+	var ranges []*IdRange
+	for _, item := range self.Right.(*ScalarList).ScalarList {
+		if item.Type != SCLAR_LITERAL {
+			return fullIdRanges(), ErrNotIdField
+		}
+		node := item.Val.(LiteralNode)
+		if IsNull(node) {
+			// _id = NULL is never true, the other values still match
+			continue
+		}
+		if node.GetType() == protocol.DOUBLE {
+			return fullIdRanges(), ErrNotIdField
+		}
+		if node.GetType() != protocol.INT {
+			return nil, fmt.Errorf("Invalid _id type %v, exptected INT", node.GetType())
+		}
+		val := node.GetVal().GetIntVal()
+		ranges = append(ranges, &IdRange{val, val})
+	}
+	return normalizeIdRanges(ranges), nil
+}
+
+// GetIdCondition splits the _id predicates out of condition. It returns the
+// residual condition the engine still has to evaluate per record (nil if
+// nothing is left) and the sorted, disjoint _id ranges the scan can be
+// limited to. IN on _id gives one point range per value.
+func GetIdCondition(condition *WhereExpression) (*WhereExpression, []*IdRange, error) {
 	if condition == nil {
-		return nil, 0, MaximumRange, nil
+		return nil, fullIdRanges(), nil
 	}
 	switch condition.Type {
 	case WHERE_BETWEEN:
 		idStart, idEnd, err := condition.getIdFromBetween()
 		if err == ErrNotIdField {
-			return condition, idStart, idEnd, nil
-		} else {
-			return nil, idStart, idEnd, err
+			return condition, fullIdRanges(), nil
+		} else if err != nil {
+			return nil, nil, err
 		}
+		return nil, normalizeIdRanges([]*IdRange{&IdRange{idStart, idEnd}}), nil
 	case WHERE_COMPARISON:
 		idStart, idEnd, err := condition.getIdFromComparison()
 		if err == ErrNotIdField {
-			return condition, idStart, idEnd, nil
-		} else {
-			return nil, idStart, idEnd, err
+			return condition, fullIdRanges(), nil
+		} else if err != nil {
+			return nil, nil, err
 		}
-		return nil, idStart, idEnd, err
+		return nil, normalizeIdRanges([]*IdRange{&IdRange{idStart, idEnd}}), nil
+	case WHERE_IN:
+		ranges, err := condition.getIdsFromIn()
+		if err == ErrNotIdField {
+			return condition, ranges, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return nil, ranges, nil
 	case WHERE_AND:
-		leftCondition, leftStart, leftEnd, err := GetIdCondition(condition.Left.(*WhereExpression))
+		leftCondition, leftRanges, err := GetIdCondition(condition.Left.(*WhereExpression))
 		if err != nil {
-			return nil, MaximumRange, MaximumRange, err
+			return nil, nil, err
 		}
-		rightCondition, rightStart, rightEnd, err := GetIdCondition(condition.Right.(*WhereExpression))
+		rightCondition, rightRanges, err := GetIdCondition(condition.Right.(*WhereExpression))
 		if err != nil {
-			return nil, MaximumRange, MaximumRange, err
+			return nil, nil, err
 		}
-		newCondition := condition
+		// build a new node instead of rewriting condition in place, the
+		// caller may still need the original tree (e.g. under an OR)
+		var newCondition *WhereExpression
 		if leftCondition == nil {
 			newCondition = rightCondition
 		} else if rightCondition == nil {
 			newCondition = leftCondition
 		} else {
-			newCondition.Left = leftCondition
-			newCondition.Right = rightCondition
-		}
-		var idStart, idEnd int64
-		if leftStart == MaximumRange && rightStart == MaximumRange {
-			idStart = 0
-		} else if leftStart != MaximumRange && rightStart == MaximumRange {
-			idStart = leftStart
-		} else if rightStart != MaximumRange && leftStart == MaximumRange {
-			idStart = rightStart
-		} else {
-			if leftStart > rightStart {
-				idStart = leftStart
-			} else {
-				idStart = rightStart
-			}
-		}
-
-		if leftEnd == MaximumRange && rightEnd == MaximumRange {
-			idEnd = MaximumRange
-		} else if leftEnd != MaximumRange && rightEnd == MaximumRange {
-			idEnd = leftEnd
-		} else if rightEnd != MaximumRange && leftEnd == MaximumRange {
-			idEnd = rightEnd
-		} else {
-			if leftEnd < rightEnd {
-				idEnd = leftEnd
-			} else {
-				idEnd = rightEnd
-			}
+			newCondition = &WhereExpression{leftCondition, rightCondition, WHERE_AND, condition.Token}
 		}
-
-		return newCondition, idStart, idEnd, nil
+		return newCondition, intersectIdRanges(leftRanges, rightRanges), nil
+	case WHERE_OR:
+		// a row matches if either side matches, so the scan has to cover the
+		// union of both sides and every row still goes through the full condition
+		_, leftRanges, err := GetIdCondition(condition.Left.(*WhereExpression))
+		if err != nil {
+			return nil, nil, err
+		}
+		_, rightRanges, err := GetIdCondition(condition.Right.(*WhereExpression))
+		if err != nil {
+			return nil, nil, err
+		}
+		return condition, unionIdRanges(leftRanges, rightRanges), nil
+	case WHERE_NOT:
+		// the complement isn't worth computing, don't narrow the scan
+		return condition, fullIdRanges(), nil
+	case WHERE_LIKE, WHERE_REGEXP, WHERE_IS_NULL:
+		// _id is an INT and never NULL, nothing to narrow
+		return condition, fullIdRanges(), nil
+	case WHERE_IN_SUBQUERY:
+		return condition, fullIdRanges(), nil
+	case WHERE_EXISTS:
+		// once run, EXISTS is true for every record or for none
+		result := condition.Right.(*Subquery).Result
+		if result == nil {
+			return condition, fullIdRanges(), nil
+		} else if result.Exists() {
+			return nil, fullIdRanges(), nil
+		}
+		return nil, []*IdRange{}, nil
 	}
 	panic("shouldn't go here")
 }
 
-func (self *WhereExpression) getConditionFields(columnSet util.StringSet) {
+func getExpressionFields(expression interface{}, columnSet util.StringSet, skipAggregate bool) {
+	switch expr := expression.(type) {
+	case string:
+		columnSet.Insert(expr)
+	case *Scalar:
+		expr.getFields(columnSet, skipAggregate)
+	case *BetweenExpression:
+		expr.Left.getFields(columnSet, skipAggregate)
+		expr.Right.getFields(columnSet, skipAggregate)
+	case *ScalarList:
+		for _, scalar := range expr.ScalarList {
+			scalar.getFields(columnSet, skipAggregate)
+		}
+	}
+}
+
+func (self *WhereExpression) getConditionFields(columnSet util.StringSet, skipAggregate bool) {
 	switch self.Type {
-	case WHERE_AND:
-		self.Left.(*WhereExpression).getConditionFields(columnSet)
-		self.Right.(*WhereExpression).getConditionFields(columnSet)
-	case WHERE_COMPARISON:
-		fieldName := self.Left.(string)
-		columnSet.Insert(fieldName)
-	case WHERE_BETWEEN:
-		fieldName := self.Left.(string)
-		columnSet.Insert(fieldName)
+	case WHERE_AND, WHERE_OR:
+		self.Left.(*WhereExpression).getConditionFields(columnSet, skipAggregate)
+		self.Right.(*WhereExpression).getConditionFields(columnSet, skipAggregate)
+	case WHERE_NOT:
+		self.Left.(*WhereExpression).getConditionFields(columnSet, skipAggregate)
+	case WHERE_COMPARISON, WHERE_BETWEEN, WHERE_IN, WHERE_LIKE, WHERE_REGEXP, WHERE_IS_NULL:
+		getExpressionFields(self.Left, columnSet, skipAggregate)
+		getExpressionFields(self.Right, columnSet, skipAggregate)
+	case WHERE_IN_SUBQUERY:
+		// the columns of the subquery are those of its own table
+		getExpressionFields(self.Left, columnSet, skipAggregate)
+	case WHERE_EXISTS:
 	default:
 		panic(fmt.Sprintf("UNKNOWN WHERE TYPE %d", self.Type))
 	}
 }
 
+// getScalars returns the scalar operands of a predicate, a plain column
+// stored as its name is not included
+func (self *WhereExpression) getScalars() []*Scalar {
+	var scalars []*Scalar
+	for _, expression := range []interface{}{self.Left, self.Right} {
+		switch expr := expression.(type) {
+		case *Scalar:
+			scalars = append(scalars, expr)
+		case *BetweenExpression:
+			scalars = append(scalars, expr.Left, expr.Right)
+		case *ScalarList:
+			scalars = append(scalars, expr.ScalarList...)
+		}
+	}
+	return scalars
+}
+
+func (self *WhereExpression) HasAggregate() bool {
+	switch self.Type {
+	case WHERE_AND, WHERE_OR:
+		return self.Left.(*WhereExpression).HasAggregate() || self.Right.(*WhereExpression).HasAggregate()
+	case WHERE_NOT:
+		return self.Left.(*WhereExpression).HasAggregate()
+	}
+	for _, scalar := range self.getScalars() {
+		if scalar.HasAggregate() {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *WhereExpression) getAggregates(aggregates []*FunctionCall) []*FunctionCall {
+	switch self.Type {
+	case WHERE_AND, WHERE_OR:
+		aggregates = self.Left.(*WhereExpression).getAggregates(aggregates)
+		return self.Right.(*WhereExpression).getAggregates(aggregates)
+	case WHERE_NOT:
+		return self.Left.(*WhereExpression).getAggregates(aggregates)
+	}
+	for _, scalar := range self.getScalars() {
+		aggregates = scalar.getAggregates(aggregates)
+	}
+	return aggregates
+}
+
+func (self *WhereExpression) validate() error {
+	switch self.Type {
+	case WHERE_AND, WHERE_OR:
+		if err := self.Left.(*WhereExpression).validate(); err != nil {
+			return err
+		}
+		return self.Right.(*WhereExpression).validate()
+	case WHERE_NOT:
+		return self.Left.(*WhereExpression).validate()
+	case WHERE_LIKE, WHERE_REGEXP:
+		if err := self.Right.(*PatternExpression).Err; err != nil {
+			return err
+		}
+	case WHERE_IN_SUBQUERY, WHERE_EXISTS:
+		if err := self.Right.(*Subquery).validate(self.Type == WHERE_IN_SUBQUERY); err != nil {
+			return err
+		}
+	}
+	for _, scalar := range self.getScalars() {
+		if err := scalar.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (self *SelectQuery) getSelectFields(columnSet util.StringSet) {
 	if self.ScalarList == nil {
 		return
 	}
 	for _, scalar := range self.ScalarList.ScalarList {
 		switch scalar.Type {
-		case SCALAR_IDENT:
-			ident := scalar.Val.(string)
-			columnSet.Insert(ident)
+		case SCALAR_IDENT, SCALAR_FUNCTION, SCALAR_EXPRESSION:
+			scalar.getFields(columnSet, false)
+		case SCLAR_LITERAL:
+			// a constant, nothing to fetch
 		default:
 			panic("SCALAR TYPE NOT SUPPORTED")
 		}
 	}
 }
 
+func (self *SelectQuery) getOrderByFields(columnSet util.StringSet) {
+	if self.OrderByList == nil {
+		return
+	}
+	for _, orderBy := range self.OrderBys {
+		// the columns of an aliased expression are those of the select list
+		if self.GetOrderByScalar(orderBy) == nil {
+			columnSet.Insert(orderBy.Field)
+		}
+	}
+}
+
+// GetOrderByScalar returns the selected expression orderBy names by its
+// alias, nil when it names a column. An alias hides a column of the same name.
+func (self *SelectQuery) GetOrderByScalar(orderBy *OrderBy) *Scalar {
+	if self.ScalarList == nil {
+		return nil
+	}
+	for _, scalar := range self.ScalarList.ScalarList {
+		if scalar.Alias != "" && scalar.Alias == orderBy.Field {
+			return scalar
+		}
+	}
+	return nil
+}
+
 func (self *WhereExpression) GetConditionFields() []string {
 	columnSet := util.NewStringSet()
-	self.getConditionFields(columnSet)
+	self.getConditionFields(columnSet, false)
 	return columnSet.ConvertToStrings()
 }
 
 func (self *SelectQuery) GetSelectAndConditionFields() []string {
 	columnSet := util.NewStringSet()
+	self.getSelectAndConditionFields(columnSet)
+	self.getOrderByFields(columnSet)
+	return columnSet.ConvertToStrings()
+}
+
+func (self *SelectQuery) getSelectAndConditionFields(columnSet util.StringSet) {
 	if self.WhereExpression != nil {
-		self.WhereExpression.getConditionFields(columnSet)
+		self.WhereExpression.getConditionFields(columnSet, false)
+	}
+	if self.Having != nil {
+		self.Having.getConditionFields(columnSet, false)
+	}
+	if self.GroupBy != nil {
+		for _, field := range self.GroupBy.Fields {
+			columnSet.Insert(field)
+		}
 	}
 	self.getSelectFields(columnSet)
-	return columnSet.ConvertToStrings()
 }
 
 func (self *SelectQuery) GetSelectFields() []string {
@@ -194,3 +399,18 @@ func (self *SelectQuery) GetSelectFields() []string {
 	self.getSelectFields(columnSet)
 	return columnSet.ConvertToStrings()
 }
+
+// GetAggregates returns the distinct aggregate calls of the select list and
+// the HAVING clause, in the order they first appear
+func (self *SelectQuery) GetAggregates() []*FunctionCall {
+	var aggregates []*FunctionCall
+	if self.ScalarList != nil {
+		for _, scalar := range self.ScalarList.ScalarList {
+			aggregates = scalar.getAggregates(aggregates)
+		}
+	}
+	if self.Having != nil {
+		aggregates = self.Having.getAggregates(aggregates)
+	}
+	return aggregates
+}
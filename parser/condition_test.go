@@ -0,0 +1,68 @@
+package parser
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// conditionTree prints every AND, OR and NOT with its own parentheses
+func conditionTree(condition *WhereExpression) string {
+	switch condition.Type {
+	case WHERE_AND:
+		return "(" + conditionTree(condition.Left.(*WhereExpression)) + " AND " + conditionTree(condition.Right.(*WhereExpression)) + ")"
+	case WHERE_OR:
+		return "(" + conditionTree(condition.Left.(*WhereExpression)) + " OR " + conditionTree(condition.Right.(*WhereExpression)) + ")"
+	case WHERE_NOT:
+		return "NOT(" + conditionTree(condition.Left.(*WhereExpression)) + ")"
+	}
+	return condition.Format()
+}
+
+func parseWhere(t *testing.T, where string) *WhereExpression {
+	query, err := Parse("SELECT a FROM t WHERE " + where)
+	assert.Equal(t, err, nil, where)
+	return query.Statement.(*SelectQuery).WhereExpression
+}
+
+func TestBooleanConditions(t *testing.T) {
+	for where, tree := range map[string]string{
+		"a = 1 OR b = 2":                   "(a = 1 OR b = 2)",
+		"a = 1 OR b = 2 OR c = 3":          "((a = 1 OR b = 2) OR c = 3)",
+		"a = 1 OR b = 2 AND c = 3":         "(a = 1 OR (b = 2 AND c = 3))",
+		"a = 1 AND b = 2 OR c = 3":         "((a = 1 AND b = 2) OR c = 3)",
+		"(a = 1 OR b = 2) AND c = 3":       "((a = 1 OR b = 2) AND c = 3)",
+		"NOT a = 1 AND b = 2":              "(NOT(a = 1) AND b = 2)",
+		"NOT (a = 1 OR b = 2)":             "NOT((a = 1 OR b = 2))",
+		"NOT NOT x > 3":                    "NOT(NOT(x > 3))",
+		"a = 1 OR NOT b BETWEEN 1 AND 5":   "(a = 1 OR NOT(b BETWEEN 1 AND 5))",
+		"order_id = 1 OR origin = 'x'":     "(order_id = 1 OR origin = 'x')",
+		"not_null = 1 and NOT notes = 'a'": "(not_null = 1 AND NOT(notes = 'a'))",
+	} {
+		assert.Equal(t, conditionTree(parseWhere(t, where)), tree, where)
+	}
+
+	for _, where := range []string{"a = 1 OR", "NOT", "a = 1 NOT b = 2", "OR a = 1"} {
+		_, err := Parse("SELECT a FROM t WHERE " + where)
+		assert.NotEqual(t, err, nil, where)
+	}
+}
+
+func TestBooleanConditionFields(t *testing.T) {
+	fields := parseWhere(t, "a = 1 OR NOT (b > 2 AND c < 3)").GetConditionFields()
+	sort.Strings(fields)
+	assert.Equal(t, fields, []string{"a", "b", "c"})
+}
+
+// the _id range is taken from a copy, the condition under an OR is still
+// needed in full to filter the rows
+func TestIdConditionKeepsTree(t *testing.T) {
+	where := "(_id = 1 AND a = 1) OR (_id = 5 AND NOT b = 2)"
+	condition := parseWhere(t, where)
+	residual, ranges, err := GetIdCondition(condition)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ranges, idRangeList(1, 1, 5, 5))
+	assert.Equal(t, residual, condition)
+	assert.Equal(t, conditionTree(condition), "((_id = 1 AND a = 1) OR (_id = 5 AND NOT(b = 2)))")
+}
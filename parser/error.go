@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParserError describes why a statement was rejected. Syntax errors also
+// carry where they were found: Line and Column start at 1, Token is the
+// offending token (empty at the end of the input) and Expected lists the
+// tokens the grammar would have accepted there.
+type ParserError struct {
+	Message  string   `json:"message"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Expected []string `json:"expected,omitempty"`
+}
+
+func NewParserError(format string, args ...interface{}) ParserError {
+	return ParserError{Message: fmt.Sprintf(format, args...)}
+}
+
+func (err ParserError) Error() string {
+	return err.Message
+}
+
+// tokenNames names every token a statement can contain, keywords and
+// operators by their text and the others by their class. A token spelled
+// several ways, like != and <>, is named by its smallest spelling.
+var tokenNames = func() map[int]string {
+	names := map[int]string{
+		IDENT:  "IDENT",
+		STRING: "STRING",
+		INT:    "INT",
+		DOUBLE: "DOUBLE",
+		BOOL:   "BOOL",
+		PARAM:  "PARAM",
+	}
+	for _, tokenMap := range []map[string]int{KeywordTokenMap, OPTokenMap, ComparisonMap} {
+		for src, token := range tokenMap {
+			if name, ok := names[token]; !ok || src < name {
+				names[token] = src
+			}
+		}
+	}
+	return names
+}()
+
+const endOfInput = "end of input"
+
+// position returns the 1-based line and column of the byte offset pos
+func (l *Lex) position(pos int) (int, int) {
+	if pos > len(l.Query) {
+		pos = len(l.Query)
+	}
+	prefix := l.Query[:pos]
+	line := strings.Count(prefix, "\n") + 1
+	column := utf8.RuneCountInString(prefix[strings.LastIndex(prefix, "\n")+1:]) + 1
+	return line, column
+}
+
+func (l *Lex) syntaxError() ParserError {
+	err := ParserError{}
+	buf := bytes.NewBufferString("syntax error")
+	if len(l.tokens) == 0 {
+		err.Message = buf.String()
+		return err
+	}
+
+	offending := l.tokens[len(l.tokens)-1]
+	err.Line, err.Column = l.position(offending.tok.Pos)
+	err.Token = offending.tok.Src
+	fmt.Fprintf(buf, " at line %d, column %d", err.Line, err.Column)
+	if offending.id == lexErrorToken && l.lexError != "" {
+		err.Token = l.Query[offending.tok.Pos:]
+		fmt.Fprintf(buf, ": %s", l.lexError)
+	} else if offending.id == lexErrorToken {
+		r, _ := utf8.DecodeRuneInString(l.Query[offending.tok.Pos:])
+		err.Token = string(r)
+		fmt.Fprintf(buf, ": unexpected character %q", err.Token)
+	} else if offending.id == 0 {
+		fmt.Fprintf(buf, ": unexpected %s", endOfInput)
+	} else {
+		fmt.Fprintf(buf, " near %q", err.Token)
+	}
+
+	err.Expected = l.expectedTokens()
+	if len(err.Expected) > 0 {
+		fmt.Fprintf(buf, ", expected one of %s", strings.Join(err.Expected, ", "))
+	}
+	err.Message = buf.String()
+	return err
+}
+
+// expectedTokens finds the tokens that could have taken the place of the
+// offending one by parsing the tokens before it again, followed by every
+// candidate in turn. A candidate fits if the parser asks for the token after it.
+func (l *Lex) expectedTokens() []string {
+	errIdx := len(l.tokens) - 1
+	candidates := make(map[int]string, len(tokenNames)+1)
+	for id, name := range tokenNames {
+		candidates[id] = name
+	}
+	candidates[0] = endOfInput
+
+	fits := make(map[int]bool)
+	for id, name := range candidates {
+		replay := make([]lexedToken, errIdx, errIdx+1)
+		copy(replay, l.tokens[:errIdx])
+		replay = append(replay, lexedToken{id, Token{l.tokens[errIdx].tok.Pos, name}})
+		probe := &Lex{Query: l.Query, replay: replay}
+		if FunDBParse(probe) == 0 || len(probe.tokens) > errIdx+1 {
+			fits[id] = true
+		}
+	}
+	var expected []string
+	for id := range fits {
+		// a non-reserved keyword is only worth naming where it isn't just a name
+		if !NonReservedKeywords[id] || !fits[IDENT] {
+			expected = append(expected, candidates[id])
+		}
+	}
+	sort.Strings(expected)
+	return expected
+}
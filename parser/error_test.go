@@ -0,0 +1,61 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSyntaxError(t *testing.T) {
+	for _, c := range []struct {
+		sql          string
+		line, column int
+		token        string
+		expected     []string
+		message      string
+	}{
+		{"", 1, 1, "",
+			[]string{"ALTER", "CREATE", "DELETE", "DESC", "DESCRIBE", "DROP", "EXPLAIN", "INSERT", "REPLACE", "SELECT", "SHOW", "TRUNCATE", "UPDATE"},
+			"syntax error at line 1, column 1: unexpected end of input, expected one of ALTER, CREATE, DELETE, DESC, DESCRIBE, DROP, EXPLAIN, INSERT, REPLACE, SELECT, SHOW, TRUNCATE, UPDATE"},
+		{"DROP t", 1, 6, "t", []string{"TABLE"},
+			`syntax error at line 1, column 6 near "t", expected one of TABLE`},
+		{"SELECT a FROM t LIMIT x", 1, 23, "x", []string{"INT"},
+			`syntax error at line 1, column 23 near "x", expected one of INT`},
+		{"SELECT a FROM t WHERE a # 1", 1, 25, "#",
+			[]string{"!=", "(", "*", "+", "-", ".", "/", "<", "<=", "=", ">", ">=", "BETWEEN", "IN", "IS", "LIKE", "NOT", "REGEXP"},
+			`syntax error at line 1, column 25: unexpected character "#", expected one of !=, (, *, +, -, ., /, <, <=, =, >, >=, BETWEEN, IN, IS, LIKE, NOT, REGEXP`},
+		{"SELECT a,\n  b FROM t\n WHERE a == 1", 3, 11, "=",
+			[]string{"(", "-", "BOOL", "DOUBLE", "IDENT", "INT", "NULL", "PARAM", "STRING"},
+			`syntax error at line 3, column 11 near "=", expected one of (, -, BOOL, DOUBLE, IDENT, INT, NULL, PARAM, STRING`},
+		// columns count characters, not bytes
+		{"SELECT é, FROM t", 1, 8, "é",
+			[]string{"(", "*", "-", "BOOL", "DISTINCT", "DOUBLE", "IDENT", "INT", "NULL", "PARAM", "STRING"},
+			`syntax error at line 1, column 8: unexpected character "é", expected one of (, *, -, BOOL, DISTINCT, DOUBLE, IDENT, INT, NULL, PARAM, STRING`},
+		// the token of a lexer error is the rest of the input
+		{"SELECT a FROM t WHERE a = 'x", 1, 27, "'x",
+			[]string{"(", "-", "BOOL", "DOUBLE", "IDENT", "INT", "NULL", "PARAM", "STRING"},
+			"syntax error at line 1, column 27: unterminated string, expected one of (, -, BOOL, DOUBLE, IDENT, INT, NULL, PARAM, STRING"},
+	} {
+		_, err := Parse(c.sql)
+		parserErr, ok := err.(ParserError)
+		assert.T(t, ok, c.sql)
+		assert.Equal(t, parserErr.Line, c.line, c.sql)
+		assert.Equal(t, parserErr.Column, c.column, c.sql)
+		assert.Equal(t, parserErr.Token, c.token, c.sql)
+		assert.Equal(t, parserErr.Expected, c.expected, c.sql)
+		assert.Equal(t, parserErr.Message, c.message, c.sql)
+	}
+}
+
+func TestExpectedTokensAtEnd(t *testing.T) {
+	_, err := Parse("SELECT a\nFROM t WHERE")
+	parserErr := err.(ParserError)
+	assert.Equal(t, parserErr.Line, 2)
+	assert.Equal(t, parserErr.Column, 13)
+	assert.Equal(t, parserErr.Token, "")
+	assert.Equal(t, parserErr.Expected, []string{"(", "-", "BOOL", "DOUBLE", "EXISTS", "IDENT", "INT", "NOT", "NULL", "PARAM", "STRING"})
+
+	// only a table name can follow FROM
+	_, err = Parse("SELECT a FROM")
+	assert.Equal(t, err.(ParserError).Expected, []string{"IDENT"})
+}
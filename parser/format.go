@@ -0,0 +1,436 @@
+package parser
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// Format prints canonical SQL: keywords are upper case, identifiers are only
+// quoted when they have to be, strings use single quotes and every optional
+// clause left to its default is omitted. Parsing what Format returns gives
+// back the same statement, so it can be logged, replayed or fingerprinted.
+
+func (self *Query) String() string {
+	return self.Format()
+}
+
+func (self *Query) Format() string {
+	return self.Statement.Format()
+}
+
+func (self *SelectQuery) String() string {
+	return self.Format()
+}
+
+func (self *SelectQuery) Format() string {
+	buf := bytes.NewBufferString("SELECT ")
+	if self.Distinct {
+		buf.WriteString("DISTINCT ")
+	}
+	buf.WriteString(self.SelectExpression.Format())
+	buf.WriteString(" ")
+	buf.WriteString(self.TableExpression.Format())
+	if self.GroupBy != nil {
+		buf.WriteString(" GROUP BY ")
+		buf.WriteString(self.GroupBy.Format())
+	}
+	if self.Having != nil {
+		buf.WriteString(" HAVING ")
+		buf.WriteString(self.Having.Format())
+	}
+	if self.OrderByList != nil {
+		buf.WriteString(" ORDER BY ")
+		buf.WriteString(self.OrderByList.Format())
+	}
+	if self.Limit != -1 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.Itoa(self.Limit))
+	}
+	if self.Offset != 0 {
+		buf.WriteString(" OFFSET ")
+		buf.WriteString(strconv.Itoa(self.Offset))
+	}
+	return buf.String()
+}
+
+func (self *InsertQuery) String() string {
+	return self.Format()
+}
+
+func (self *InsertQuery) Format() string {
+	buf := bytes.NewBufferString("INSERT INTO ")
+	if self.OnConflict == CONFLICT_REPLACE {
+		buf.Reset()
+		buf.WriteString("REPLACE INTO ")
+	}
+	buf.WriteString(formatIdent(self.Table))
+	if self.ColumnFields != nil {
+		buf.WriteString(" (")
+		buf.WriteString(self.ColumnFields.Format())
+		buf.WriteString(")")
+	}
+	if self.Select != nil {
+		buf.WriteString(" ")
+		buf.WriteString(self.Select.Format())
+	} else {
+		buf.WriteString(" VALUES ")
+		buf.WriteString(self.ValueList.Format())
+	}
+	if self.OnConflict == CONFLICT_UPDATE {
+		buf.WriteString(" ON CONFLICT (")
+		buf.WriteString(formatIdent(self.ConflictColumn))
+		buf.WriteString(") DO UPDATE")
+	}
+	return buf.String()
+}
+
+func (self *DeleteQuery) String() string {
+	return self.Format()
+}
+
+func (self *DeleteQuery) Format() string {
+	return "DELETE " + self.TableExpression.Format()
+}
+
+func (self *UpdateQuery) String() string {
+	return self.Format()
+}
+
+func (self *UpdateQuery) Format() string {
+	sql := "UPDATE " + formatIdent(self.Table) + " SET " + self.AssignmentList.Format()
+	if self.WhereExpression != nil {
+		sql += " WHERE " + self.WhereExpression.Format()
+	}
+	return sql
+}
+
+func (self *CreateTableQuery) String() string {
+	return self.Format()
+}
+
+func (self *CreateTableQuery) Format() string {
+	buf := bytes.NewBufferString("CREATE TABLE ")
+	buf.WriteString(formatIdent(self.Name))
+	if self.Columns != nil {
+		buf.WriteString(" (")
+		for i, column := range self.Columns {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(column.Format())
+		}
+		buf.WriteString(")")
+	}
+	if self.Type == TABLE_ID_INCREMENT {
+		buf.WriteString(" INCREMENT")
+	}
+	return buf.String()
+}
+
+func (self *ColumnDef) Format() string {
+	sql := formatIdent(self.Name) + " " + self.Type.String()
+	if self.NotNull {
+		sql += " NOT NULL"
+	}
+	if self.Default != nil {
+		sql += " DEFAULT " + formatLiteral(NewFieldLiteral(self.Default))
+	}
+	return sql
+}
+
+func (self *DropTableQuery) String() string {
+	return self.Format()
+}
+
+func (self *DropTableQuery) Format() string {
+	return "DROP TABLE " + formatIdent(self.Name)
+}
+
+func (self *TruncateTableQuery) String() string {
+	return self.Format()
+}
+
+func (self *TruncateTableQuery) Format() string {
+	return "TRUNCATE TABLE " + formatIdent(self.Name)
+}
+
+func (self *AlterTableQuery) String() string {
+	return self.Format()
+}
+
+func (self *AlterTableQuery) Format() string {
+	sql := "ALTER TABLE " + formatIdent(self.Name)
+	switch self.Type {
+	case ALTER_ADD_COLUMN:
+		if self.Definition != nil {
+			return sql + " ADD COLUMN " + self.Definition.Format()
+		}
+		return sql + " ADD COLUMN " + formatIdent(self.Column)
+	case ALTER_DROP_COLUMN:
+		return sql + " DROP COLUMN " + formatIdent(self.Column)
+	default:
+		return sql + " RENAME TO " + formatIdent(self.NewName)
+	}
+}
+
+func (self *ShowQuery) String() string {
+	return self.Format()
+}
+
+func (self *ShowQuery) Format() string {
+	var sql string
+	switch self.Type {
+	case SHOW_COLUMNS:
+		return "DESCRIBE " + formatIdent(self.Table)
+	case SHOW_DATABASES:
+		sql = "SHOW DATABASES"
+	case SHOW_TABLES:
+		sql = "SHOW TABLES"
+	default:
+		sql = "SHOW TABLE STATUS"
+	}
+	if self.Like != nil {
+		sql += " " + self.Like.Format()
+	}
+	return sql
+}
+
+func (self *ExplainQuery) String() string {
+	return self.Format()
+}
+
+func (self *ExplainQuery) Format() string {
+	if self.Analyze {
+		return "EXPLAIN ANALYZE " + self.Query.Format()
+	}
+	return "EXPLAIN " + self.Query.Format()
+}
+
+func (self *TableExpression) Format() string {
+	if self.WhereExpression == nil {
+		return self.FromExpression.Format()
+	}
+	return self.FromExpression.Format() + " WHERE " + self.WhereExpression.Format()
+}
+
+func (self *FromExpression) Format() string {
+	if self.Join == nil {
+		return "FROM " + formatIdent(self.Table)
+	}
+	return "FROM " + formatIdent(self.Table) + " " + self.Join.Format()
+}
+
+func (self *SelectExpression) Format() string {
+	if self.IsStar {
+		return "*"
+	}
+	items := make([]string, len(self.ScalarList.ScalarList))
+	for i, scalar := range self.ScalarList.ScalarList {
+		items[i] = scalar.Format()
+		if scalar.Alias != "" {
+			items[i] += " AS " + formatIdent(scalar.Alias)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+func (self *ScalarList) Format() string {
+	items := make([]string, len(self.ScalarList))
+	for i, scalar := range self.ScalarList {
+		items[i] = scalar.Format()
+	}
+	return strings.Join(items, ", ")
+}
+
+// Format prints the scalar without its alias, unlike String which is the
+// name of the output column and leaves literals unquoted
+func (self *Scalar) Format() string {
+	switch self.Type {
+	case SCALAR_IDENT:
+		return formatColumn(self.Val.(string))
+	case SCLAR_LITERAL:
+		return formatLiteral(self.Val.(LiteralNode))
+	case SCALAR_FUNCTION:
+		return self.Val.(*FunctionCall).Format()
+	default:
+		return self.Val.(*ArithmeticExpression).Format()
+	}
+}
+
+func (self *ArithmeticExpression) Format() string {
+	operand := func(scalar *Scalar) string {
+		if scalar.Type == SCALAR_EXPRESSION {
+			return "(" + scalar.Format() + ")"
+		}
+		return scalar.Format()
+	}
+	if self.Op == UMINUS {
+		// a negative operand would print --, which starts a comment
+		if left := operand(self.Left); !strings.HasPrefix(left, "-") {
+			return "-" + left
+		}
+		return "-(" + self.Left.Format() + ")"
+	}
+	return operand(self.Left) + " " + ArithmeticOpMap[self.Op] + " " + operand(self.Right)
+}
+
+func (self *FunctionCall) Format() string {
+	if self.IsStar {
+		return self.Name + "(*)"
+	}
+	if self.ScalarList == nil {
+		return self.Name + "()"
+	}
+	return self.Name + "(" + self.ScalarList.Format() + ")"
+}
+
+func (self *BetweenExpression) Format() string {
+	return "BETWEEN " + self.Left.Format() + " AND " + self.Right.Format()
+}
+
+func (self *PatternExpression) Format() string {
+	keyword := "REGEXP "
+	if self.IsLike {
+		keyword = "LIKE "
+	}
+	if self.Param != nil {
+		return keyword + self.Param.Token.Src
+	}
+	return keyword + formatString(self.Pattern)
+}
+
+func (self *OrderByList) Format() string {
+	items := make([]string, len(self.OrderBys))
+	for i, orderBy := range self.OrderBys {
+		items[i] = orderBy.Format()
+	}
+	return strings.Join(items, ", ")
+}
+
+func (self *OrderBy) Format() string {
+	switch self.Order {
+	case ORDER_ASC:
+		return formatColumn(self.Field) + " ASC"
+	case ORDER_DESC:
+		return formatColumn(self.Field) + " DESC"
+	default:
+		return formatColumn(self.Field)
+	}
+}
+
+func (self *ColumnFields) Format() string {
+	items := make([]string, len(self.Fields))
+	for i, field := range self.Fields {
+		items[i] = formatColumn(field)
+	}
+	return strings.Join(items, ", ")
+}
+
+func (self *AssignmentList) Format() string {
+	items := make([]string, len(self.Assignments))
+	for i, assignment := range self.Assignments {
+		items[i] = assignment.Format()
+	}
+	return strings.Join(items, ", ")
+}
+
+func (self *Assignment) Format() string {
+	return formatIdent(self.Field) + " = " + self.Val.Format()
+}
+
+func (self *ValueList) Format() string {
+	items := make([]string, len(self.Values))
+	for i, values := range self.Values {
+		items[i] = values.Format()
+	}
+	return strings.Join(items, ", ")
+}
+
+func (self *ValueItems) Format() string {
+	items := make([]string, len(self.Items))
+	for i, item := range self.Items {
+		items[i] = formatLiteral(item)
+	}
+	return "(" + strings.Join(items, ", ") + ")"
+}
+
+// formatIdent quotes a name with backquotes when it isn't a plain
+// identifier or would be read as a reserved keyword
+func formatIdent(name string) string {
+	upper := strings.ToUpper(name)
+	token, ok := KeywordTokenMap[upper]
+	if (!ok || NonReservedKeywords[token]) && upper != "TRUE" && upper != "FALSE" && isIdent(name) {
+		return name
+	}
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// formatColumn prints a column, the table of a qualified one apart
+func formatColumn(name string) string {
+	if table, column := SplitColumn(name); table != "" && column != "" {
+		return formatIdent(table) + "." + formatIdent(column)
+	}
+	return formatIdent(name)
+}
+
+// formatString quotes a string so that unquoteString gives it back
+func formatString(val string) string {
+	buf := bytes.NewBufferString("'")
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; c {
+		case '\'':
+			buf.WriteString("''")
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case 0:
+			buf.WriteString(`\0`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteString("'")
+	return buf.String()
+}
+
+// formatLiteral prints a literal the way the lexer reads it back with the
+// same type, a DOUBLE always has a fraction or an exponent
+func formatLiteral(node LiteralNode) string {
+	switch node := node.(type) {
+	case *ParamNode:
+		return node.Token.Src
+	case *IntervalNode:
+		return "INTERVAL '" + node.Duration.String() + "'"
+	case *TimestampNode:
+		return "TIMESTAMP '" + node.Time().Format(time.RFC3339Nano) + "'"
+	}
+	val := node.GetVal()
+	switch node.GetType() {
+	case protocol.INT:
+		return strconv.FormatInt(val.GetIntVal(), 10)
+	case protocol.DOUBLE:
+		src := strconv.FormatFloat(val.GetDoubleVal(), 'g', -1, 64)
+		if !strings.ContainsAny(src, ".e") {
+			src += ".0"
+		}
+		return src
+	case protocol.BOOL:
+		if val.GetBoolVal() {
+			return "TRUE"
+		}
+		return "FALSE"
+	case protocol.STRING:
+		return formatString(val.GetStrVal())
+	default:
+		return "NULL"
+	}
+}
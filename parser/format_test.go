@@ -0,0 +1,337 @@
+package parser
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestFormat(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"select a,b as c from t where x<>1 and (y=2 or z=3)":                "SELECT a, b AS c FROM t WHERE x != 1 AND (y = 2 OR z = 3)",
+		"SELECT * FROM t WHERE a OR (b = 1 OR c = 2)":                       "", // a isn't a condition
+		"SELECT * FROM t WHERE a = 1 OR (b = 1 OR c = 2)":                   "SELECT * FROM t WHERE a = 1 OR (b = 1 OR c = 2)",
+		"SELECT * FROM t WHERE NOT (a = 1 AND b = 2)":                       "SELECT * FROM t WHERE NOT (a = 1 AND b = 2)",
+		"SELECT `order`, `my col` FROM `select` WHERE `x``y` = 1":           "SELECT `order`, `my col` FROM `select` WHERE `x``y` = 1",
+		"SELECT * FROM t WHERE s = \"it's\" OR s = 'a\\\\b\\n'":             "SELECT * FROM t WHERE s = 'it''s' OR s = 'a\\\\b\\n'",
+		"SELECT * FROM t WHERE d = 1. OR d = 2e3 OR d = .5":                 "SELECT * FROM t WHERE d = 1.0 OR d = 2000.0 OR d = 0.5",
+		"SELECT * FROM t WHERE a not in (1, 2) and b is not null":           "SELECT * FROM t WHERE a NOT IN (1, 2) AND b IS NOT NULL",
+		"SELECT * FROM t WHERE name NOT LIKE '100\\%'":                      "SELECT * FROM t WHERE name NOT LIKE '100\\\\%'",
+		"SELECT * FROM t WHERE ts > TIMESTAMP '2024-03-01' - INTERVAL '1d'": "SELECT * FROM t WHERE ts > TIMESTAMP '2024-03-01T00:00:00Z' - INTERVAL '24h0m0s'",
+		"SELECT a.x FROM a INNER JOIN b ON b._id = a.ref":                   "SELECT a.x FROM a JOIN b ON a.ref = b._id",
+		"insert into t (_id,a,b,c,d) values (1, -2.5, 'x', null, true)":     "INSERT INTO t (_id, a, b, c, d) VALUES (1, -2.5, 'x', NULL, TRUE)",
+		"replace into t (_id, a) select _id, a from u":                      "REPLACE INTO t (_id, a) SELECT _id, a FROM u",
+		"create table t (a int not null, d double default 1) random":        "CREATE TABLE t (a INT NOT NULL, d DOUBLE DEFAULT 1.0)",
+		"desc t":                      "DESCRIBE t",
+		"truncate t":                  "TRUNCATE TABLE t",
+		"alter table t drop a":        "ALTER TABLE t DROP COLUMN a",
+		"show table status like 't%'": "SHOW TABLE STATUS LIKE 't%'",
+	} {
+		query, err := Parse(sql)
+		if expected == "" {
+			assert.NotEqual(t, err, nil)
+			continue
+		}
+		assert.Equal(t, err, nil)
+		assert.Equal(t, query.Format(), expected)
+	}
+
+	// the output column of a literal is still named after its value
+	query, err := Parse("SELECT 'x', count(*) FROM t")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).ScalarList.ScalarList[0].Name(), "x")
+	assert.Equal(t, query.String(), "SELECT 'x', COUNT(*) FROM t")
+}
+
+func TestFormatPrepared(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT * FROM t WHERE a = ? AND name LIKE ? LIMIT 10",
+		"UPDATE t SET a = $2 WHERE _id = $1",
+	} {
+		stmt, err := Prepare(sql)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, stmt.Query.Format(), sql)
+	}
+}
+
+// TestFormatRoundTrip checks Parse(Format(Parse(q))) is the query Parse(q)
+// returned for a corpus of hand written and randomly generated statements
+func TestFormatRoundTrip(t *testing.T) {
+	corpus := []string{
+		"SELECT DISTINCT a, b FROM t WHERE a > 1 ORDER BY a, b DESC LIMIT 5 OFFSET 10",
+		"SELECT b, COUNT(*) AS n, SUM(a) FROM t WHERE a BETWEEN 1 AND 9 GROUP BY b HAVING COUNT(*) > 1 ORDER BY b ASC",
+		"SELECT a.x, b.y FROM a JOIN b ON a.ref = b._id WHERE b.y IN (SELECT y FROM c WHERE z = 'q') AND a.x IS NULL",
+		"SELECT * FROM t WHERE EXISTS (SELECT _id FROM u WHERE u_id = 1 LIMIT 1) OR NOT NOT a = 1",
+		"SELECT UPPER(name), SUBSTR(name, 1, 2), ROUND(d, 2), COALESCE(a, b, 0), NOW() FROM t",
+		"SELECT -a, -(-a), a - -1, (a + 1) * (b - 2) / 3 FROM t WHERE -a < - 1",
+		"SELECT * FROM t WHERE DATE_TRUNC('day', ts) = TIMESTAMP '2024-03-01T10:20:30.123456789Z'",
+		"SELECT * FROM t WHERE a REGEXP '^[a-z]+$' AND b NOT REGEXP 'x\\\\d'",
+		"DELETE FROM t WHERE _id IN (1, 2, 3) OR a NOT IN (SELECT a FROM u)",
+		"UPDATE t SET a = a * 2, b = 'it''s' WHERE b IS NOT NULL",
+		"INSERT INTO t (_id, a) VALUES (1, -9223372036854775808), (2, 1e-05), (3, -0.0) ON CONFLICT (_id) DO UPDATE",
+		"INSERT INTO t SELECT * FROM u WHERE _id < 1000 ON CONFLICT(_id) DO UPDATE",
+		"INSERT INTO t (_id, ts, i) VALUES (1, TIMESTAMP '1960-01-01 00:00:00', INTERVAL '-1d2h')",
+		"CREATE TABLE t (ts TIMESTAMP DEFAULT TIMESTAMP '2024-01-01', s STRING DEFAULT 'a''b', n INT DEFAULT -3, b BOOL NOT NULL) INCREMENT",
+		"CREATE TABLE `table` (`key` STRING)",
+		"ALTER TABLE t ADD c", "ALTER TABLE t RENAME TO u",
+		"SHOW DATABASES", "SHOW TABLES LIKE 'a\\_%'",
+		"EXPLAIN SELECT * FROM t WHERE _id < 10", "EXPLAIN ANALYZE DELETE FROM t WHERE a = 1",
+		"SELECT -(-9223372036854775808), -(-1.5) FROM t",
+	}
+	for _, c := range generateParseCases(16) {
+		if c.valid {
+			corpus = append(corpus, c.sql)
+		}
+	}
+	gen := &sqlGenerator{rand.New(rand.NewSource(1))}
+	for i := 0; i < 3000; i++ {
+		corpus = append(corpus, gen.statement())
+	}
+	// a bound negative value lands where the SQL had no literal
+	stmt, err := Prepare("SELECT a FROM t WHERE a = -? AND b = 1 - ?")
+	assert.Equal(t, err, nil)
+	bound, err := stmt.Bind([]*protocol.FieldValue{intValue(-5), intValue(-5)})
+	assert.Equal(t, err, nil)
+	corpus = append(corpus, bound.Format())
+
+	for _, sql := range corpus {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil, sql)
+		formatted := query.Format()
+		again, err := Parse(formatted)
+		assert.Equal(t, err, nil, sql+" => "+formatted)
+		assert.T(t, sameTree(reflect.ValueOf(query), reflect.ValueOf(again)), sql+" => "+formatted)
+		assert.Equal(t, again.Format(), formatted)
+	}
+}
+
+func TestSameTree(t *testing.T) {
+	same := func(a, b string) bool {
+		left, err := Parse(a)
+		assert.Equal(t, err, nil)
+		right, err := Parse(b)
+		assert.Equal(t, err, nil)
+		return sameTree(reflect.ValueOf(left), reflect.ValueOf(right))
+	}
+	assert.T(t, same("SELECT * FROM t WHERE a <> 1", "select *  from t where a != 1"))
+	assert.T(t, !same("SELECT * FROM t WHERE a = 1", "SELECT * FROM t WHERE a = 2"))
+	assert.T(t, !same("SELECT * FROM t WHERE a = 1", "SELECT * FROM t WHERE a >= 1"))
+	assert.T(t, !same("SELECT * FROM t WHERE a = 1 OR b = 1 OR c = 1", "SELECT * FROM t WHERE a = 1 OR (b = 1 OR c = 1)"))
+	assert.T(t, !same("SELECT * FROM t WHERE a LIKE 'x%'", "SELECT * FROM t WHERE a LIKE 'y%'"))
+}
+
+var (
+	tokenType  = reflect.TypeOf(Token{})
+	regexpType = reflect.TypeOf(&regexp.Regexp{})
+)
+
+// sameTree compares two parsed queries, tokens only matter for the
+// comparison operator they spell, <> and != being the same
+func sameTree(a, b reflect.Value) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Type() == regexpType {
+			return a.Interface().(*regexp.Regexp).String() == b.Interface().(*regexp.Regexp).String()
+		}
+		if a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		return sameTree(a.Elem(), b.Elem())
+	case reflect.Struct:
+		if a.Type() == tokenType {
+			return ComparisonMap[a.Field(1).String()] == ComparisonMap[b.Field(1).String()]
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if !sameTree(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameTree(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			if !sameTree(a.MapIndex(key), b.MapIndex(key)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	}
+	return false
+}
+
+// sqlGenerator writes random statements in every spelling the lexer accepts
+type sqlGenerator struct {
+	*rand.Rand
+}
+
+func (self *sqlGenerator) pick(choices ...string) string {
+	return choices[self.Intn(len(choices))]
+}
+
+func (self *sqlGenerator) column() string {
+	return self.pick("a", "B", "name", "_id", "ts", "`order`", "`select`", "`my col`", "`x``y`", "`true`", "`2x`")
+}
+
+func (self *sqlGenerator) literal() string {
+	switch self.Intn(8) {
+	case 0:
+		return fmt.Sprint(self.Intn(100000))
+	case 1:
+		return self.pick(fmt.Sprint(self.Float64()*1000), "1.", ".25", "1e3", "2.5E-7", "0.0", "123456789012345678901234567890.5")
+	case 2:
+		return self.pick("''", "'x'", `"dq"`, "'it''s'", `'back\\slash'`, `'tab\tnew\nline'`, `'100\%'`, `'\0'`, "'héllo'")
+	case 3:
+		return self.pick("TRUE", "false", "NULL", "null")
+	case 4:
+		return self.pick("TIMESTAMP '2024-03-01T12:30:00Z'", "TIMESTAMP '2024-03-01'", "timestamp '2024-03-01 12:30:00.5+02:00'")
+	case 5:
+		return self.pick("INTERVAL '1d12h'", "INTERVAL '-90m'", "interval '1.5s'", "INTERVAL '0s'")
+	}
+	return fmt.Sprint(self.Intn(10))
+}
+
+func (self *sqlGenerator) scalar(depth int) string {
+	if depth <= 0 {
+		if self.Intn(2) == 0 {
+			return self.column()
+		}
+		return self.literal()
+	}
+	switch self.Intn(9) {
+	case 0:
+		return self.column()
+	case 1:
+		return self.literal()
+	case 2:
+		return self.pick("LOWER", "upper", "Length") + "(" + self.pick("name", "`my col`") + ")"
+	case 3:
+		return self.pick("COALESCE(", "IFNULL(") + self.scalar(depth-1) + ", " + self.scalar(depth-1) + ")"
+	case 4:
+		return self.pick("ROUND(", "abs(") + self.column() + ")"
+	case 5:
+		// a space keeps - - 1 from starting a comment
+		return "- " + self.scalar(depth-1)
+	case 6:
+		return "(" + self.scalar(depth-1) + ")"
+	}
+	return self.scalar(depth-1) + self.pick(" + ", " - ", "*", " / ") + self.scalar(depth-1)
+}
+
+func (self *sqlGenerator) condition(depth int) string {
+	if depth > 0 {
+		switch self.Intn(6) {
+		case 0:
+			return self.condition(depth-1) + self.pick(" AND ", " and ", " OR ") + self.condition(depth-1)
+		case 1:
+			return "(" + self.condition(depth-1) + ")"
+		case 2:
+			return "NOT " + self.condition(depth-1)
+		}
+	}
+	not := self.pick("", "NOT ")
+	switch self.Intn(8) {
+	case 0:
+		return self.column() + " BETWEEN " + self.scalar(1) + " AND " + self.scalar(1)
+	case 1:
+		items := []string{self.scalar(1)}
+		for self.Intn(2) == 0 {
+			items = append(items, self.scalar(1))
+		}
+		return self.scalar(1) + " " + not + "IN (" + strings.Join(items, ", ") + ")"
+	case 2:
+		return self.scalar(1) + " " + not + self.pick("LIKE", "REGEXP") + self.pick(" 'a%'", " 'it''s_'", ` '\\d+'`, " '^x$'")
+	case 3:
+		return self.scalar(1) + " IS " + not + "NULL"
+	case 4:
+		return not + "EXISTS (SELECT _id FROM u WHERE " + self.condition(depth-1) + ")"
+	case 5:
+		return self.scalar(1) + " " + not + "IN (SELECT " + self.column() + " FROM u WHERE " + self.condition(depth-1) + " LIMIT 5)"
+	}
+	return self.scalar(2) + self.pick(" = ", "!=", " <> ", " < ", "<=", " > ", ">=") + self.scalar(2)
+}
+
+func (self *sqlGenerator) selectStatement() string {
+	sql := "SELECT " + self.pick("", "DISTINCT ")
+	if self.Intn(4) == 0 {
+		sql += "*"
+	} else {
+		items := []string{self.scalar(2)}
+		for self.Intn(2) == 0 {
+			items = append(items, self.scalar(2)+self.pick("", " AS alias", " as `from`"))
+		}
+		sql += strings.Join(items, ", ")
+	}
+	sql += " FROM " + self.pick("t", "`group`")
+	if self.Intn(4) != 0 {
+		sql += " WHERE " + self.condition(3)
+	}
+	if self.Intn(2) == 0 {
+		sql += " ORDER BY " + self.column() + self.pick("", " ASC", " desc")
+	}
+	if self.Intn(2) == 0 {
+		sql += fmt.Sprintf(" LIMIT %d", self.Intn(100))
+	}
+	if self.Intn(3) == 0 {
+		sql += fmt.Sprintf(" OFFSET %d", self.Intn(100))
+	}
+	return sql
+}
+
+func (self *sqlGenerator) statement() string {
+	switch self.Intn(6) {
+	case 0:
+		return "DELETE FROM t WHERE " + self.condition(3)
+	case 1:
+		sql := "UPDATE t SET " + self.pick("a", "name", "`order`") + " = " + self.scalar(2)
+		if self.Intn(2) == 0 {
+			sql += " WHERE " + self.condition(2)
+		}
+		return sql
+	case 2:
+		values := make([]string, 1+self.Intn(3))
+		for i := range values {
+			values[i] = fmt.Sprintf("(%d, %s%s, %s)", self.Intn(100), self.pick("", "-"), self.pick("1", "2.5", "1e-3"), self.literal())
+		}
+		return self.pick("INSERT", "REPLACE") + " INTO t (_id, a, `b c`) VALUES " + strings.Join(values, ", ")
+	case 3:
+		return "INSERT INTO t SELECT * FROM u WHERE " + self.condition(2) + self.pick("", " ON CONFLICT (_id) DO UPDATE")
+	}
+	return self.selectStatement()
+}
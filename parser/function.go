@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+var (
+	AggregateFunctions = map[string]bool{
+		"COUNT": true,
+		"SUM":   true,
+		"AVG":   true,
+		"MIN":   true,
+		"MAX":   true,
+	}
+)
+
+// Function is a scalar function, computed from the values of a single row.
+// Args are the types of its arguments: NULL accepts any type and DOUBLE an INT
+// as well, which is passed as is. The last Optional arguments can be left
+// out, and with Variadic the last argument can be repeated. Return is the
+// type of the result, NULL when it depends on the arguments.
+type Function struct {
+	Args     []protocol.FieldType
+	Optional int
+	Variadic bool
+	Return   protocol.FieldType
+	// Call is only given the arguments in the declared types. Unless
+	// CallOnNull is set it isn't called when an argument is NULL, the
+	// result is NULL then.
+	Call       func(args []LiteralNode) (LiteralNode, error)
+	CallOnNull bool
+	// Check validates the arguments further once the query is parsed, it is optional
+	Check func(args []*Scalar) error
+	// PerStatement functions, like NOW(), have one value for the whole
+	// statement: Fold calls them once before it runs
+	PerStatement bool
+}
+
+var scalarFunctions = make(map[string]*Function)
+
+// RegisterFunction makes a Go function callable from SQL under name, which
+// is case insensitive. It is meant to be called from init and panics when
+// the name is taken.
+func RegisterFunction(name string, function *Function) {
+	name = strings.ToUpper(name)
+	if function == nil || function.Call == nil {
+		panic("parser: RegisterFunction of " + name + " without Call")
+	}
+	if _, ok := scalarFunctions[name]; ok || AggregateFunctions[name] {
+		panic("parser: RegisterFunction called twice for " + name)
+	}
+	if function.Optional > len(function.Args) || function.Variadic && len(function.Args) == 0 {
+		panic("parser: RegisterFunction of " + name + " with invalid Args")
+	}
+	scalarFunctions[name] = function
+}
+
+func (self *Function) argType(i int) protocol.FieldType {
+	if i >= len(self.Args) {
+		return self.Args[len(self.Args)-1]
+	}
+	return self.Args[i]
+}
+
+// accepts tells whether argument i can have the type, NULL is any type
+func (self *Function) accepts(i int, argType protocol.FieldType) bool {
+	expected := self.argType(i)
+	return expected == protocol.NULL || argType == protocol.NULL || argType == expected ||
+		expected == protocol.DOUBLE && argType == protocol.INT
+}
+
+// validate checks the number of arguments and the types of those known
+// before the query runs, the type of a column is only known per row
+func (self *Function) validate(call *FunctionCall) error {
+	if call.IsStar {
+		return fmt.Errorf("syntax error: %s(*) not supported", call.Name)
+	}
+	args := call.GetArgs()
+	min, max := len(self.Args)-self.Optional, len(self.Args)
+	if len(args) < min || !self.Variadic && len(args) > max {
+		expected := fmt.Sprint(min)
+		if self.Variadic {
+			expected = fmt.Sprintf("at least %d", min)
+		} else if min != max {
+			expected = fmt.Sprintf("%d to %d", min, max)
+		}
+		return fmt.Errorf("syntax error: %s expects %s arguments, got %d", call.Name, expected, len(args))
+	}
+	for i, arg := range args {
+		if err := arg.Validate(); err != nil {
+			return err
+		}
+		if argType := arg.staticType(); !self.accepts(i, argType) {
+			return fmt.Errorf("syntax error: %s expects %v as argument %d, got %v %s",
+				call.Name, self.argType(i), i+1, argType, arg)
+		}
+	}
+	if self.Check != nil {
+		return self.Check(args)
+	}
+	return nil
+}
+
+type FunctionCall struct {
+	Name   string
+	IsStar bool
+	*ScalarList
+	// Value is the result of a PerStatement function once folded
+	Value LiteralNode
+}
+
+func NewFunctionCall(name string, args *ScalarList, isStar bool) *FunctionCall {
+	return &FunctionCall{
+		Name:       strings.ToUpper(name),
+		IsStar:     isStar,
+		ScalarList: args,
+	}
+}
+
+func (self *FunctionCall) IsAggregate() bool {
+	return AggregateFunctions[self.Name]
+}
+
+func (self *FunctionCall) GetArgs() []*Scalar {
+	if self.ScalarList == nil {
+		return nil
+	}
+	return self.ScalarList.ScalarList
+}
+
+func (self *FunctionCall) Validate() error {
+	if function, ok := scalarFunctions[self.Name]; ok {
+		return function.validate(self)
+	}
+	if !self.IsAggregate() {
+		return fmt.Errorf("syntax error: function %s not supported", self.Name)
+	}
+	if self.IsStar {
+		if self.Name != "COUNT" {
+			return fmt.Errorf("syntax error: %s(*) not supported", self.Name)
+		}
+		return nil
+	}
+	if len(self.GetArgs()) != 1 {
+		return fmt.Errorf("syntax error: %s expects 1 argument, got %d", self.Name, len(self.GetArgs()))
+	}
+	for _, arg := range self.GetArgs() {
+		if arg.HasAggregate() {
+			return fmt.Errorf("syntax error: aggregate function calls can't be nested in %s", self.Name)
+		}
+		if err := arg.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call computes a scalar function from its evaluated arguments, whose types
+// are checked first since column values can have any type
+func (self *FunctionCall) Call(args []LiteralNode) (LiteralNode, error) {
+	if self.Value != nil {
+		return self.Value, nil
+	}
+	function, ok := scalarFunctions[self.Name]
+	if !ok {
+		return nil, fmt.Errorf("function %s not supported", self.Name)
+	}
+	for i, arg := range args {
+		if IsNull(arg) {
+			if !function.CallOnNull {
+				return NewLiteral(protocol.NULL, ""), nil
+			}
+			continue
+		}
+		if !function.accepts(i, arg.GetType()) {
+			return nil, fmt.Errorf("%s expects %v as argument %d, got %v %v",
+				self.Name, function.argType(i), i+1, arg.GetType(), arg.GetVal().GetValue())
+		}
+	}
+	return function.Call(args)
+}
+
+// String returns the canonical name of the call, e.g. COUNT(*) or SUM(amount),
+// which is also the name of its column in aggregated records
+func (self *FunctionCall) String() string {
+	buf := bytes.NewBufferString(self.Name)
+	buf.WriteString("(")
+	if self.IsStar {
+		buf.WriteString("*")
+	}
+	for i, arg := range self.GetArgs() {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(arg.String())
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestScalarFunctions(t *testing.T) {
+	for sql, expected := range map[string]interface{}{
+		"LOWER('Li Lei')":                        "li lei",
+		"upper('héllo')":                         "HÉLLO",
+		"LENGTH('héllo')":                        int64(5),
+		"SUBSTR('database', 5)":                  "base",
+		"SUBSTR('database', 1, 4)":               "data",
+		"SUBSTR('database', 0, 2)":               "da",
+		"SUBSTR('database', 20)":                 "",
+		"SUBSTR('abc', 2, 9223372036854775807)":  "bc",
+		"SUBSTR('abc', -9223372036854775808, 2)": "ab",
+		"SUBSTR('abc', 9223372036854775807, 1)":  "",
+		"SUBSTR('abc', 2, -1)":                   "",
+		"ABS(-3)":                                int64(3),
+		"ABS(-2.5)":                              2.5,
+		"ABS(-9223372036854775807)":              int64(9223372036854775807),
+		"ROUND(2.5)":                             3.0,
+		"ROUND(-2.5)":                            -3.0,
+		"ROUND(3.14159, 2)":                      3.14,
+		"ROUND(7)":                               int64(7),
+		"ROUND(1234.5, -2)":                      1200.0,
+		"ROUND(1.25, 400)":                       1.25,
+		"ROUND(1.5e300, 10)":                     1.5e300,
+		"ROUND(123.4, -400)":                     0.0,
+		"ROUND(-0.5, -9223372036854775808)":      0.0,
+		"COALESCE(NULL, NULL, 'x', 'y')":         "x",
+		"IFNULL(NULL, 0)":                        int64(0),
+		"IFNULL(1, 0)":                           int64(1),
+		"LENGTH(LOWER('AB') + NULL)":             nil,
+		"UPPER(NULL)":                            nil,
+	} {
+		val := selectValue(t, "SELECT "+sql+" FROM t")
+		assert.Equal(t, val.GetVal().GetValue(), expected, sql)
+	}
+}
+
+func TestFunctionValidation(t *testing.T) {
+	for sql, message := range map[string]string{
+		"SELECT a FROM t WHERE LOWER(name) = 'li'":        "",
+		"SELECT a FROM t WHERE LOWER(1) = 'li'":           "LOWER expects STRING as argument 1, got INT",
+		"SELECT a FROM t WHERE LOWR(name) = 'li'":         "function LOWR not supported",
+		"SELECT LENGTH(name, 2) FROM t":                   "LENGTH expects 1 arguments, got 2",
+		"SELECT SUBSTR(name) FROM t":                      "SUBSTR expects 2 to 3 arguments, got 1",
+		"SELECT SUBSTR(name, '1') FROM t":                 "SUBSTR expects INT as argument 2, got STRING",
+		"SELECT COALESCE() FROM t":                        "COALESCE expects at least 1 arguments, got 0",
+		"SELECT ABS(LENGTH(name)), ROUND(a + 1.5) FROM t": "",
+		"SELECT ABS(LOWER(name)) FROM t":                  "ABS expects DOUBLE as argument 1, got STRING",
+		"SELECT ROUND(AVG(a), 1) FROM t":                  "",
+		"SELECT DATE_TRUNC('hour', _id) FROM t":           "DATE_TRUNC expects TIMESTAMP as argument 2, got INT",
+	} {
+		_, err := Parse(sql)
+		if message == "" {
+			assert.Equal(t, err, nil, sql)
+		} else {
+			assert.NotEqual(t, err, nil, sql)
+			assert.T(t, strings.Contains(err.Error(), message), err.Error())
+		}
+	}
+
+	// a column can hold any type, so its values are only checked when called
+	query, err := Parse("SELECT LOWER(name) FROM t")
+	assert.Equal(t, err, nil)
+	function := query.Statement.(*SelectQuery).ScalarList.ScalarList[0].Val.(*FunctionCall)
+	_, err = function.Call([]LiteralNode{newIntNode(1)})
+	assert.NotEqual(t, err, nil)
+}
+
+func TestFunctionOverflow(t *testing.T) {
+	// the opposite of the smallest INT is past the largest one
+	query, err := Parse("SELECT ABS(-9223372036854775808) FROM t")
+	assert.Equal(t, err, nil)
+	function := query.Statement.(*SelectQuery).ScalarList.ScalarList[0].Val.(*FunctionCall)
+	_, err = function.Call([]LiteralNode{evalScalar(t, function.GetArgs()[0])})
+	assert.Equal(t, err, ErrIntegerOverflow)
+}
+
+func TestRegisterFunction(t *testing.T) {
+	defer delete(scalarFunctions, "REVERSE")
+	RegisterFunction("reverse", &Function{
+		Args:   []protocol.FieldType{protocol.STRING},
+		Return: protocol.STRING,
+		Call: func(args []LiteralNode) (LiteralNode, error) {
+			runes := []rune(args[0].GetVal().GetStrVal())
+			for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+				runes[i], runes[j] = runes[j], runes[i]
+			}
+			val := string(runes)
+			return NewFieldLiteral(&protocol.FieldValue{StrVal: &val}), nil
+		},
+	})
+	assert.Equal(t, selectValue(t, "SELECT UPPER(Reverse('abc')) FROM t").GetVal().GetStrVal(), "CBA")
+	_, err := Parse("SELECT a FROM t WHERE REVERSE(1.5) = 'x'")
+	assert.NotEqual(t, err, nil)
+
+	for _, name := range []string{"REVERSE", "lower", "sum"} {
+		func() {
+			defer func() {
+				assert.NotEqual(t, recover(), nil)
+			}()
+			RegisterFunction(name, &Function{Call: coalesce})
+		}()
+	}
+}
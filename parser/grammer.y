@@ -4,11 +4,8 @@ package parser
 
 import (
     "github.com/senarukana/fundb/protocol"
-    "strconv"
 )
 
-var ParsedQuery *Query
-
 type Token struct {
     Pos    int
     Src    string
@@ -25,9 +22,20 @@ func (t Token) String() string {
     ident       string
     literal     LiteralNode
     create_table *CreateTableQuery
+    drop_table  *DropTableQuery
+    truncate_table *TruncateTableQuery
+    alter_table *AlterTableQuery
+    show_statement *ShowQuery
+    explain_statement *ExplainQuery
+    pattern     *PatternExpression
+    column_def  *ColumnDef
+    column_defs []*ColumnDef
     insert_sql  *InsertQuery
     select_statement *SelectQuery
     delete_statement *DeleteQuery
+    update_statement *UpdateQuery
+    assignment_list *AssignmentList
+    assignment  *Assignment
     selection   *SelectExpression
     column_list *ColumnFields
     value_list  *ValueList
@@ -39,6 +47,7 @@ func (t Token) String() string {
     ordering_spec *OrderBy
     scalar      *Scalar
     scalar_list *ScalarList
+    function    *FunctionCall
     int_exp     int
     bool_exp    bool 
     table_id_type TableIdType
@@ -48,41 +57,61 @@ func (t Token) String() string {
 %left OR
 %left AND
 %left NOT
-%left EQUAL GREATER GREATEREQ SMALLER SMALLEREQ /* = <> < > <= >= */
+%left EQUAL NOTEQUAL GREATER GREATEREQ SMALLER SMALLEREQ /* = <> < > <= >= */
 %left PLUS MINUS
 %left STAR DIV
 %nonassoc UMINUS
 
 %token <tok> LP RP DOT COMMA STAR NULLX 
-%token <tok> PLUS MINUS DIV OR AND
+%token <tok> PLUS MINUS DIV OR AND NOT
 %token <tok> CREATE TABLE TYPE INCREMENT RANDOM
+%token <tok> DROP TRUNCATE ALTER ADD COLUMN RENAME TO
+%token <tok> SHOW DATABASES TABLES DESCRIBE STATUS
+%token <tok> EXPLAIN ANALYZE DEFAULT TIMESTAMP INTERVAL
 %token <tok> SELECT UPDATE DELETE INSERT
-%token <tok> INTO VALUES WHERE FROM BETWEEN
-%token <tok> ORDER BY DISTINCT ASC DESC LIMIT
-%token <tok> IDENT STRING DOUBLE INT BOOL
-%token <tok> EQUAL GREATER GREATEREQ SMALLER SMALLEREQ
+%token <tok> INTO VALUES WHERE FROM BETWEEN SET IN EXISTS LIKE REGEXP IS
+%token <tok> ORDER BY DISTINCT AS ASC DESC LIMIT OFFSET GROUP HAVING
+%token <tok> JOIN INNER ON
+%token <tok> REPLACE CONFLICT DO
+%token <tok> IDENT STRING DOUBLE INT BOOL PARAM
+%token <tok> EQUAL NOTEQUAL GREATER GREATEREQ SMALLER SMALLEREQ
 
 %type <sql> sql manipulative_statement schema_statement
 %type <create_table> create_table_statement
+%type <column_def> column_def
+%type <column_defs> opt_column_def_list column_def_commalist
+%type <drop_table> drop_table_statement
+%type <truncate_table> truncate_table_statement
+%type <alter_table> alter_table_statement
+%type <show_statement> show_statement
+%type <explain_statement> explain_statement
+%type <pattern> opt_like_pattern
 %type <insert_sql> insert_statement
 %type <select_statement> select_statement
 %type <delete_statement> delete_statement
-%type <ident> table column
+%type <update_statement> update_statement
+%type <assignment_list> assignment_commalist
+%type <assignment> assignment
+%type <ident> table column column_ref opt_on_conflict
 %type <literal> insert_atom literal
-%type <column_list> opt_column_commalist column_commalist
+%type <column_list> opt_column_commalist column_commalist column_ref_commalist
 %type <value_list> values_list
 %type <value_items> value_items insert_atom_commalist
 %type <column_list> opt_column_commalist column_commalist
 %type <selection> selection
-%type <scalar_list> scalar_exp_commalist
-%type <scalar> scalar_exp
+%type <scalar_list> scalar_exp_commalist select_item_commalist
+%type <scalar> scalar_exp select_item
+%type <function> function_ref
 %type <table_exp> table_exp
 %type <from_exp> from_exp table_ref_commalist
-%type <where_exp> opt_where_exp where_exp search_condition predicate comparison_predicate between_predicate
+%type <where_exp> opt_where_exp where_exp search_condition predicate comparison_predicate between_predicate in_predicate like_predicate null_predicate existence_test
+%type <where_exp> opt_having_exp
+%type <column_list> opt_group_by_exp
 %type <order_by_exp> opt_order_by_exp ordering_spec_commalist
+%type <tok> comparison_op ident
 %type <ordering_spec> ordering_spec
-%type <int_exp> opt_asc_desc opt_limit_exp
-%type <bool_exp> opt_distinct
+%type <int_exp> opt_asc_desc opt_limit_exp opt_offset_exp
+%type <bool_exp> opt_distinct opt_analyze
 %type <table_id_type> opt_id_type
 
 
@@ -92,15 +121,144 @@ func (t Token) String() string {
 sql: 
         schema_statement 
     |   manipulative_statement
+    |   show_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_SHOW, $1}
+        }
+    |   explain_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_EXPLAIN, $1}
+        }
+
+explain_statement:
+        EXPLAIN opt_analyze select_statement {
+            $$ = &ExplainQuery{$2, &Query{QUERY_SELECT, $3}}
+        }
+    |   EXPLAIN opt_analyze delete_statement {
+            $$ = &ExplainQuery{$2, &Query{QUERY_DELETE, $3}}
+        }
+
+opt_analyze:
+        /* empty */ {
+            $$ = false
+        }
+    |   ANALYZE {
+            $$ = true
+        }
+
+show_statement:
+        SHOW DATABASES opt_like_pattern {
+            $$ = &ShowQuery{Type: SHOW_DATABASES, Like: $3}
+        }
+    |   SHOW TABLES opt_like_pattern {
+            $$ = &ShowQuery{Type: SHOW_TABLES, Like: $3}
+        }
+    |   SHOW TABLE STATUS opt_like_pattern {
+            $$ = &ShowQuery{Type: SHOW_TABLE_STATUS, Like: $4}
+        }
+    |   DESCRIBE ident {
+            $$ = &ShowQuery{Type: SHOW_COLUMNS, Table: $2.Src}
+        }
+    |   DESC ident {
+            $$ = &ShowQuery{Type: SHOW_COLUMNS, Table: $2.Src}
+        }
+
+opt_like_pattern:
+        /* empty */ {
+            $$ = nil
+        }
+    |   LIKE STRING {
+            $$ = newPatternExpression(NewLiteral(protocol.STRING, $2.Src), true)
+        }
 
 schema_statement:
         create_table_statement {
-            ParsedQuery = &Query { QUERY_SCHEMA_TABLE_CREATE, $1}
+            FunDBlex.(*Lex).query = &Query{QUERY_SCHEMA_TABLE_CREATE, $1}
+        }
+    |   drop_table_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_SCHEMA_TABLE_DROP, $1}
+        }
+    |   truncate_table_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_SCHEMA_TABLE_TRUNCATE, $1}
+        }
+    |   alter_table_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_SCHEMA_TABLE_ALTER, $1}
         }
 
 create_table_statement:
-        CREATE TABLE IDENT opt_id_type {
-            $$ = &CreateTableQuery{$3.Src, $4}
+        CREATE TABLE ident opt_column_def_list opt_id_type {
+            $$ = &CreateTableQuery{$3.Src, $5, $4}
+        }
+
+opt_column_def_list:
+        /* empty */ {
+            $$ = nil
+        }
+    |   LP column_def_commalist RP {
+            $$ = $2
+        }
+
+column_def_commalist:
+        column_def {
+            $$ = []*ColumnDef{$1}
+        }
+    |   column_def_commalist COMMA column_def {
+            $$ = append($1, $3)
+        }
+
+column_def:
+        ident IDENT {
+            $$ = NewColumnDef($1.Src, $2.Src)
+        }
+    |   ident TIMESTAMP {
+            $$ = NewColumnDef($1.Src, $2.Src)
+        }
+    |   column_def NOT NULLX {
+            $1.NotNull = true
+            $$ = $1
+        }
+    |   column_def DEFAULT literal {
+            $1.setDefault($3)
+            $$ = $1
+        }
+    |   column_def DEFAULT MINUS literal {
+            if FunDBlex.(*Lex).negated($4) {
+                $1.setDefault($4)
+            } else {
+                $1.setNegativeDefault($4)
+            }
+            $$ = $1
+        }
+
+drop_table_statement:
+        DROP TABLE ident {
+            $$ = &DropTableQuery{$3.Src}
+        }
+
+truncate_table_statement:
+        TRUNCATE ident {
+            $$ = &TruncateTableQuery{$2.Src}
+        }
+    |   TRUNCATE TABLE ident {
+            $$ = &TruncateTableQuery{$3.Src}
+        }
+
+alter_table_statement:
+        ALTER TABLE ident ADD ident {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_ADD_COLUMN, Column: $5.Src}
+        }
+    |   ALTER TABLE ident ADD COLUMN ident {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_ADD_COLUMN, Column: $6.Src}
+        }
+    |   ALTER TABLE ident ADD COLUMN column_def {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_ADD_COLUMN, Column: $6.Name, Definition: $6}
+        }
+    |   ALTER TABLE ident DROP ident {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_DROP_COLUMN, Column: $5.Src}
+        }
+    |   ALTER TABLE ident DROP COLUMN ident {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_DROP_COLUMN, Column: $6.Src}
+        }
+    |   ALTER TABLE ident RENAME TO ident {
+            $$ = &AlterTableQuery{Name: $3.Src, Type: ALTER_RENAME, NewName: $6.Src}
         }
 
 opt_id_type:
@@ -117,13 +275,16 @@ opt_id_type:
 
 manipulative_statement:
         insert_statement {
-            ParsedQuery = &Query{ QUERY_INSERT, $1}
+            FunDBlex.(*Lex).query = &Query{QUERY_INSERT, $1}
         }
     |   delete_statement {
-            ParsedQuery = &Query{ QUERY_DELETE, $1}
+            FunDBlex.(*Lex).query = &Query{QUERY_DELETE, $1}
         }
     |   select_statement {
-            ParsedQuery = &Query{ QUERY_SELECT, $1}
+            FunDBlex.(*Lex).query = &Query{QUERY_SELECT, $1}
+        }
+    |   update_statement {
+            FunDBlex.(*Lex).query = &Query{QUERY_UPDATE, $1}
         }
 
 delete_statement:
@@ -131,9 +292,27 @@ delete_statement:
             $$ = &DeleteQuery{$2}
         }
 
+update_statement:
+        UPDATE table SET assignment_commalist opt_where_exp {
+            $$ = &UpdateQuery{&TableExpression{&FromExpression{Table: $2}, $5}, $4}
+        }
+
+assignment_commalist:
+        assignment {
+            $$ = NewAssignmentList($1)
+        }
+    |   assignment_commalist COMMA assignment {
+            $$ = AssignmentListAppend($1, $3)
+        }
+
+assignment:
+        column EQUAL scalar_exp {
+            $$ = &Assignment{$1, $3}
+        }
+
 select_statement:
-        SELECT opt_distinct selection table_exp opt_order_by_exp opt_limit_exp{
-            $$ = &SelectQuery{$2, $3, $4, $5, $6}
+        SELECT opt_distinct selection table_exp opt_group_by_exp opt_having_exp opt_order_by_exp opt_limit_exp opt_offset_exp {
+            $$ = &SelectQuery{$2, $3, $4, $5, $6, $7, $8, $9}
         }
     ;
 
@@ -150,10 +329,27 @@ selection:
         STAR {
             $$ = &SelectExpression{true, nil}
         }
-    |   scalar_exp_commalist {
+    |   select_item_commalist {
             $$ = &SelectExpression{false , $1}
         }
 
+select_item_commalist:
+        select_item {
+            $$ = NewScalarList($1)
+        }
+    |   select_item_commalist COMMA select_item {
+            $$ = ScalarListAppend($1, $3)
+        }
+
+select_item:
+        scalar_exp {
+            $$ = $1
+        }
+    |   scalar_exp AS ident {
+            $1.Alias = $3.Src
+            $$ = $1
+        }
+
 scalar_exp_commalist:
         scalar_exp {
             $$ = NewScalarList($1)
@@ -163,12 +359,44 @@ scalar_exp_commalist:
         }
 
 scalar_exp:
-        column {
-            $$ = &Scalar{SCALAR_IDENT, $1}
+        column_ref {
+            $$ = &Scalar{Type: SCALAR_IDENT, Val: $1}
         }
     |   literal {
-            $$ = &Scalar{SCLAR_LITERAL, $1}
+            $$ = &Scalar{Type: SCLAR_LITERAL, Val: $1}
         } 
+    |   function_ref {
+            $$ = &Scalar{Type: SCALAR_FUNCTION, Val: $1}
+        }
+    |   scalar_exp PLUS scalar_exp {
+            $$ = NewArithmeticScalar(PLUS, $1, $3)
+        }
+    |   scalar_exp MINUS scalar_exp {
+            $$ = NewArithmeticScalar(MINUS, $1, $3)
+        }
+    |   scalar_exp STAR scalar_exp {
+            $$ = NewArithmeticScalar(STAR, $1, $3)
+        }
+    |   scalar_exp DIV scalar_exp {
+            $$ = NewArithmeticScalar(DIV, $1, $3)
+        }
+    |   MINUS scalar_exp %prec UMINUS {
+            $$ = FunDBlex.(*Lex).negate($2)
+        }
+    |   LP scalar_exp RP {
+            $$ = $2
+        }
+
+function_ref:
+        IDENT LP STAR RP {
+            $$ = NewFunctionCall($1.Src, nil, true)
+        }
+    |   IDENT LP RP {
+            $$ = NewFunctionCall($1.Src, nil, false)
+        }
+    |   IDENT LP scalar_exp_commalist RP {
+            $$ = NewFunctionCall($1.Src, $3, false)
+        }
 
 table_exp: 
         from_exp opt_where_exp {
@@ -182,8 +410,15 @@ from_exp:
 
 table_ref_commalist:
         table {
-            $$ = &FromExpression{$1}
+            $$ = &FromExpression{Table: $1}
         }
+    |   table opt_inner JOIN table ON column_ref EQUAL column_ref {
+            $$ = NewJoinExpression($3, $1, $4, $6, $8)
+        }
+
+opt_inner:
+        /* empty */
+    |   INNER
 
 opt_where_exp:
         /* empty */ {
@@ -200,38 +435,101 @@ search_condition:
         LP search_condition RP {
             $$ = $2
         }
+    |   search_condition OR search_condition {
+            $$ = &WhereExpression{$1, $3, WHERE_OR, $2}
+        }
     |   search_condition AND search_condition {
             $$ = &WhereExpression{$1, $3, WHERE_AND, $2}
         }
+    |   NOT search_condition {
+            $$ = &WhereExpression{$2, nil, WHERE_NOT, $1}
+        }
     |   predicate
 
 predicate:
         comparison_predicate 
     |   between_predicate
+    |   in_predicate
+    |   like_predicate
+    |   null_predicate
+    |   existence_test
 
 comparison_predicate:
-        IDENT EQUAL scalar_exp {
-            $$ = &WhereExpression{$1.Src, $3, WHERE_COMPARISON, $2}
+        scalar_exp comparison_op scalar_exp {
+            $$ = NewComparisonExpression($2, $1, $3)
         }
-    |   IDENT SMALLER scalar_exp {
-            $$ = &WhereExpression{$1.Src, $3, WHERE_COMPARISON, $2}
+
+comparison_op:
+        EQUAL
+    |   NOTEQUAL
+    |   SMALLER
+    |   GREATER
+    |   SMALLEREQ
+    |   GREATEREQ
+
+in_predicate:
+        scalar_exp IN LP scalar_exp_commalist RP {
+            $$ = NewInExpression($2, $1, $4)
+        }
+    |   scalar_exp NOT IN LP scalar_exp_commalist RP {
+            $$ = &WhereExpression{NewInExpression($3, $1, $5), nil, WHERE_NOT, $2}
+        }
+    |   scalar_exp IN LP select_statement RP {
+            $$ = NewInSubqueryExpression($2, $1, $4)
+        }
+    |   scalar_exp NOT IN LP select_statement RP {
+            $$ = &WhereExpression{NewInSubqueryExpression($3, $1, $5), nil, WHERE_NOT, $2}
+        }
+
+existence_test:
+        EXISTS LP select_statement RP {
+            $$ = &WhereExpression{nil, &Subquery{Query: $3}, WHERE_EXISTS, $1}
+        }
+
+like_predicate:
+        scalar_exp LIKE literal {
+            $$ = NewPatternExpression(WHERE_LIKE, $2, $1, $3)
         }
-    |   IDENT GREATER scalar_exp {
-            $$ = &WhereExpression{$1.Src, $3, WHERE_COMPARISON, $2}
+    |   scalar_exp NOT LIKE literal {
+            $$ = &WhereExpression{NewPatternExpression(WHERE_LIKE, $3, $1, $4), nil, WHERE_NOT, $2}
         }
-    |   IDENT SMALLEREQ scalar_exp {
-            $$ = &WhereExpression{$1.Src, $3, WHERE_COMPARISON, $2}
+    |   scalar_exp REGEXP literal {
+            $$ = NewPatternExpression(WHERE_REGEXP, $2, $1, $3)
         }
-    |   IDENT GREATEREQ scalar_exp {
-            $$ = &WhereExpression{$1.Src, $3, WHERE_COMPARISON, $2}
+    |   scalar_exp NOT REGEXP literal {
+            $$ = &WhereExpression{NewPatternExpression(WHERE_REGEXP, $3, $1, $4), nil, WHERE_NOT, $2}
+        }
+
+null_predicate:
+        scalar_exp IS NULLX {
+            $$ = NewNullExpression($2, $1)
+        }
+    |   scalar_exp IS NOT NULLX {
+            $$ = &WhereExpression{NewNullExpression($2, $1), nil, WHERE_NOT, $3}
         }
 
 between_predicate:
-        IDENT BETWEEN scalar_exp AND scalar_exp {
-            $$ = NewBetweenExpression($2, $1.Src, $3, $5)
+        column_ref BETWEEN scalar_exp AND scalar_exp {
+            $$ = NewBetweenExpression($2, $1, $3, $5)
         }
     ;
 
+opt_group_by_exp:
+        /* empty */ {
+            $$ = nil
+        }
+    |   GROUP BY column_ref_commalist {
+            $$ = $3
+        }
+
+opt_having_exp:
+        /* empty */ {
+            $$ = nil
+        }
+    |   HAVING search_condition {
+            $$ = $2
+        }
+
 opt_order_by_exp:
         /* empty */ {
             $$ = nil
@@ -249,32 +547,58 @@ ordering_spec_commalist:
         }
 
 ordering_spec:
-       column opt_asc_desc {
+       column_ref opt_asc_desc {
             $$ = &OrderBy{$1, $2}
        }
 
 opt_asc_desc:
         /* empty */ {
-            $$ = 0
+            $$ = ORDER_NONE
         }
     |   ASC {
-            $$ = 1
+            $$ = ORDER_ASC
         }
     |   DESC {
-            $$ = 2
+            $$ = ORDER_DESC
         }
 opt_limit_exp:
         /* empty */ {
             $$ = -1
         }
     |   LIMIT INT {
-            val, _ := strconv.ParseInt($2.Src, 10, 64)
-            $$ = int(val)
+            $$ = FunDBlex.(*Lex).newCount($2)
+    }
+
+opt_offset_exp:
+        /* empty */ {
+            $$ = 0
+        }
+    |   OFFSET INT {
+            $$ = FunDBlex.(*Lex).newCount($2)
     }
 
 insert_statement:
-        INSERT INTO table opt_column_commalist VALUES values_list {
-            $$ = &InsertQuery{$3, $4, $6}
+        INSERT INTO table opt_column_commalist VALUES values_list opt_on_conflict {
+            $$ = NewInsertQuery($3, $4, $6, nil, $7)
+        }
+    |   INSERT INTO table opt_column_commalist select_statement opt_on_conflict {
+            $$ = NewInsertQuery($3, $4, nil, $5, $6)
+        }
+    |   REPLACE INTO table opt_column_commalist VALUES values_list {
+            $$ = NewInsertQuery($3, $4, $6, nil, "")
+            $$.OnConflict = CONFLICT_REPLACE
+        }
+    |   REPLACE INTO table opt_column_commalist select_statement {
+            $$ = NewInsertQuery($3, $4, nil, $5, "")
+            $$.OnConflict = CONFLICT_REPLACE
+        }
+
+opt_on_conflict:
+        /* empty */ {
+            $$ = ""
+        }
+    |   ON CONFLICT LP column RP DO UPDATE {
+            $$ = $4
         }
 
 opt_column_commalist:
@@ -318,32 +642,76 @@ insert_atom:
         literal {
             $$ = $1
         }
-    |   NULLX {
-            $$ = NewLiteral(protocol.NULL, "")
+    |   MINUS INT {
+            $$ = FunDBlex.(*Lex).newNumber(protocol.INT, $2, true)
+        }
+    |   MINUS DOUBLE {
+            $$ = FunDBlex.(*Lex).newNumber(protocol.DOUBLE, $2, true)
         }
 
 column:     
-        IDENT {
+        ident {
             $$ = $1.Src
         }
 
+column_ref:
+        column
+    |   ident DOT ident {
+            $$ = $1.Src + "." + $3.Src
+        }
+
+column_ref_commalist:
+        column_ref {
+            $$ = NewColumnField($1)
+        }
+    |   column_ref_commalist COMMA column_ref {
+            $$ = ColumnFieldsAppend($1, $3)
+        }
+
 table:
-        IDENT {
+        ident {
             $$ = $1.Src
         }
 
+/* the keywords only needed by a few statements aren't reserved, they are
+   names wherever a name is allowed */
+ident:
+        IDENT
+    |   ADD
+    |   COLUMN
+    |   RENAME
+    |   TO
+    |   DATABASES
+    |   TABLES
+    |   STATUS
+    |   DEFAULT
+    |   TIMESTAMP
+    |   INTERVAL
+
 literal:
         STRING {
             $$ = NewLiteral(protocol.STRING, $1.Src)
         }
     |   INT {
-            $$ = NewLiteral(protocol.INT, $1.Src)
+            $$ = FunDBlex.(*Lex).newNumber(protocol.INT, $1, false)
         }
     |   DOUBLE {
-            $$ = NewLiteral(protocol.DOUBLE, $1.Src)
+            $$ = FunDBlex.(*Lex).newNumber(protocol.DOUBLE, $1, false)
         }
     |   BOOL {
             $$ = NewLiteral(protocol.BOOL, $1.Src)
         }
+    |   NULLX {
+            $$ = NewLiteral(protocol.NULL, "")
+        }
+    |   PARAM {
+            $$ = FunDBlex.(*Lex).newParam($1)
+        }
+    |   TIMESTAMP STRING {
+            $$ = FunDBlex.(*Lex).newTimestamp($2)
+        }
+    |   INTERVAL STRING {
+            $$ = FunDBlex.(*Lex).newInterval($2)
+        }
 
 %%
\ No newline at end of file
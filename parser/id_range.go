@@ -0,0 +1,84 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IdRange is an inclusive range of _id values the engine has to scan
+type IdRange struct {
+	Start int64
+	End   int64
+}
+
+func (self *IdRange) String() string {
+	return fmt.Sprintf("[%d, %d]", self.Start, self.End)
+}
+
+type idRanges []*IdRange
+
+func (self idRanges) Len() int           { return len(self) }
+func (self idRanges) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self idRanges) Less(i, j int) bool { return self[i].Start < self[j].Start }
+
+func fullIdRanges() []*IdRange {
+	return []*IdRange{&IdRange{0, MaximumRange}}
+}
+
+// normalizeIdRanges drops empty ranges, sorts the rest and merges the ones
+// that overlap or touch
+func normalizeIdRanges(ranges []*IdRange) []*IdRange {
+	res := make([]*IdRange, 0, len(ranges))
+	for _, idRange := range ranges {
+		if idRange.Start <= idRange.End {
+			res = append(res, &IdRange{idRange.Start, idRange.End})
+		}
+	}
+	sort.Sort(idRanges(res))
+
+	merged := res[:0]
+	for _, idRange := range res {
+		if len(merged) > 0 {
+			last := merged[len(merged)-1]
+			if last.End == MaximumRange || idRange.Start <= last.End+1 {
+				if idRange.End > last.End {
+					last.End = idRange.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, idRange)
+	}
+	return merged
+}
+
+func unionIdRanges(left, right []*IdRange) []*IdRange {
+	return normalizeIdRanges(append(append([]*IdRange{}, left...), right...))
+}
+
+func intersectIdRanges(left, right []*IdRange) []*IdRange {
+	var res []*IdRange
+	for _, l := range left {
+		for _, r := range right {
+			start, end := l.Start, l.End
+			if r.Start > start {
+				start = r.Start
+			}
+			if r.End < end {
+				end = r.End
+			}
+			res = append(res, &IdRange{start, end})
+		}
+	}
+	return normalizeIdRanges(res)
+}
+
+// IdRangesOf returns the ranges holding exactly ids, in order, consecutive
+// ids share a range
+func IdRangesOf(ids []int64) []*IdRange {
+	ranges := make([]*IdRange, len(ids))
+	for i, id := range ids {
+		ranges[i] = &IdRange{id, id}
+	}
+	return normalizeIdRanges(ranges)
+}
@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func idRangeList(bounds ...int64) []*IdRange {
+	ranges := make([]*IdRange, 0, len(bounds)/2)
+	for i := 0; i+1 < len(bounds); i += 2 {
+		ranges = append(ranges, &IdRange{bounds[i], bounds[i+1]})
+	}
+	return ranges
+}
+
+func TestNormalizeIdRanges(t *testing.T) {
+	for _, c := range []struct {
+		in, out []*IdRange
+	}{
+		{idRangeList(), idRangeList()},
+		{idRangeList(5, 4), idRangeList()},
+		{idRangeList(10, 20, 1, 3), idRangeList(1, 3, 10, 20)},
+		{idRangeList(1, 5, 3, 8), idRangeList(1, 8)},
+		{idRangeList(1, 5, 6, 8), idRangeList(1, 8)},
+		{idRangeList(1, 5, 7, 8), idRangeList(1, 5, 7, 8)},
+		{idRangeList(1, 10, 2, 3), idRangeList(1, 10)},
+		// last.End+1 would overflow, a range reaching MaximumRange swallows the rest
+		{idRangeList(5, MaximumRange, MaximumRange, MaximumRange), idRangeList(5, MaximumRange)},
+		{idRangeList(MaximumRange, MaximumRange, 0, MaximumRange-1), idRangeList(0, MaximumRange)},
+	} {
+		assert.Equal(t, normalizeIdRanges(c.in), c.out)
+	}
+}
+
+func TestUnionIdRanges(t *testing.T) {
+	for _, c := range []struct {
+		left, right, out []*IdRange
+	}{
+		{idRangeList(), idRangeList(1, 2), idRangeList(1, 2)},
+		{idRangeList(1, 2), idRangeList(4, 5), idRangeList(1, 2, 4, 5)},
+		{idRangeList(1, 2), idRangeList(3, 5), idRangeList(1, 5)},
+		{idRangeList(1, 4, 8, 9), idRangeList(3, 8), idRangeList(1, 9)},
+		{idRangeList(0, MaximumRange), idRangeList(3, 8), idRangeList(0, MaximumRange)},
+	} {
+		assert.Equal(t, unionIdRanges(c.left, c.right), c.out)
+	}
+	// the inputs are left as they are
+	left := idRangeList(1, 2)
+	unionIdRanges(left, idRangeList(3, 4))
+	assert.Equal(t, left, idRangeList(1, 2))
+}
+
+func TestIntersectIdRanges(t *testing.T) {
+	for _, c := range []struct {
+		left, right, out []*IdRange
+	}{
+		{idRangeList(), idRangeList(1, 2), idRangeList()},
+		{idRangeList(1, 2), idRangeList(4, 5), idRangeList()},
+		{idRangeList(1, 5), idRangeList(3, 8), idRangeList(3, 5)},
+		{idRangeList(1, 5), idRangeList(5, 8), idRangeList(5, 5)},
+		{idRangeList(1, 3, 6, 9), idRangeList(2, 7), idRangeList(2, 3, 6, 7)},
+		{idRangeList(0, MaximumRange), idRangeList(4, 4, 9, MaximumRange), idRangeList(4, 4, 9, MaximumRange)},
+	} {
+		assert.Equal(t, intersectIdRanges(c.left, c.right), c.out)
+	}
+}
+
+func TestGetIdConditionRanges(t *testing.T) {
+	for _, c := range []struct {
+		where    string
+		ranges   []*IdRange
+		residual string
+	}{
+		{"_id = 5", idRangeList(5, 5), ""},
+		{"_id > 5", idRangeList(6, MaximumRange), ""},
+		{"_id >= 5 AND _id < 10", idRangeList(5, 9), ""},
+		{"_id > 5 AND _id < 3", idRangeList(), ""},
+		{"_id = 5 AND a = 1", idRangeList(5, 5), "a = 1"},
+		{"_id = 5 OR _id = 900", idRangeList(5, 5, 900, 900), "_id = 5 OR _id = 900"},
+		{"_id < 5 OR _id > 3", idRangeList(0, MaximumRange), "_id < 5 OR _id > 3"},
+		{"_id IN (1, 2) OR _id = 3", idRangeList(1, 3), "_id IN (1, 2) OR _id = 3"},
+		{"_id = 5 OR a = 1", idRangeList(0, MaximumRange), "_id = 5 OR a = 1"},
+		{"(_id = 1 OR _id = 7) AND _id > 3", idRangeList(7, 7), "_id = 1 OR _id = 7"},
+		{"NOT _id = 5", idRangeList(0, MaximumRange), "NOT _id = 5"},
+		{"NOT (_id > 5) AND _id < 10", idRangeList(0, 9), "NOT _id > 5"},
+		{"_id = 9223372036854775807 OR _id = 1", idRangeList(1, 1, MaximumRange, MaximumRange), "_id = 9223372036854775807 OR _id = 1"},
+		{"_id >= 9223372036854775807 OR _id BETWEEN 0 AND 9223372036854775807", idRangeList(0, MaximumRange), "_id >= 9223372036854775807 OR _id BETWEEN 0 AND 9223372036854775807"},
+		// val+1 and val-1 would wrap around, nothing is beyond the limits
+		{"_id > 9223372036854775807", idRangeList(), ""},
+		{"_id < -9223372036854775808", idRangeList(), ""},
+		{"_id BETWEEN -9223372036854775808 AND -9223372036854775808", idRangeList(), ""},
+		{"_id < -9223372036854775808 OR _id = 3", idRangeList(3, 3), "_id < -9223372036854775808 OR _id = 3"},
+		// NULL never equals an _id, the other values still match
+		{"_id IN (1, NULL)", idRangeList(1, 1), ""},
+		{"_id IN (NULL)", idRangeList(), ""},
+		{"_id IN (NULL, 4) AND a = 1", idRangeList(4, 4), "a = 1"},
+		// a comparison with NULL is never true, the whole query doesn't fail
+		{"_id = NULL", idRangeList(), ""},
+		{"_id != NULL", idRangeList(), ""},
+		{"_id BETWEEN NULL AND 5", idRangeList(), ""},
+		{"a = 1 OR _id = NULL", idRangeList(0, MaximumRange), "a = 1 OR _id = NULL"},
+		{"_id > 3 AND _id < NULL", idRangeList(), ""},
+		// a DOUBLE can't bound the range, it is compared per record
+		{"_id > 1.5", idRangeList(0, MaximumRange), "_id > 1.5"},
+		{"_id = 2.0 AND _id < 10", idRangeList(0, 9), "_id = 2.0"},
+		{"_id BETWEEN 1.5 AND 3", idRangeList(0, MaximumRange), "_id BETWEEN 1.5 AND 3"},
+		{"_id IN (1, 2.5)", idRangeList(0, MaximumRange), "_id IN (1, 2.5)"},
+		{"_id = 1.5 OR _id = 7", idRangeList(0, MaximumRange), "_id = 1.5 OR _id = 7"},
+	} {
+		query, err := Parse("SELECT a FROM t WHERE " + c.where)
+		assert.Equal(t, err, nil)
+		condition, ranges, err := GetIdCondition(query.Statement.(*SelectQuery).WhereExpression)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ranges, c.ranges, c.where)
+		if c.residual == "" {
+			assert.Equal(t, condition, (*WhereExpression)(nil), c.where)
+		} else {
+			assert.Equal(t, condition.String(), c.residual, c.where)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestInsertSelect(t *testing.T) {
+	query, err := Parse("INSERT INTO archive SELECT * FROM events WHERE _id < 1000")
+	assert.Equal(t, err, nil)
+	insert := query.Statement.(*InsertQuery)
+	assert.Equal(t, insert.Table, "archive")
+	assert.Equal(t, insert.ValueList, (*ValueList)(nil))
+	assert.Equal(t, insert.Select.Table, "events")
+	assert.Equal(t, insert.OnConflict, CONFLICT_FAIL)
+	assert.Equal(t, insert.GetSelectFields([]string{"_id", "a"}), []string{"_id", "a"})
+
+	query, err = Parse("INSERT INTO archive SELECT a._id, b.name, a.n + 1 AS m FROM a JOIN b ON a.ref = b._id")
+	assert.Equal(t, err, nil)
+	insert = query.Statement.(*InsertQuery)
+	assert.Equal(t, insert.GetSelectFields([]string{"a._id", "b.name", "m"}), []string{"_id", "name", "m"})
+
+	query, err = Parse("INSERT INTO archive (_id, x) SELECT _id, a + 1.5 FROM events")
+	assert.Equal(t, err, nil)
+	insert = query.Statement.(*InsertQuery)
+	assert.Equal(t, insert.GetSelectFields([]string{"_id", "a + 1.5"}), []string{"_id", "x"})
+
+	for sql, message := range map[string]string{
+		"INSERT INTO archive (_id, x) SELECT _id FROM events":         "Incompatible fields(2) and selected values(1)",
+		"INSERT INTO archive SELECT a FROM events":                    "needs _id among the selected columns",
+		"INSERT INTO archive SELECT _id, a, a FROM events":            "field a is inserted more than once",
+		"INSERT INTO archive SELECT _id, _timestamp FROM events":      "_timestamp is set by the database",
+		"INSERT INTO archive SELECT _id FROM events WHERE count(*)>1": "aggregate functions are not allowed",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), message), sql+": "+err.Error())
+	}
+}
+
+func TestInsertOnConflict(t *testing.T) {
+	for sql, action := range map[string]ConflictAction{
+		"INSERT INTO t (_id, a) VALUES (1, 'x')":                                  CONFLICT_FAIL,
+		"INSERT INTO t (_id, a) VALUES (1, 'x') ON CONFLICT (_id) DO UPDATE":      CONFLICT_UPDATE,
+		"REPLACE INTO t (_id, a) VALUES (1, 'x'), (2, 'y')":                       CONFLICT_REPLACE,
+		"INSERT INTO t SELECT * FROM u ON CONFLICT(_id) DO UPDATE":                CONFLICT_UPDATE,
+		"REPLACE INTO t SELECT _id, a FROM u WHERE a > 1 ORDER BY a DESC LIMIT 5": CONFLICT_REPLACE,
+	} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, query.Type, QUERY_INSERT)
+		assert.Equal(t, query.Statement.(*InsertQuery).OnConflict, action)
+	}
+
+	for sql, message := range map[string]string{
+		"INSERT INTO t (_id, a) VALUES (1, 'x') ON CONFLICT (a) DO UPDATE": "ON CONFLICT only supports _id",
+		"INSERT INTO t (a) VALUES ('x') ON CONFLICT (_id) DO UPDATE":       "ON CONFLICT(_id) DO UPDATE needs the _id",
+		"REPLACE INTO t (a) VALUES ('x')":                                  "REPLACE needs the _id",
+		"INSERT INTO t VALUES (1, 2)":                                      "needs the list of columns inserted",
+		"REPLACE INTO t VALUES (1, 2)":                                     "needs the list of columns inserted",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), message), sql+": "+err.Error())
+	}
+}
+
+func TestPrepareInsertSelect(t *testing.T) {
+	stmt, err := Prepare("INSERT INTO archive SELECT * FROM events WHERE _id < ? ON CONFLICT (_id) DO UPDATE")
+	assert.Equal(t, err, nil)
+	query, err := stmt.Bind([]*protocol.FieldValue{intValue(1000)})
+	assert.Equal(t, err, nil)
+	insert := query.Statement.(*InsertQuery)
+	assert.Equal(t, insert.OnConflict, CONFLICT_UPDATE)
+	assert.Equal(t, insert.Select.WhereExpression.String(), "_id < 1000")
+}
+
+func TestSelectAfter(t *testing.T) {
+	query, err := Parse("SELECT * FROM events WHERE _id < 1000")
+	assert.Equal(t, err, nil)
+	selectQuery := query.Statement.(*SelectQuery)
+	page := selectQuery.After(10, 100)
+	assert.Equal(t, page.Limit, 100)
+	assert.Equal(t, selectQuery.Limit, -1)
+	_, ranges, err := GetIdCondition(page.WhereExpression)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, ranges, []*IdRange{&IdRange{11, 999}})
+}
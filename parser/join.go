@@ -0,0 +1,112 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/senarukana/fundb/util"
+)
+
+// JoinExpression is INNER JOIN Table ON Left = Right. Left is a column of the
+// table joined to and Right a column of Table, both qualified like a.ref.
+type JoinExpression struct {
+	Table string
+	Left  string
+	Right string
+	Token Token
+}
+
+// NewJoinExpression builds FROM table JOIN joined ON left = right, the
+// columns are swapped when written the other way round, e.g. ON b._id = a.ref
+func NewJoinExpression(token Token, table, joined, left, right string) *FromExpression {
+	if leftTable, _ := SplitColumn(left); leftTable == joined {
+		left, right = right, left
+	}
+	return &FromExpression{table, &JoinExpression{joined, left, right, token}}
+}
+
+func (self *JoinExpression) String() string {
+	return self.Format()
+}
+
+func (self *JoinExpression) Format() string {
+	return "JOIN " + formatIdent(self.Table) + " ON " + formatColumn(self.Left) + " = " + formatColumn(self.Right)
+}
+
+// SplitColumn returns the table and the column of a qualified column like
+// a.x, the table is empty when the column isn't qualified
+func SplitColumn(name string) (string, string) {
+	if idx := strings.IndexByte(name, '.'); idx != -1 {
+		return name[:idx], name[idx+1:]
+	}
+	return "", name
+}
+
+// isQualifiedColumn tells a qualified column like a.x from an expression
+// named after its text, e.g. a.x + 1
+func isQualifiedColumn(name string) bool {
+	table, column := SplitColumn(name)
+	return isIdent(table) && isIdent(column)
+}
+
+func isIdent(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isIdentChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// QualifyColumn is the name of column in the result of a join
+func QualifyColumn(table, column string) string {
+	return table + "." + column
+}
+
+func (self *FromExpression) validate() error {
+	if self.Join == nil {
+		return nil
+	}
+	if self.Join.Table == self.Table {
+		return fmt.Errorf("syntax error: table %s can't be joined with itself", self.Table)
+	}
+	leftTable, _ := SplitColumn(self.Join.Left)
+	rightTable, _ := SplitColumn(self.Join.Right)
+	if leftTable != self.Table || rightTable != self.Join.Table {
+		return fmt.Errorf("syntax error: JOIN ON must compare a column of %s with a column of %s",
+			self.Table, self.Join.Table)
+	}
+	return nil
+}
+
+// checkColumns checks the tables columns are qualified with, every column of
+// a join names its table and no other column does
+func (self *FromExpression) checkColumns(columns []string) error {
+	for _, column := range columns {
+		table, _ := SplitColumn(column)
+		if self.Join == nil {
+			if table != "" {
+				return fmt.Errorf("syntax error: column %s is qualified, only the columns of a JOIN are", column)
+			}
+		} else if table != self.Table && table != self.Join.Table {
+			return fmt.Errorf("syntax error: column %s must be qualified with %s or %s in a JOIN",
+				column, self.Table, self.Join.Table)
+		}
+	}
+	return nil
+}
+
+// checkColumns checks every column read by the query, ORDER BY may also
+// name the alias of a selected expression
+func (self *SelectQuery) checkColumns() error {
+	if err := self.FromExpression.validate(); err != nil {
+		return err
+	}
+	columnSet := util.NewStringSet()
+	self.getSelectAndConditionFields(columnSet)
+	self.getOrderByFields(columnSet)
+	return self.FromExpression.checkColumns(columnSet.ConvertToStrings())
+}
@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseJoin(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT a.x, b.y FROM a JOIN b ON a.ref = b._id WHERE b.y > 1 AND a.x BETWEEN 1 AND 9",
+		"SELECT a.x, b.y FROM a INNER JOIN b ON b._id = a.ref WHERE b.y > 1 AND a.x BETWEEN 1 AND 9",
+	} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil)
+		selectQuery := query.Statement.(*SelectQuery)
+		assert.Equal(t, selectQuery.Table, "a")
+		assert.Equal(t, selectQuery.Join.Table, "b")
+		// the columns are in the order of the tables
+		assert.Equal(t, selectQuery.Join.Left, "a.ref")
+		assert.Equal(t, selectQuery.Join.Right, "b._id")
+		assert.Equal(t, selectQuery.Join.String(), "JOIN b ON a.ref = b._id")
+		fields := selectQuery.GetSelectAndConditionFields()
+		sort.Strings(fields)
+		assert.Equal(t, fields, []string{"a.x", "b.y"})
+	}
+
+	query, err := Parse("SELECT b.y, count(*) AS n FROM a JOIN b ON a.k = b.k GROUP BY b.y ORDER BY b.y DESC")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).GroupBy.Fields, []string{"b.y"})
+}
+
+func TestInvalidJoin(t *testing.T) {
+	for sql, message := range map[string]string{
+		"SELECT a.x FROM a JOIN a ON a.ref = a._id":             "can't be joined with itself",
+		"SELECT a.x FROM a JOIN b ON a.ref = a._id":             "must compare a column of a with a column of b",
+		"SELECT a.x FROM a JOIN b ON a.ref = c._id":             "must compare a column of a with a column of b",
+		"SELECT x FROM a JOIN b ON a.ref = b._id":               "column x must be qualified with a or b",
+		"SELECT a.x FROM a JOIN b ON a.ref = b._id WHERE c.y=1": "column c.y must be qualified with a or b",
+		"SELECT a.x FROM a":                                     "column a.x is qualified",
+		"DELETE FROM a JOIN b ON a.ref = b._id WHERE a.x = 1":   "JOIN is only supported in SELECT",
+		"DELETE FROM a WHERE a.x = 1":                           "column a.x is qualified",
+		"UPDATE a SET x = b.y WHERE x = 1":                      "column b.y is qualified",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), message), sql+": "+err.Error())
+	}
+}
@@ -1,18 +1,11 @@
 package parser
 
 import (
-	"bytes"
-	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
 )
 
 var (
-	doubleRe        = regexp.MustCompile("^[0-9]+\\.[0-9]+")
-	intRe           = regexp.MustCompile("^[0-9]+")
-	boolRe          = regexp.MustCompile("^(TRUE|FALSE|true|false)")
-	stringRe        = regexp.MustCompile("^((\"[^\"]*\")|(\\'[^\\']*\\'))")
-	identRe         = regexp.MustCompile("[a-zA-z]+")
 	KeywordTokenMap = map[string]int{
 		"SELECT":    SELECT,
 		"UPDATE":    UPDATE,
@@ -22,20 +15,69 @@ var (
 		"WHERE":     WHERE,
 		"INTO":      INTO,
 		"VALUES":    VALUES,
+		"SET":       SET,
 		"ORDER":     ORDER,
 		"BY":        BY,
+		"GROUP":     GROUP,
+		"HAVING":    HAVING,
 		"DISTINCT":  DISTINCT,
-		"AST":       ASC,
+		"AS":        AS,
+		"ASC":       ASC,
 		"DESC":      DESC,
 		"LIMIT":     LIMIT,
+		"OFFSET":    OFFSET,
 		"CREATE":    CREATE,
 		"TABLE":     TABLE,
+		"DROP":      DROP,
+		"TRUNCATE":  TRUNCATE,
+		"ALTER":     ALTER,
+		"ADD":       ADD,
+		"COLUMN":    COLUMN,
+		"RENAME":    RENAME,
+		"TO":        TO,
+		"SHOW":      SHOW,
+		"DATABASES": DATABASES,
+		"TABLES":    TABLES,
+		"DESCRIBE":  DESCRIBE,
+		"STATUS":    STATUS,
+		"EXPLAIN":   EXPLAIN,
+		"DEFAULT":   DEFAULT,
+		"TIMESTAMP": TIMESTAMP,
+		"INTERVAL":  INTERVAL,
+		"ANALYZE":   ANALYZE,
 		"TYPE":      TYPE,
 		"BETWEEN":   BETWEEN,
 		"INCREMENT": INCREMENT,
 		"RANDOM":    RANDOM,
 		"OR":        OR,
 		"AND":       AND,
+		"NOT":       NOT,
+		"IN":        IN,
+		"EXISTS":    EXISTS,
+		"JOIN":      JOIN,
+		"INNER":     INNER,
+		"ON":        ON,
+		"REPLACE":   REPLACE,
+		"CONFLICT":  CONFLICT,
+		"DO":        DO,
+		"LIKE":      LIKE,
+		"REGEXP":    REGEXP,
+		"IS":        IS,
+		"NULL":      NULLX,
+	}
+	// NonReservedKeywords are also names, as the ident rule of the grammar
+	// accepts them wherever a name is
+	NonReservedKeywords = map[int]bool{
+		ADD:       true,
+		COLUMN:    true,
+		RENAME:    true,
+		TO:        true,
+		DATABASES: true,
+		TABLES:    true,
+		STATUS:    true,
+		DEFAULT:   true,
+		TIMESTAMP: true,
+		INTERVAL:  true,
 	}
 	OPTokenMap = map[string]int{
 		"(": LP,
@@ -43,6 +85,15 @@ var (
 		",": COMMA,
 		".": DOT,
 		"*": STAR,
+		"+": PLUS,
+		"-": MINUS,
+		"/": DIV,
+	}
+	ArithmeticOpMap = map[int]string{
+		PLUS:  "+",
+		MINUS: "-",
+		STAR:  "*",
+		DIV:   "/",
 	}
 	ComparisonMap = map[string]int{
 		"=":  EQUAL,
@@ -50,14 +101,51 @@ var (
 		">=": GREATEREQ,
 		"<":  SMALLER,
 		"<=": SMALLEREQ,
+		"!=": NOTEQUAL,
+		"<>": NOTEQUAL,
 	}
 )
 
+// lexErrorToken is returned when the scanner fails, no rule accepts it
+const lexErrorToken = 1 << 30
+
+// maxKeywordLen bounds the words looked up in KeywordTokenMap
+var maxKeywordLen = func() int {
+	max := len("FALSE")
+	for keyword := range KeywordTokenMap {
+		if len(keyword) > max {
+			max = len(keyword)
+		}
+	}
+	return max
+}()
+
 type Lex struct {
 	Pos       int
 	Query     string
 	LastToken Token
 	LastError string
+	// lexError tells why the scanner stopped before the end of the query
+	lexError string
+	// literalErr is set by the first literal the grammar couldn't convert,
+	// e.g. an invalid TIMESTAMP
+	literalErr error
+	// unnegatedInts are the INT literals out of range unless negated
+	unnegatedInts []unnegatedInt
+	// placeholders seen so far, ? are numbered in order and $n carry their own number
+	positionalParams int
+	numberedParams   []int
+	// query is set by the grammar once the statement is reduced
+	query *Query
+	// tokens returned so far, the last one is where a syntax error was found
+	tokens []lexedToken
+	// replay is served instead of lexing Query when probing for expected tokens
+	replay []lexedToken
+}
+
+type lexedToken struct {
+	id  int
+	tok Token
 }
 
 func NewLex(query string) *Lex {
@@ -73,88 +161,283 @@ func (l *Lex) MkTok(src string) Token {
 }
 
 func (l *Lex) Lex(lval *FunDBSymType) int {
-	if l.Pos >= len(l.Query) {
+	if l.replay != nil {
+		if len(l.tokens) < len(l.replay) {
+			t := l.replay[len(l.tokens)]
+			l.tokens = append(l.tokens, t)
+			lval.tok = t.tok
+			return t.id
+		}
+		l.tokens = append(l.tokens, lexedToken{0, Token{l.Pos, ""}})
 		return 0
 	}
-	src := l.Query[l.Pos:]
-	cur := strings.TrimLeft(src, " \r\t\n")
-	l.Pos += len(src) - len(cur)
-
-	m := doubleRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Pos += len(m)
-		return DOUBLE
+	id := l.next(lval)
+	if id == 0 && l.Pos < len(l.Query) {
+		// a character no token starts with or a lexical error, which the
+		// grammar must not take for the end of input
+		id = lexErrorToken
+	}
+	if id == 0 || id == lexErrorToken {
+		lval.tok = Token{l.Pos, ""}
 	}
+	l.tokens = append(l.tokens, lexedToken{id, lval.tok})
+	return id
+}
 
-	m = intRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Pos += len(m)
-		return INT
+// next scans one token in a single pass over the query. Keywords are matched
+// case-insensitively and their Src is the upper-case keyword, identifiers keep
+// their case and backquoted ones are unquoted, string tokens keep their quotes
+// and escapes, which NewLiteral resolves.
+func (l *Lex) next(lval *FunDBSymType) int {
+	if !l.skipSpace() || l.Pos >= len(l.Query) {
+		return 0
 	}
+	c := l.Query[l.Pos]
+	switch {
+	case isIdentStart(c):
+		return l.scanWord(lval)
+	case isDigit(c), c == '.' && isDigit(l.peek(1)):
+		return l.scanNumber(lval)
+	case c == '\'' || c == '"':
+		return l.scanString(lval, c)
+	case c == '`':
+		return l.scanQuotedIdent(lval)
+	case c == '?':
+		return l.emit(lval, PARAM, l.Pos+1)
+	case c == '$' && isDigit(l.peek(1)):
+		end := l.Pos + 1
+		for end < len(l.Query) && isDigit(l.Query[end]) {
+			end++
+		}
+		return l.emit(lval, PARAM, end)
+	}
+	return l.scanOperator(lval)
+}
 
-	m = boolRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Pos += len(m)
-		return BOOL
+func (l *Lex) peek(offset int) byte {
+	if l.Pos+offset >= len(l.Query) {
+		return 0
 	}
+	return l.Query[l.Pos+offset]
+}
 
-	m = stringRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Pos += len(m)
-		return STRING
+// emit returns the token made of the query up to end
+func (l *Lex) emit(lval *FunDBSymType, id int, end int) int {
+	lval.tok = l.MkTok(l.Query[l.Pos:end])
+	l.Pos = end
+	return id
+}
+
+// skipSpace moves past white space and comments, it fails on a comment that
+// is never closed
+func (l *Lex) skipSpace() bool {
+	for l.Pos < len(l.Query) {
+		switch c := l.Query[l.Pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			l.Pos++
+		case c == '-' && l.peek(1) == '-':
+			end := strings.IndexByte(l.Query[l.Pos:], '\n')
+			if end == -1 {
+				l.Pos = len(l.Query)
+			} else {
+				l.Pos += end + 1
+			}
+		case c == '/' && l.peek(1) == '*':
+			end := strings.Index(l.Query[l.Pos+2:], "*/")
+			if end == -1 {
+				l.lexError = "unterminated comment"
+				return false
+			}
+			l.Pos += end + 4
+		default:
+			return true
+		}
 	}
+	return true
+}
 
-	for keyword, token := range KeywordTokenMap {
-		if strings.HasPrefix(strings.ToUpper(cur), keyword) {
-			lval.tok = l.MkTok(keyword)
-			l.Pos += len(keyword)
-			return token
+func (l *Lex) scanWord(lval *FunDBSymType) int {
+	end := l.Pos + 1
+	for end < len(l.Query) && isIdentChar(l.Query[end]) {
+		end++
+	}
+	word := l.Query[l.Pos:end]
+	if len(word) > maxKeywordLen {
+		return l.emit(lval, IDENT, end)
+	}
+	upper := strings.ToUpper(word)
+	if token, ok := KeywordTokenMap[upper]; ok {
+		lval.tok = l.MkTok(upper)
+		if NonReservedKeywords[token] {
+			// it may be a name, whose case is kept
+			lval.tok = l.MkTok(word)
 		}
+		l.Pos = end
+		return token
 	}
+	if upper == "TRUE" || upper == "FALSE" {
+		lval.tok = l.MkTok(upper)
+		l.Pos = end
+		return BOOL
+	}
+	return l.emit(lval, IDENT, end)
+}
 
-	for op, token := range OPTokenMap {
-		if strings.HasPrefix(cur, op) {
-			lval.tok = l.MkTok(op)
-			l.Pos += len(op)
-			return token
+// scanNumber reads digits with an optional fraction and exponent, a number
+// with either is a DOUBLE. The sign is not part of the number, the grammar
+// applies it.
+func (l *Lex) scanNumber(lval *FunDBSymType) int {
+	id := INT
+	end := l.Pos
+	for end < len(l.Query) && isDigit(l.Query[end]) {
+		end++
+	}
+	if end < len(l.Query) && l.Query[end] == '.' {
+		id = DOUBLE
+		end++
+		for end < len(l.Query) && isDigit(l.Query[end]) {
+			end++
+		}
+	}
+	if end < len(l.Query) && (l.Query[end] == 'e' || l.Query[end] == 'E') {
+		exp := end + 1
+		if exp < len(l.Query) && (l.Query[exp] == '+' || l.Query[exp] == '-') {
+			exp++
+		}
+		if exp < len(l.Query) && isDigit(l.Query[exp]) {
+			id = DOUBLE
+			end = exp
+			for end < len(l.Query) && isDigit(l.Query[end]) {
+				end++
+			}
 		}
 	}
+	return l.emit(lval, id, end)
+}
 
-	for op, token := range ComparisonMap {
-		if strings.HasPrefix(cur, op) {
-			lval.tok = l.MkTok(op)
-			l.Pos += len(op)
-			return token
+// scanString reads a string quoted with quote, a backslash escapes the next
+// character and a doubled quote stands for the quote itself
+func (l *Lex) scanString(lval *FunDBSymType, quote byte) int {
+	for end := l.Pos + 1; end < len(l.Query); end++ {
+		switch l.Query[end] {
+		case '\\':
+			end++
+		case quote:
+			if end+1 < len(l.Query) && l.Query[end+1] == quote {
+				end++
+				continue
+			}
+			return l.emit(lval, STRING, end+1)
 		}
 	}
+	l.lexError = "unterminated string"
+	return 0
+}
 
-	m = identRe.FindString(cur)
-	if m != "" {
-		// fmt.Println("ident")
-		lval.tok = l.MkTok(m)
-		l.Pos += len(m)
+// scanQuotedIdent reads an identifier between backquotes, which may be a
+// keyword or contain any character, a doubled backquote stands for itself
+func (l *Lex) scanQuotedIdent(lval *FunDBSymType) int {
+	for end := l.Pos + 1; end < len(l.Query); end++ {
+		if l.Query[end] != '`' {
+			continue
+		}
+		if end+1 < len(l.Query) && l.Query[end+1] == '`' {
+			end++
+			continue
+		}
+		name := strings.Replace(l.Query[l.Pos+1:end], "``", "`", -1)
+		if name == "" {
+			l.lexError = "empty quoted identifier"
+			return 0
+		}
+		lval.tok = l.MkTok(name)
+		l.Pos = end + 1
 		return IDENT
 	}
+	l.lexError = "unterminated quoted identifier"
 	return 0
 }
 
-func (l *Lex) Error(s string) {
-	buf := bytes.NewBuffer(make([]byte, 0, 32))
-	fmt.Fprintf(buf, "%s at position %v near %s", s, l.Pos, l.LastToken.Src)
-	fmt.Printf("Syntax Error: pos near %d:\n", l.Pos)
+// scanOperator matches the longest operator first, so <= isn't read as <
+func (l *Lex) scanOperator(lval *FunDBSymType) int {
+	if l.Pos+2 <= len(l.Query) {
+		if token, ok := ComparisonMap[l.Query[l.Pos:l.Pos+2]]; ok {
+			return l.emit(lval, token, l.Pos+2)
+		}
+	}
+	op := l.Query[l.Pos : l.Pos+1]
+	if token, ok := ComparisonMap[op]; ok {
+		return l.emit(lval, token, l.Pos+1)
+	}
+	if token, ok := OPTokenMap[op]; ok {
+		return l.emit(lval, token, l.Pos+1)
+	}
+	return 0
+}
+
+func (l *Lex) newParam(tok Token) *ParamNode {
+	if tok.Src == "?" {
+		l.positionalParams++
+		return &ParamNode{Index: l.positionalParams, Token: tok}
+	}
+	index, _ := strconv.Atoi(tok.Src[1:])
+	l.numberedParams = append(l.numberedParams, index)
+	return &ParamNode{Index: index, Token: tok}
+}
+
+func (l *Lex) literalError(tok Token, err error) {
+	if l.literalErr != nil {
+		return
+	}
+	parserErr := NewParserError("syntax error: %s", err)
+	parserErr.Line, parserErr.Column = l.position(tok.Pos)
+	parserErr.Token = tok.Src
+	l.literalErr = parserErr
+}
 
-	fmt.Printf("%s\n", l.Query)
-	for i := 0; i < l.Pos; i++ {
-		if l.Query[i] == '\t' {
-			fmt.Print("\t")
-		} else {
-			fmt.Print(" ")
+func (l *Lex) hasParams() bool {
+	return l.positionalParams > 0 || len(l.numberedParams) > 0
+}
+
+// paramCount checks the placeholders are either all ? or all $1..$n without gaps
+func (l *Lex) paramCount() (int, error) {
+	if l.positionalParams > 0 && len(l.numberedParams) > 0 {
+		return 0, NewParserError("syntax error: ? and $n placeholders can't be mixed")
+	}
+	if l.positionalParams > 0 {
+		return l.positionalParams, nil
+	}
+	count := 0
+	used := make(map[int]bool)
+	for _, index := range l.numberedParams {
+		if index < 1 {
+			return 0, NewParserError("syntax error: placeholder $%d, numbering starts at $1", index)
+		}
+		used[index] = true
+		if index > count {
+			count = index
+		}
+	}
+	for i := 1; i <= count; i++ {
+		if !used[i] {
+			return 0, NewParserError("syntax error: placeholder $%d is missing", i)
 		}
 	}
-	fmt.Println("^")
-	l.LastError = buf.String()
+	return count, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func (l *Lex) Error(s string) {
+	l.LastError = s
 }
@@ -0,0 +1,244 @@
+package parser
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+// lexAll returns the tokens of query up to the end of input or an error
+func lexAll(query string) ([]lexedToken, *Lex) {
+	l := NewLex(query)
+	for {
+		var lval FunDBSymType
+		id := l.Lex(&lval)
+		if id == 0 {
+			return l.tokens[:len(l.tokens)-1], l
+		}
+	}
+}
+
+func TestLex(t *testing.T) {
+	cases := []struct {
+		query  string
+		tokens []lexedToken
+	}{
+		{"select Name from users_2", []lexedToken{
+			{SELECT, Token{0, "SELECT"}}, {IDENT, Token{7, "Name"}}, {FROM, Token{12, "FROM"}}, {IDENT, Token{17, "users_2"}},
+		}},
+		{"a<=1 AND b<>2 OR c!=3 and d>=4", []lexedToken{
+			{IDENT, Token{0, "a"}}, {SMALLEREQ, Token{1, "<="}}, {INT, Token{3, "1"}},
+			{AND, Token{5, "AND"}}, {IDENT, Token{9, "b"}}, {NOTEQUAL, Token{10, "<>"}}, {INT, Token{12, "2"}},
+			{OR, Token{14, "OR"}}, {IDENT, Token{17, "c"}}, {NOTEQUAL, Token{18, "!="}}, {INT, Token{20, "3"}},
+			{AND, Token{22, "AND"}}, {IDENT, Token{26, "d"}}, {GREATEREQ, Token{27, ">="}}, {INT, Token{29, "4"}},
+		}},
+		{"1.5 .5 2e3 1.5E-2 7e", []lexedToken{
+			{DOUBLE, Token{0, "1.5"}}, {DOUBLE, Token{4, ".5"}}, {DOUBLE, Token{7, "2e3"}}, {DOUBLE, Token{11, "1.5E-2"}},
+			{INT, Token{18, "7"}}, {IDENT, Token{19, "e"}},
+		}},
+		{"`select` `a``b` orders", []lexedToken{
+			{IDENT, Token{0, "select"}}, {IDENT, Token{9, "a`b"}}, {IDENT, Token{16, "orders"}},
+		}},
+		{`'it''s' "a\"b" true False`, []lexedToken{
+			{STRING, Token{0, `'it''s'`}}, {STRING, Token{8, `"a\"b"`}}, {BOOL, Token{15, "TRUE"}}, {BOOL, Token{20, "FALSE"}},
+		}},
+		{"a -- comment\n/* block\n comment */ - ? $12", []lexedToken{
+			{IDENT, Token{0, "a"}}, {MINUS, Token{34, "-"}}, {PARAM, Token{36, "?"}}, {PARAM, Token{38, "$12"}},
+		}},
+	}
+	for _, c := range cases {
+		tokens, _ := lexAll(c.query)
+		assert.Equal(t, tokens, c.tokens)
+	}
+}
+
+func TestLexError(t *testing.T) {
+	for query, message := range map[string]string{
+		"SELECT a FROM t WHERE b = 'x":    "unterminated string",
+		"SELECT a FROM t /* comment":      "unterminated comment",
+		"SELECT `a FROM t":                "unterminated quoted identifier",
+		"SELECT a FROM t WHERE b = ``":    "empty quoted identifier",
+		"SELECT a FROM t WHERE b = 1 # x": "unexpected character \"#\"",
+	} {
+		_, err := Parse(query)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), message), err.Error())
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	for src, val := range map[string]string{
+		`'plain'`:       "plain",
+		`'it''s'`:       "it's",
+		`"say ""hi"""`:  `say "hi"`,
+		`'a\'b\"c\\d'`:  `a'b"c\d`,
+		`'tab\there\n'`: "tab\there\n",
+		`'100\%'`:       `100\%`,
+	} {
+		assert.Equal(t, NewLiteral(protocol.STRING, src).GetVal().GetStrVal(), val)
+	}
+}
+
+func TestNotEqual(t *testing.T) {
+	for _, sql := range []string{"SELECT a FROM t WHERE a != 1", "SELECT a FROM t WHERE a <> 1"} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil)
+		where := query.Statement.(*SelectQuery).WhereExpression
+		assert.T(t, !where.Right.(*Scalar).Val.(LiteralNode).Compare(NOTEQUAL, newIntNode(1)))
+		assert.T(t, where.Right.(*Scalar).Val.(LiteralNode).Compare(NOTEQUAL, newIntNode(2)))
+	}
+	query, err := Parse("DELETE FROM t WHERE _id <> 3")
+	assert.Equal(t, err, nil)
+	condition, ranges, err := GetIdCondition(query.Statement.(*DeleteQuery).WhereExpression)
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, condition, nil)
+	assert.Equal(t, ranges, fullIdRanges())
+}
+
+func TestNegativeValues(t *testing.T) {
+	query, err := Parse("INSERT INTO t (a, b) VALUES (-3, -1.5e2)")
+	assert.Equal(t, err, nil)
+	items := query.Statement.(*InsertQuery).Values[0].Items
+	assert.Equal(t, items[0].GetVal().GetIntVal(), int64(-3))
+	assert.Equal(t, items[1].GetVal().GetDoubleVal(), -150.0)
+
+	query, err = Parse("INSERT INTO t (a, b) VALUES (-9223372036854775808, 9223372036854775807)")
+	assert.Equal(t, err, nil)
+	items = query.Statement.(*InsertQuery).Values[0].Items
+	assert.Equal(t, items[0].GetVal().GetIntVal(), int64(math.MinInt64))
+	assert.Equal(t, items[1].GetVal().GetIntVal(), int64(math.MaxInt64))
+
+	for sql, val := range map[string]int64{
+		"SELECT a FROM t WHERE a = -9223372036854775808":   math.MinInt64,
+		"SELECT a FROM t WHERE a = -(9223372036854775808)": math.MinInt64,
+	} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil, sql)
+		right := query.Statement.(*SelectQuery).WhereExpression.Right.(*Scalar)
+		assert.Equal(t, right.Type, SCLAR_LITERAL)
+		assert.Equal(t, right.Val.(LiteralNode).GetVal().GetIntVal(), val)
+	}
+	query, err = Parse("CREATE TABLE t (a INT DEFAULT -9223372036854775808)")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*CreateTableQuery).Columns[0].Default.GetIntVal(), int64(math.MinInt64))
+}
+
+func TestNumberOutOfRange(t *testing.T) {
+	for _, c := range []struct {
+		sql, token string
+		column     int
+	}{
+		{"SELECT a FROM t WHERE _id = 99999999999999999999", "99999999999999999999", 29},
+		{"SELECT a FROM t WHERE a = 9223372036854775808", "9223372036854775808", 27},
+		{"SELECT a FROM t WHERE a = 1 - 9223372036854775808", "9223372036854775808", 31},
+		{"INSERT INTO t (a) VALUES (-9223372036854775809)", "9223372036854775809", 28},
+		{"INSERT INTO t (a) VALUES (9223372036854775808)", "9223372036854775808", 27},
+		{"SELECT a FROM t WHERE a > 1e400", "1e400", 27},
+		{"INSERT INTO t (a) VALUES (-1.5e309)", "1.5e309", 28},
+		{"SELECT a FROM t LIMIT 9223372036854775808", "9223372036854775808", 23},
+		{"SELECT a FROM t LIMIT 1 OFFSET 99999999999999999999", "99999999999999999999", 32},
+	} {
+		_, err := Parse(c.sql)
+		parserErr, ok := err.(ParserError)
+		assert.T(t, ok, c.sql)
+		assert.T(t, strings.Contains(parserErr.Message, "out of range"), parserErr.Message)
+		assert.Equal(t, parserErr.Token, c.token, c.sql)
+		assert.Equal(t, parserErr.Column, c.column, c.sql)
+	}
+	// too small to be told from zero isn't out of range
+	query, err := Parse("SELECT a FROM t WHERE a > 1e-400")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).WhereExpression.Right.(*Scalar).Val.(LiteralNode).GetVal().GetDoubleVal(), 0.0)
+
+	query, err = Parse("SELECT a FROM t LIMIT 9223372036854775807 OFFSET 9223372036854775807")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).Limit, math.MaxInt64)
+	assert.Equal(t, query.Statement.(*SelectQuery).Offset, math.MaxInt64)
+}
+
+const benchQuery = `SELECT name, age + 1 AS next_age, count(*) FROM users_2014
+	WHERE _id BETWEEN 100 AND 2000 AND (name LIKE 'jo%' OR age >= 21.5) AND city <> "Paris"
+	GROUP BY name, age HAVING count(*) > 1 ORDER BY age DESC LIMIT 10 OFFSET 5`
+
+func BenchmarkLex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		l := NewLex(benchQuery)
+		var lval FunDBSymType
+		for l.next(&lval) != 0 {
+		}
+	}
+}
+
+// regexpLex is the lexer the scanner replaced, kept as the baseline of
+// BenchmarkRegexpLex
+type regexpLex struct {
+	Pos   int
+	Query string
+}
+
+var (
+	doubleRe = regexp.MustCompile("^[0-9]+\\.[0-9]+")
+	intRe    = regexp.MustCompile("^[0-9]+")
+	boolRe   = regexp.MustCompile("^(TRUE|FALSE|true|false)")
+	stringRe = regexp.MustCompile("^((\"[^\"]*\")|(\\'[^\\']*\\'))")
+	paramRe  = regexp.MustCompile("^(\\?|\\$[0-9]+)")
+	identRe  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*")
+)
+
+func (l *regexpLex) next(lval *FunDBSymType) int {
+	if l.Pos >= len(l.Query) {
+		return 0
+	}
+	src := l.Query[l.Pos:]
+	cur := strings.TrimLeft(src, " \r\t\n")
+	l.Pos += len(src) - len(cur)
+
+	for _, re := range []struct {
+		re *regexp.Regexp
+		id int
+	}{{doubleRe, DOUBLE}, {intRe, INT}, {boolRe, BOOL}, {stringRe, STRING}, {paramRe, PARAM}} {
+		if m := re.re.FindString(cur); m != "" {
+			lval.tok = Token{l.Pos, m}
+			l.Pos += len(m)
+			return re.id
+		}
+	}
+
+	upperCur := strings.ToUpper(cur)
+	for keyword, token := range KeywordTokenMap {
+		if strings.HasPrefix(upperCur, keyword) && (len(cur) == len(keyword) || !isIdentChar(cur[len(keyword)])) {
+			lval.tok = Token{l.Pos, keyword}
+			l.Pos += len(keyword)
+			return token
+		}
+	}
+	for _, opMap := range []map[string]int{OPTokenMap, ComparisonMap} {
+		for op, token := range opMap {
+			if strings.HasPrefix(cur, op) {
+				lval.tok = Token{l.Pos, op}
+				l.Pos += len(op)
+				return token
+			}
+		}
+	}
+	if m := identRe.FindString(cur); m != "" {
+		lval.tok = Token{l.Pos, m}
+		l.Pos += len(m)
+		return IDENT
+	}
+	return 0
+}
+
+func BenchmarkRegexpLex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		l := &regexpLex{Query: benchQuery}
+		var lval FunDBSymType
+		for l.next(&lval) != 0 {
+		}
+	}
+}
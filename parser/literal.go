@@ -1,12 +1,24 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 
 	"github.com/senarukana/fundb/protocol"
 )
 
+var (
+	ErrDivisionByZero  = errors.New("division by zero")
+	ErrIntegerOverflow = errors.New("integer overflow")
+)
+
+// LiteralNode is a typed value. Equal and Less define the order used by
+// sorting, grouping and DISTINCT: NULL equals NULL and is smaller than any
+// other value. Compare evaluates a comparison predicate, where any NULL
+// operand makes the result unknown, which is reported as false.
 type LiteralNode interface {
 	GetVal() *protocol.FieldValue
 	GetType() protocol.FieldType
@@ -15,6 +27,10 @@ type LiteralNode interface {
 	Less(LiteralNode) bool
 }
 
+func IsNull(node LiteralNode) bool {
+	return node.GetType() == protocol.NULL
+}
+
 type IntNode struct {
 	Type protocol.FieldType
 	*protocol.FieldValue
@@ -49,17 +65,22 @@ func (self *IntNode) GetType() protocol.FieldType {
 }
 
 func (self *IntNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
 	switch cmpOp {
 	case EQUAL:
 		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
 	case SMALLER:
 		return self.Less(other)
 	case SMALLEREQ:
 		return self.Equal(other) || self.Less(other)
 	case GREATER:
-		return !(self.Less(other) || self.Equal(other))
+		return other.Less(self)
 	case GREATEREQ:
-		return !(self.Less(other))
+		return self.Equal(other) || other.Less(self)
 	default:
 		panic("UNKNOWN operator")
 	}
@@ -68,6 +89,8 @@ func (self *IntNode) Compare(cmpOp int, other LiteralNode) bool {
 func (self *IntNode) Equal(other LiteralNode) bool {
 	if intNode, ok := other.(*IntNode); ok {
 		return self.GetIntVal() == intNode.GetIntVal()
+	} else if doubleNode, ok := other.(*DoubleNode); ok {
+		return float64(self.GetIntVal()) == doubleNode.GetDoubleVal()
 	} else {
 		return false
 	}
@@ -76,6 +99,8 @@ func (self *IntNode) Equal(other LiteralNode) bool {
 func (self *IntNode) Less(other LiteralNode) bool {
 	if intNode, ok := other.(*IntNode); ok {
 		return self.GetIntVal() < intNode.GetIntVal()
+	} else if doubleNode, ok := other.(*DoubleNode); ok {
+		return float64(self.GetIntVal()) < doubleNode.GetDoubleVal()
 	} else {
 		return false
 	}
@@ -90,17 +115,22 @@ func (self *DoubleNode) GetType() protocol.FieldType {
 }
 
 func (self *DoubleNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
 	switch cmpOp {
 	case EQUAL:
 		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
 	case SMALLER:
 		return self.Less(other)
 	case SMALLEREQ:
 		return self.Equal(other) || self.Less(other)
 	case GREATER:
-		return !(self.Less(other) || self.Equal(other))
+		return other.Less(self)
 	case GREATEREQ:
-		return !(self.Less(other))
+		return self.Equal(other) || other.Less(self)
 	default:
 		panic("UNKNOWN operator")
 	}
@@ -109,6 +139,8 @@ func (self *DoubleNode) Compare(cmpOp int, other LiteralNode) bool {
 func (self *DoubleNode) Equal(other LiteralNode) bool {
 	if doubleNode, ok := other.(*DoubleNode); ok {
 		return self.GetDoubleVal() == doubleNode.GetDoubleVal()
+	} else if intNode, ok := other.(*IntNode); ok {
+		return self.GetDoubleVal() == float64(intNode.GetIntVal())
 	} else {
 		return false
 	}
@@ -117,6 +149,8 @@ func (self *DoubleNode) Equal(other LiteralNode) bool {
 func (self *DoubleNode) Less(other LiteralNode) bool {
 	if doubleNode, ok := other.(*DoubleNode); ok {
 		return self.GetDoubleVal() < doubleNode.GetDoubleVal()
+	} else if intNode, ok := other.(*IntNode); ok {
+		return self.GetDoubleVal() < float64(intNode.GetIntVal())
 	} else {
 		return false
 	}
@@ -131,9 +165,14 @@ func (self *BoolNode) Equal(other LiteralNode) bool {
 }
 
 func (self *BoolNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
 	switch cmpOp {
 	case EQUAL:
 		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
 	case SMALLER:
 		return false
 	case SMALLEREQ:
@@ -168,17 +207,22 @@ func (self *StringNode) Equal(other LiteralNode) bool {
 }
 
 func (self *StringNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
 	switch cmpOp {
 	case EQUAL:
 		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
 	case SMALLER:
 		return self.Less(other)
 	case SMALLEREQ:
 		return self.Equal(other) || self.Less(other)
 	case GREATER:
-		return !(self.Less(other) || self.Equal(other))
+		return other.Less(self)
 	case GREATEREQ:
-		return !(self.Less(other))
+		return self.Equal(other) || other.Less(self)
 	default:
 		panic("UNKNOWN operator")
 	}
@@ -217,24 +261,12 @@ func (self *NullNode) Equal(other LiteralNode) bool {
 }
 
 func (self *NullNode) Compare(cmpOp int, other LiteralNode) bool {
-	switch cmpOp {
-	case EQUAL:
-		return self.Equal(other)
-	case SMALLER:
-		return false
-	case SMALLEREQ:
-		return false
-	case GREATER:
-		return false
-	case GREATEREQ:
-		return false
-	default:
-		panic("UNKNOWN operator")
-	}
+	// NULL compared with anything, NULL included, is unknown
+	return false
 }
 
 func (self *NullNode) Less(other LiteralNode) bool {
-	return false
+	return !IsNull(other)
 }
 
 func NewLiteral(fieldType protocol.FieldType, src string) LiteralNode {
@@ -253,7 +285,9 @@ func NewLiteral(fieldType protocol.FieldType, src string) LiteralNode {
 		field.BoolVal = &val
 		return &BoolNode{protocol.BOOL, field}
 	case protocol.STRING:
-		field.StrVal = &src
+		// src is the quoted token
+		val := unquoteString(src)
+		field.StrVal = &val
 		return &StringNode{protocol.STRING, field}
 	case protocol.NULL:
 		return &NullNode{protocol.NULL, field}
@@ -262,3 +296,229 @@ func NewLiteral(fieldType protocol.FieldType, src string) LiteralNode {
 	}
 	panic("shouldn't go here")
 }
+
+// minIntMagnitude is the magnitude of the smallest INT, one more than the largest
+const minIntMagnitude = "9223372036854775808"
+
+// unnegatedInt is a minIntMagnitude literal waiting for the minus sign before it
+type unnegatedInt struct {
+	node LiteralNode
+	tok  Token
+}
+
+// newNumber converts an INT or DOUBLE token, negative when the grammar read
+// the minus sign before it, a number out of range is an error. The magnitude
+// of the smallest INT is stored negative right away, it is only valid once
+// negated.
+func (l *Lex) newNumber(fieldType protocol.FieldType, tok Token, negative bool) LiteralNode {
+	src := tok.Src
+	if negative {
+		src = "-" + src
+	}
+	var err error
+	if fieldType == protocol.INT {
+		if _, err = strconv.ParseInt(src, 10, 64); err != nil && src == minIntMagnitude {
+			node := newIntNode(math.MinInt64)
+			l.unnegatedInts = append(l.unnegatedInts, unnegatedInt{node, tok})
+			return node
+		}
+	} else {
+		_, err = strconv.ParseFloat(src, 64)
+	}
+	if err != nil {
+		l.literalError(tok, fmt.Errorf("number %s is out of range", src))
+		return NewLiteral(protocol.NULL, "")
+	}
+	return NewLiteral(fieldType, src)
+}
+
+// newCount converts the INT of LIMIT or OFFSET, a count out of range is an
+// error rather than the largest INT
+func (l *Lex) newCount(tok Token) int {
+	val, err := strconv.ParseInt(tok.Src, 10, 64)
+	if err != nil {
+		l.literalError(tok, fmt.Errorf("number %s is out of range", tok.Src))
+	}
+	return int(val)
+}
+
+// negated tells whether node is a minIntMagnitude literal, which is then
+// known to have its minus sign
+func (l *Lex) negated(node LiteralNode) bool {
+	for i, unnegated := range l.unnegatedInts {
+		if unnegated.node == node {
+			l.unnegatedInts = append(l.unnegatedInts[:i], l.unnegatedInts[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// negate is the scalar -operand
+func (l *Lex) negate(operand *Scalar) *Scalar {
+	if operand.Type == SCLAR_LITERAL && l.negated(operand.Val.(LiteralNode)) {
+		return operand
+	}
+	return NewArithmeticScalar(UMINUS, operand, nil)
+}
+
+// unquoteString strips the quotes of a string token and resolves its escapes:
+// \n, \t, \r and \0 are control characters, a backslash before a quote or
+// another backslash stands for that character and a doubled quote for the
+// quote. Other escapes keep their backslash, so \% and \_ still reach LIKE.
+func unquoteString(src string) string {
+	quote, body := src[0], src[1:len(src)-1]
+	if strings.IndexByte(body, '\\') == -1 && strings.IndexByte(body, quote) == -1 {
+		return body
+	}
+	buf := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c == quote && i+1 < len(body) && body[i+1] == quote {
+			i++
+		} else if c == '\\' && i+1 < len(body) {
+			i++
+			switch body[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case '0':
+				c = 0
+			case '\\', '\'', '"':
+				c = body[i]
+			default:
+				buf = append(buf, '\\')
+				c = body[i]
+			}
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+// NewFieldLiteral wraps a stored or bound value, a nil value is NULL
+func NewFieldLiteral(field *protocol.FieldValue) LiteralNode {
+	switch {
+	case field == nil:
+		return &NullNode{protocol.NULL, &protocol.FieldValue{}}
+	case field.TimestampVal != nil:
+		return &TimestampNode{protocol.TIMESTAMP, field}
+	case field.IntVal != nil:
+		return &IntNode{protocol.INT, field}
+	case field.DoubleVal != nil:
+		return &DoubleNode{protocol.DOUBLE, field}
+	case field.BoolVal != nil:
+		return &BoolNode{protocol.BOOL, field}
+	case field.StrVal != nil:
+		return &StringNode{protocol.STRING, field}
+	default:
+		return &NullNode{protocol.NULL, field}
+	}
+}
+
+func newIntNode(val int64) LiteralNode {
+	return &IntNode{protocol.INT, &protocol.FieldValue{IntVal: &val}}
+}
+
+func newDoubleNode(val float64) LiteralNode {
+	return &DoubleNode{protocol.DOUBLE, &protocol.FieldValue{DoubleVal: &val}}
+}
+
+func toDouble(node LiteralNode) float64 {
+	if node.GetType() == protocol.INT {
+		return float64(node.GetVal().GetIntVal())
+	}
+	return node.GetVal().GetDoubleVal()
+}
+
+func isNumeric(node LiteralNode) bool {
+	return node.GetType() == protocol.INT || node.GetType() == protocol.DOUBLE
+}
+
+// Arithmetic applies an arithmetic operator to two numeric literals, right is
+// ignored for UMINUS. INT op INT stays INT, any DOUBLE operand promotes the
+// result to DOUBLE, and a NULL operand makes the result NULL. Timestamps and
+// intervals follow temporalArithmetic.
+func Arithmetic(op int, left, right LiteralNode) (LiteralNode, error) {
+	if op == UMINUS {
+		switch left.GetType() {
+		case protocol.NULL:
+			return left, nil
+		case protocol.INT:
+			val := left.GetVal().GetIntVal()
+			if val == math.MinInt64 {
+				return nil, ErrIntegerOverflow
+			}
+			return newIntNode(-val), nil
+		case protocol.DOUBLE:
+			return newDoubleNode(-left.GetVal().GetDoubleVal()), nil
+		case protocol.INTERVAL:
+			return newIntervalNode(-left.(*IntervalNode).Duration), nil
+		default:
+			return nil, fmt.Errorf("unsupported operand %v for -", left.GetVal().GetValue())
+		}
+	}
+
+	if left.GetType() == protocol.NULL {
+		return left, nil
+	}
+	if right.GetType() == protocol.NULL {
+		return right, nil
+	}
+	if isTemporal(left) || isTemporal(right) {
+		return temporalArithmetic(op, left, right)
+	}
+	if !isNumeric(left) || !isNumeric(right) {
+		return nil, fmt.Errorf("unsupported operands %v and %v for %s",
+			left.GetVal().GetValue(), right.GetVal().GetValue(), ArithmeticOpMap[op])
+	}
+
+	if left.GetType() == protocol.INT && right.GetType() == protocol.INT {
+		l, r := left.GetVal().GetIntVal(), right.GetVal().GetIntVal()
+		// the results past the int64 range would wrap around
+		switch op {
+		case PLUS:
+			if r > 0 && l > math.MaxInt64-r || r < 0 && l < math.MinInt64-r {
+				return nil, ErrIntegerOverflow
+			}
+			return newIntNode(l + r), nil
+		case MINUS:
+			if r < 0 && l > math.MaxInt64+r || r > 0 && l < math.MinInt64+r {
+				return nil, ErrIntegerOverflow
+			}
+			return newIntNode(l - r), nil
+		case STAR:
+			if l != 0 && ((l*r)/l != r || l == -1 && r == math.MinInt64) {
+				return nil, ErrIntegerOverflow
+			}
+			return newIntNode(l * r), nil
+		case DIV:
+			if r == 0 {
+				return nil, ErrDivisionByZero
+			}
+			if l == math.MinInt64 && r == -1 {
+				return nil, ErrIntegerOverflow
+			}
+			return newIntNode(l / r), nil
+		}
+	} else {
+		l, r := toDouble(left), toDouble(right)
+		switch op {
+		case PLUS:
+			return newDoubleNode(l + r), nil
+		case MINUS:
+			return newDoubleNode(l - r), nil
+		case STAR:
+			return newDoubleNode(l * r), nil
+		case DIV:
+			if r == 0 {
+				return nil, ErrDivisionByZero
+			}
+			return newDoubleNode(l / r), nil
+		}
+	}
+	panic(fmt.Sprintf("UNKNOWN ARITHMETIC OPERATOR %d", op))
+}
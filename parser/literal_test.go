@@ -0,0 +1,159 @@
+package parser
+
+import (
+	"math"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+var nullNode = NewFieldLiteral(nil)
+
+func TestArithmetic(t *testing.T) {
+	for _, c := range []struct {
+		op          int
+		left, right LiteralNode
+		expected    interface{}
+	}{
+		{PLUS, newIntNode(2), newIntNode(3), int64(5)},
+		{MINUS, newIntNode(2), newIntNode(3), int64(-1)},
+		{STAR, newIntNode(-4), newIntNode(3), int64(-12)},
+		{DIV, newIntNode(7), newIntNode(2), int64(3)},
+		{DIV, newIntNode(-7), newIntNode(2), int64(-3)},
+		// a DOUBLE on either side promotes the result
+		{PLUS, newIntNode(1), newDoubleNode(0.5), 1.5},
+		{MINUS, newDoubleNode(0.5), newIntNode(1), -0.5},
+		{STAR, newDoubleNode(2.5), newDoubleNode(2), 5.0},
+		{DIV, newDoubleNode(7), newIntNode(2), 3.5},
+		{DIV, newIntNode(7), newDoubleNode(2), 3.5},
+		{UMINUS, newIntNode(3), nil, int64(-3)},
+		{UMINUS, newDoubleNode(-1.5), nil, 1.5},
+		// NULL wins over everything, even a zero divisor
+		{PLUS, nullNode, newIntNode(1), nil},
+		{STAR, newDoubleNode(2), nullNode, nil},
+		{DIV, nullNode, newIntNode(0), nil},
+		{DIV, newIntNode(1), nullNode, nil},
+		{MINUS, NewFieldLiteral(strValue("a")), nullNode, nil},
+		{UMINUS, nullNode, nil, nil},
+		// the int64 limits themselves are reached without overflowing
+		{PLUS, newIntNode(math.MaxInt64 - 1), newIntNode(1), int64(math.MaxInt64)},
+		{PLUS, newIntNode(math.MinInt64), newIntNode(math.MaxInt64), int64(-1)},
+		{MINUS, newIntNode(math.MinInt64 + 1), newIntNode(1), int64(math.MinInt64)},
+		{MINUS, newIntNode(-1), newIntNode(math.MaxInt64), int64(math.MinInt64)},
+		{STAR, newIntNode(math.MinInt64), newIntNode(1), int64(math.MinInt64)},
+		{STAR, newIntNode(-1), newIntNode(math.MaxInt64), int64(-math.MaxInt64)},
+		{STAR, newIntNode(0), newIntNode(math.MinInt64), int64(0)},
+		{DIV, newIntNode(math.MinInt64), newIntNode(1), int64(math.MinInt64)},
+		{UMINUS, newIntNode(math.MaxInt64), nil, int64(-math.MaxInt64)},
+	} {
+		val, err := Arithmetic(c.op, c.left, c.right)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, val.GetVal().GetValue(), c.expected)
+	}
+
+	val, err := Arithmetic(PLUS, newIntNode(1), newDoubleNode(2))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val.GetType(), protocol.DOUBLE)
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	for _, c := range []struct {
+		op          int
+		left, right LiteralNode
+	}{
+		{DIV, newIntNode(1), newIntNode(0)},
+		{DIV, newDoubleNode(1), newIntNode(0)},
+		{DIV, newIntNode(1), newDoubleNode(0)},
+		{DIV, newDoubleNode(0), newDoubleNode(0)},
+	} {
+		_, err := Arithmetic(c.op, c.left, c.right)
+		assert.Equal(t, err, ErrDivisionByZero)
+	}
+
+	for _, c := range []struct {
+		op          int
+		left, right LiteralNode
+	}{
+		{PLUS, newIntNode(math.MaxInt64), newIntNode(1)},
+		{PLUS, newIntNode(math.MinInt64), newIntNode(-1)},
+		{MINUS, newIntNode(math.MinInt64), newIntNode(1)},
+		{MINUS, newIntNode(0), newIntNode(math.MinInt64)},
+		{STAR, newIntNode(math.MaxInt64), newIntNode(2)},
+		{STAR, newIntNode(math.MinInt64), newIntNode(-1)},
+		{STAR, newIntNode(-1), newIntNode(math.MinInt64)},
+		{STAR, newIntNode(1 << 32), newIntNode(1 << 32)},
+		{DIV, newIntNode(math.MinInt64), newIntNode(-1)},
+		{UMINUS, newIntNode(math.MinInt64), nil},
+	} {
+		_, err := Arithmetic(c.op, c.left, c.right)
+		assert.Equal(t, err, ErrIntegerOverflow)
+	}
+
+	for _, c := range []struct {
+		op          int
+		left, right LiteralNode
+	}{
+		{PLUS, NewFieldLiteral(strValue("a")), newIntNode(1)},
+		{STAR, newIntNode(1), NewFieldLiteral(strValue("2"))},
+		{UMINUS, NewFieldLiteral(strValue("a")), nil},
+	} {
+		_, err := Arithmetic(c.op, c.left, c.right)
+		assert.NotEqual(t, err, nil)
+		assert.NotEqual(t, err, ErrDivisionByZero)
+		assert.NotEqual(t, err, ErrIntegerOverflow)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	str := func(val string) LiteralNode { return NewFieldLiteral(strValue(val)) }
+	for _, c := range []struct {
+		left, right LiteralNode
+		// the results of =, !=, <, <=, > and >=
+		expected [6]bool
+	}{
+		{newIntNode(1), newIntNode(2), [6]bool{false, true, true, true, false, false}},
+		{newIntNode(2), newIntNode(2), [6]bool{true, false, false, true, false, true}},
+		{newDoubleNode(2.5), newIntNode(2), [6]bool{false, true, false, false, true, true}},
+		// an INT and a DOUBLE of the same value are equal
+		{newIntNode(1), newDoubleNode(1), [6]bool{true, false, false, true, false, true}},
+		{newDoubleNode(1e18), newIntNode(1000000000000000000), [6]bool{true, false, false, true, false, true}},
+		{str("a"), str("b"), [6]bool{false, true, true, true, false, false}},
+		{newTimestampNode(2), newTimestampNode(1), [6]bool{false, true, false, false, true, true}},
+		// values of types that don't compare are never smaller nor greater
+		{newIntNode(1), str("a"), [6]bool{false, true, false, false, false, false}},
+		{str("a"), newDoubleNode(1), [6]bool{false, true, false, false, false, false}},
+		{newTimestampNode(1), newIntNode(1), [6]bool{false, true, false, false, false, false}},
+		{newIntervalNode(1), newIntNode(1), [6]bool{false, true, false, false, false, false}},
+		// anything compared with NULL is unknown, NULL included
+		{newIntNode(1), nullNode, [6]bool{}},
+		{str("a"), nullNode, [6]bool{}},
+		{nullNode, newIntNode(1), [6]bool{}},
+		{nullNode, nullNode, [6]bool{}},
+	} {
+		for i, op := range []int{EQUAL, NOTEQUAL, SMALLER, SMALLEREQ, GREATER, GREATEREQ} {
+			assert.Equal(t, c.left.Compare(op, c.right), c.expected[i], c.left, op, c.right)
+		}
+	}
+}
+
+// Equal and Less order the values of sorts, groups and DISTINCT, in which
+// NULL is a value equal to NULL and smaller than everything else
+func TestEqualLess(t *testing.T) {
+	assert.T(t, nullNode.Equal(nullNode))
+	assert.T(t, !nullNode.Less(nullNode))
+	for _, other := range []LiteralNode{newIntNode(-1), newDoubleNode(0), NewFieldLiteral(strValue(""))} {
+		assert.T(t, !nullNode.Equal(other))
+		assert.T(t, !other.Equal(nullNode))
+		assert.T(t, nullNode.Less(other))
+		assert.T(t, !other.Less(nullNode))
+	}
+
+	assert.T(t, newIntNode(3).Equal(newDoubleNode(3)))
+	assert.T(t, newDoubleNode(3).Equal(newIntNode(3)))
+	assert.T(t, !newIntNode(3).Less(newDoubleNode(3)))
+	assert.T(t, !newDoubleNode(3).Less(newIntNode(3)))
+	assert.T(t, newIntNode(3).Less(newDoubleNode(3.5)))
+	assert.T(t, !newIntNode(1).Equal(NewFieldLiteral(strValue("1"))))
+}
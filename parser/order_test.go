@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseOrderBy(t *testing.T) {
+	for _, c := range []struct {
+		sql      string
+		orderBys []*OrderBy
+	}{
+		{"SELECT a FROM t", nil},
+		{"SELECT a FROM t ORDER BY a", []*OrderBy{{"a", ORDER_NONE}}},
+		{"SELECT a FROM t ORDER BY a ASC", []*OrderBy{{"a", ORDER_ASC}}},
+		{"SELECT a FROM t order by a desc", []*OrderBy{{"a", ORDER_DESC}}},
+		{"SELECT a FROM t ORDER BY b DESC, a, c asc LIMIT 3", []*OrderBy{{"b", ORDER_DESC}, {"a", ORDER_NONE}, {"c", ORDER_ASC}}},
+		// ORDER BY may name the alias of a selected expression
+		{"SELECT a + 1 AS b FROM t ORDER BY b DESC", []*OrderBy{{"b", ORDER_DESC}}},
+		{"SELECT t.a FROM t JOIN u ON t._id = u.tid ORDER BY u.b", []*OrderBy{{"u.b", ORDER_NONE}}},
+	} {
+		query, err := Parse(c.sql)
+		assert.Equal(t, err, nil, c.sql)
+		selectQuery := query.Statement.(*SelectQuery)
+		if c.orderBys == nil {
+			assert.Equal(t, selectQuery.OrderByList, (*OrderByList)(nil), c.sql)
+		} else {
+			assert.Equal(t, selectQuery.OrderBys, c.orderBys, c.sql)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT a FROM t ORDER BY",
+		"SELECT a FROM t ORDER a",
+		"SELECT a FROM t ORDER BY a AST",
+		"SELECT a FROM t ORDER BY a DESC ASC",
+		"SELECT a FROM t ORDER BY a,",
+		"SELECT a FROM t LIMIT 1 ORDER BY a",
+		"SELECT a FROM t ORDER BY t.a",
+		"SELECT t.a FROM t JOIN u ON t._id = u.tid ORDER BY a",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil, sql)
+	}
+}
+
+// a column sorted on is fetched even when it isn't selected, an alias is
+// not a column
+func TestOrderByFields(t *testing.T) {
+	for sql, expected := range map[string][]string{
+		"SELECT a FROM t WHERE b > 1 ORDER BY c DESC, a":             {"a", "b", "c"},
+		"SELECT price * qty AS total FROM t ORDER BY total":          {"price", "qty"},
+		"SELECT a AS b FROM t ORDER BY b, c":                         {"a", "c"},
+		"SELECT city, COUNT(*) AS n FROM t GROUP BY city ORDER BY n": {"city"},
+	} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil, sql)
+		fields := query.Statement.(*SelectQuery).GetSelectAndConditionFields()
+		sort.Strings(fields)
+		assert.Equal(t, fields, expected, sql)
+	}
+
+	query, err := Parse("SELECT a + 1 AS b, c FROM t ORDER BY b, c")
+	assert.Equal(t, err, nil)
+	selectQuery := query.Statement.(*SelectQuery)
+	assert.Equal(t, selectQuery.GetOrderByScalar(selectQuery.OrderBys[0]), selectQuery.ScalarList.ScalarList[0])
+	assert.Equal(t, selectQuery.GetOrderByScalar(selectQuery.OrderBys[1]), (*Scalar)(nil))
+
+	// a column that is neither grouped nor an alias still is rejected
+	_, err = Parse("SELECT city, COUNT(*) AS n FROM t GROUP BY city ORDER BY m")
+	assert.NotEqual(t, err, nil)
+}
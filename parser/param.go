@@ -0,0 +1,288 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// ParamNode is a ? or $n placeholder of a prepared statement, Index starts at 1.
+// It is replaced by the bound value before the query runs.
+type ParamNode struct {
+	Index int
+	Token Token
+}
+
+func (self *ParamNode) GetVal() *protocol.FieldValue {
+	return &protocol.FieldValue{}
+}
+
+func (self *ParamNode) GetType() protocol.FieldType {
+	return protocol.NULL
+}
+
+func (self *ParamNode) Compare(cmpOp int, other LiteralNode) bool {
+	return false
+}
+
+func (self *ParamNode) Equal(other LiteralNode) bool {
+	return false
+}
+
+func (self *ParamNode) Less(other LiteralNode) bool {
+	return false
+}
+
+// PreparedStatement is a query parsed once and executed with different
+// parameters. ParamTypes holds the type every parameter must have, NULL
+// when the column it is compared with can hold any type.
+type PreparedStatement struct {
+	Query      *Query
+	ParamTypes []protocol.FieldType
+}
+
+func Prepare(sql string) (*PreparedStatement, error) {
+	query, lex, err := parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	paramCount, err := lex.paramCount()
+	if err != nil {
+		return nil, err
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	stmt := &PreparedStatement{
+		Query:      query,
+		ParamTypes: make([]protocol.FieldType, paramCount),
+	}
+	// a binder without values only collects the parameter types
+	(&binder{types: stmt.ParamTypes}).bindQuery(query)
+	return stmt, nil
+}
+
+// Bind returns a copy of the query with every placeholder replaced by its
+// value, a nil value is NULL. The statement itself is left untouched, so it
+// can be bound again, also from several goroutines at once.
+func (self *PreparedStatement) Bind(params []*protocol.FieldValue) (*Query, error) {
+	if len(params) != len(self.ParamTypes) {
+		return nil, fmt.Errorf("statement expects %d parameters, got %d", len(self.ParamTypes), len(params))
+	}
+	for i, param := range params {
+		paramType := NewFieldLiteral(param).GetType()
+		if self.ParamTypes[i] != protocol.NULL && paramType != protocol.NULL && paramType != self.ParamTypes[i] {
+			return nil, fmt.Errorf("parameter %d expects %v, got %v", i+1, self.ParamTypes[i], paramType)
+		}
+	}
+	query := (&binder{types: self.ParamTypes, params: params}).bindQuery(self.Query)
+	// patterns given as parameters are only compiled now
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// Fold returns a copy of statement in which the calls of PerStatement
+// functions hold their value, the statement itself is left untouched. Every
+// record, subquery and page of an INSERT ... SELECT then sees the same NOW().
+// Calls already folded keep their value.
+func Fold(statement Statement) (Statement, error) {
+	folder := &binder{folded: make(map[string]LiteralNode)}
+	res := folder.bindQuery(&Query{Statement: statement}).Statement
+	return res, folder.err
+}
+
+// binder copies the nodes on the way to a placeholder and shares the rest,
+// with folded it calls the PerStatement functions instead
+type binder struct {
+	types  []protocol.FieldType
+	params []*protocol.FieldValue
+	// folded holds the value of every call folded so far by its SQL, the
+	// same call is only made once
+	folded map[string]LiteralNode
+	// err is the first error of a folded call
+	err error
+}
+
+func (self *binder) literal(node LiteralNode, expected protocol.FieldType) LiteralNode {
+	param, ok := node.(*ParamNode)
+	if !ok {
+		return node
+	}
+	if self.params == nil {
+		if expected != protocol.NULL {
+			self.types[param.Index-1] = expected
+		}
+		return node
+	}
+	return NewFieldLiteral(self.params[param.Index-1])
+}
+
+func (self *binder) scalar(scalar *Scalar, expected protocol.FieldType) *Scalar {
+	switch scalar.Type {
+	case SCLAR_LITERAL:
+		return &Scalar{Type: scalar.Type, Val: self.literal(scalar.Val.(LiteralNode), expected), Alias: scalar.Alias}
+	case SCALAR_FUNCTION:
+		function := *scalar.Val.(*FunctionCall)
+		function.ScalarList = self.scalarList(function.ScalarList, protocol.NULL)
+		if self.folded != nil {
+			self.foldCall(&function)
+		}
+		return &Scalar{Type: scalar.Type, Val: &function, Alias: scalar.Alias}
+	case SCALAR_EXPRESSION:
+		expr := *scalar.Val.(*ArithmeticExpression)
+		expr.Left = self.scalar(expr.Left, protocol.NULL)
+		if expr.Right != nil {
+			expr.Right = self.scalar(expr.Right, protocol.NULL)
+		}
+		return &Scalar{Type: scalar.Type, Val: &expr, Alias: scalar.Alias}
+	}
+	return scalar
+}
+
+// foldCall sets the value of a PerStatement function whose arguments are literals
+func (self *binder) foldCall(call *FunctionCall) {
+	function, ok := scalarFunctions[call.Name]
+	if !ok || !function.PerStatement || call.Value != nil {
+		return
+	}
+	args := make([]LiteralNode, len(call.GetArgs()))
+	for i, arg := range call.GetArgs() {
+		if arg.Type != SCLAR_LITERAL {
+			return
+		}
+		args[i] = arg.Val.(LiteralNode)
+	}
+	key := call.Format()
+	if value, ok := self.folded[key]; ok {
+		call.Value = value
+		return
+	}
+	value, err := call.Call(args)
+	if err != nil {
+		if self.err == nil {
+			self.err = err
+		}
+		return
+	}
+	call.Value = value
+	self.folded[key] = value
+}
+
+func (self *binder) scalarList(scalarList *ScalarList, expected protocol.FieldType) *ScalarList {
+	if scalarList == nil {
+		return nil
+	}
+	res := &ScalarList{ScalarList: make([]*Scalar, len(scalarList.ScalarList))}
+	for i, scalar := range scalarList.ScalarList {
+		res.ScalarList[i] = self.scalar(scalar, expected)
+	}
+	return res
+}
+
+func (self *binder) expression(expression interface{}, expected protocol.FieldType) interface{} {
+	if scalar, ok := expression.(*Scalar); ok {
+		return self.scalar(scalar, expected)
+	}
+	return expression
+}
+
+// operandType is the type a value compared with left must have, _id only holds INT
+func operandType(left interface{}) protocol.FieldType {
+	if field, ok := left.(string); ok && field == "_id" {
+		return protocol.INT
+	}
+	return protocol.NULL
+}
+
+func (self *binder) where(condition *WhereExpression) *WhereExpression {
+	if condition == nil {
+		return nil
+	}
+	res := *condition
+	switch condition.Type {
+	case WHERE_AND, WHERE_OR:
+		res.Left = self.where(condition.Left.(*WhereExpression))
+		res.Right = self.where(condition.Right.(*WhereExpression))
+	case WHERE_NOT:
+		res.Left = self.where(condition.Left.(*WhereExpression))
+	case WHERE_COMPARISON:
+		res.Left = self.expression(condition.Left, protocol.NULL)
+		res.Right = self.expression(condition.Right, operandType(condition.Left))
+	case WHERE_BETWEEN:
+		betweenExpr := condition.Right.(*BetweenExpression)
+		res.Right = &BetweenExpression{
+			Left:  self.scalar(betweenExpr.Left, operandType(condition.Left)),
+			Right: self.scalar(betweenExpr.Right, operandType(condition.Left)),
+		}
+	case WHERE_IN:
+		res.Left = self.expression(condition.Left, protocol.NULL)
+		res.Right = self.scalarList(condition.Right.(*ScalarList), operandType(condition.Left))
+	case WHERE_LIKE, WHERE_REGEXP:
+		res.Left = self.expression(condition.Left, protocol.NULL)
+		pattern := condition.Right.(*PatternExpression)
+		if pattern.Param != nil {
+			bound := self.literal(pattern.Param, protocol.STRING)
+			if self.params != nil {
+				res.Right = newPatternExpression(bound, pattern.IsLike)
+			}
+		}
+	case WHERE_IS_NULL:
+		res.Left = self.expression(condition.Left, protocol.NULL)
+	case WHERE_IN_SUBQUERY, WHERE_EXISTS:
+		res.Left = self.expression(condition.Left, protocol.NULL)
+		subquery := self.bindQuery(&Query{QUERY_SELECT, condition.Right.(*Subquery).Query})
+		res.Right = &Subquery{Query: subquery.Statement.(*SelectQuery)}
+	}
+	return &res
+}
+
+func (self *binder) table(table *TableExpression) *TableExpression {
+	return &TableExpression{table.FromExpression, self.where(table.WhereExpression)}
+}
+
+func (self *binder) bindQuery(query *Query) *Query {
+	res := &Query{Type: query.Type}
+	switch q := query.Statement.(type) {
+	case *SelectQuery:
+		selectQuery := *q
+		selectQuery.SelectExpression = &SelectExpression{q.IsStar, self.scalarList(q.ScalarList, protocol.NULL)}
+		selectQuery.TableExpression = self.table(q.TableExpression)
+		selectQuery.Having = self.where(q.Having)
+		res.Statement = &selectQuery
+	case *InsertQuery:
+		insertQuery := *q
+		if q.Select != nil {
+			insertQuery.Select = self.bindQuery(&Query{QUERY_SELECT, q.Select}).Statement.(*SelectQuery)
+			res.Statement = &insertQuery
+			break
+		}
+		insertQuery.ValueList = &ValueList{Values: make([]*ValueItems, len(q.Values))}
+		for i, valueItems := range q.Values {
+			items := &ValueItems{Items: make([]LiteralNode, len(valueItems.Items))}
+			for j, item := range valueItems.Items {
+				expected := protocol.NULL
+				if q.ColumnFields != nil && j < len(q.Fields) {
+					expected = operandType(q.Fields[j])
+				}
+				items.Items[j] = self.literal(item, expected)
+			}
+			insertQuery.Values[i] = items
+		}
+		res.Statement = &insertQuery
+	case *DeleteQuery:
+		res.Statement = &DeleteQuery{self.table(q.TableExpression)}
+	case *UpdateQuery:
+		assignments := &AssignmentList{Assignments: make([]*Assignment, len(q.Assignments))}
+		for i, assignment := range q.Assignments {
+			assignments.Assignments[i] = &Assignment{assignment.Field, self.scalar(assignment.Val, protocol.NULL)}
+		}
+		res.Statement = &UpdateQuery{self.table(q.TableExpression), assignments}
+	case *ExplainQuery:
+		res.Statement = &ExplainQuery{q.Analyze, self.bindQuery(q.Query)}
+	default:
+		res.Statement = query.Statement
+	}
+	return res
+}
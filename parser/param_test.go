@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func strValue(val string) *protocol.FieldValue {
+	return &protocol.FieldValue{StrVal: &val}
+}
+
+func TestPrepareNumbering(t *testing.T) {
+	stmt, err := Prepare("SELECT a FROM t WHERE a = ? AND b = ? AND c = ?")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(stmt.ParamTypes), 3)
+	query, err := stmt.Bind([]*protocol.FieldValue{intValue(1), intValue(2), intValue(3)})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).WhereExpression.String(), "a = 1 AND b = 2 AND c = 3")
+
+	// $n may repeat and come in any order
+	stmt, err = Prepare("UPDATE t SET a = $2 WHERE b = $1 OR c = $1")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(stmt.ParamTypes), 2)
+	query, err = stmt.Bind([]*protocol.FieldValue{intValue(1), intValue(2)})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.String(), "UPDATE t SET a = 2 WHERE b = 1 OR c = 1")
+
+	for sql, message := range map[string]string{
+		"SELECT a FROM t WHERE a = $1 AND b = ?":  "can't be mixed",
+		"SELECT a FROM t WHERE a = $1 AND b = $3": "placeholder $2 is missing",
+		"SELECT a FROM t WHERE a = $0":            "numbering starts at $1",
+	} {
+		_, err := Prepare(sql)
+		assert.NotEqual(t, err, nil, sql)
+		assert.T(t, strings.Contains(err.Error(), message), err.Error())
+	}
+	_, err = Parse("SELECT a FROM t WHERE a = ?")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestPrepareTypes(t *testing.T) {
+	stmt, err := Prepare("SELECT a, ? AS c FROM t WHERE _id > ? AND name LIKE ? AND b IN (?, 3)")
+	assert.Equal(t, err, nil)
+	// _id is an INT and patterns are strings, other columns take any type
+	assert.Equal(t, stmt.ParamTypes, []protocol.FieldType{protocol.NULL, protocol.INT, protocol.STRING, protocol.NULL})
+
+	stmt, err = Prepare("INSERT INTO t (_id, a) VALUES (?, ?), (?, ?)")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, stmt.ParamTypes, []protocol.FieldType{protocol.INT, protocol.NULL, protocol.INT, protocol.NULL})
+	query, err := stmt.Bind([]*protocol.FieldValue{intValue(1), strValue("a"), intValue(2), nil})
+	assert.Equal(t, err, nil)
+	values := query.Statement.(*InsertQuery).Values
+	assert.Equal(t, values[1].Items[0].GetVal().GetIntVal(), int64(2))
+	assert.Equal(t, values[1].Items[1].GetType(), protocol.NULL)
+}
+
+func TestBindMismatch(t *testing.T) {
+	stmt, err := Prepare("SELECT a FROM t WHERE _id > ? AND name LIKE ?")
+	assert.Equal(t, err, nil)
+	for _, c := range []struct {
+		params  []*protocol.FieldValue
+		message string
+	}{
+		{[]*protocol.FieldValue{intValue(1)}, "expects 2 parameters, got 1"},
+		{[]*protocol.FieldValue{intValue(1), strValue("a"), strValue("b")}, "expects 2 parameters, got 3"},
+		{[]*protocol.FieldValue{strValue("1"), strValue("a")}, "parameter 1 expects"},
+		{[]*protocol.FieldValue{intValue(1), intValue(2)}, "parameter 2 expects"},
+	} {
+		_, err := stmt.Bind(c.params)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), c.message), err.Error())
+	}
+	// NULL is accepted for any type
+	_, err = stmt.Bind([]*protocol.FieldValue{nil, strValue("a%")})
+	assert.Equal(t, err, nil)
+
+	// a pattern is only checked once it is bound
+	stmt, err = Prepare("SELECT a FROM t WHERE a REGEXP ?")
+	assert.Equal(t, err, nil)
+	_, err = stmt.Bind([]*protocol.FieldValue{strValue("(")})
+	assert.NotEqual(t, err, nil)
+}
+
+func TestBindKeepsStatement(t *testing.T) {
+	sql := "SELECT a, ? AS c FROM t WHERE _id > ? AND b IN (SELECT x FROM u WHERE y = ?) ORDER BY a LIMIT 2"
+	stmt, err := Prepare(sql)
+	assert.Equal(t, err, nil)
+	prepared := stmt.Query.String()
+	for i := int64(0); i < 3; i++ {
+		query, err := stmt.Bind([]*protocol.FieldValue{strValue("x"), intValue(i), intValue(i)})
+		assert.Equal(t, err, nil)
+		_, ranges, err := GetIdCondition(query.Statement.(*SelectQuery).WhereExpression)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, ranges[0].Start, i+1)
+	}
+	// the prepared statement still holds its placeholders
+	assert.Equal(t, stmt.Query.String(), prepared)
+	selectQuery := stmt.Query.Statement.(*SelectQuery)
+	_, ok := selectQuery.ScalarList.ScalarList[1].Val.(*ParamNode)
+	assert.T(t, ok)
+}
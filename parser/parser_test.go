@@ -0,0 +1,282 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+type parseCase struct {
+	sql       string
+	queryType QueryType
+	table     string
+	valid     bool
+}
+
+// generateParseCases mixes every kind of statement, each one with its own
+// table name so a result handed to the wrong goroutine is noticed
+func generateParseCases(n int) []*parseCase {
+	cases := make([]*parseCase, 0, n)
+	for i := 0; len(cases) < n; i++ {
+		table := fmt.Sprintf("t%d", i)
+		cases = append(cases,
+			&parseCase{fmt.Sprintf("SELECT a, b + %d AS c FROM %s WHERE _id > %d AND name LIKE 'x%%' ORDER BY a DESC LIMIT 10", i, table, i), QUERY_SELECT, table, true},
+			&parseCase{fmt.Sprintf("INSERT INTO %s (a, b) VALUES (%d, 'v'), (NULL, 1.5)", table, i), QUERY_INSERT, table, true},
+			&parseCase{fmt.Sprintf("DELETE FROM %s WHERE _id IN (%d, %d)", table, i, i+1), QUERY_DELETE, table, true},
+			&parseCase{fmt.Sprintf("UPDATE %s SET a = a + %d WHERE b IS NOT NULL", table, i), QUERY_UPDATE, table, true},
+			&parseCase{fmt.Sprintf("CREATE TABLE %s INCREMENT", table), QUERY_SCHEMA_TABLE_CREATE, table, true},
+			&parseCase{fmt.Sprintf("CREATE TABLE %s (name STRING NOT NULL, age INT DEFAULT %d, score DOUBLE DEFAULT -1)", table, i), QUERY_SCHEMA_TABLE_CREATE, table, true},
+			&parseCase{fmt.Sprintf("CREATE TABLE %s (age INT DEFAULT 'x')", table), INVALID, table, false},
+			&parseCase{fmt.Sprintf("DROP TABLE %s", table), QUERY_SCHEMA_TABLE_DROP, table, true},
+			&parseCase{fmt.Sprintf("TRUNCATE TABLE %s", table), QUERY_SCHEMA_TABLE_TRUNCATE, table, true},
+			&parseCase{fmt.Sprintf("ALTER TABLE %s ADD COLUMN c%d", table, i), QUERY_SCHEMA_TABLE_ALTER, table, true},
+			&parseCase{fmt.Sprintf("ALTER TABLE %s ADD COLUMN d%d DOUBLE NOT NULL DEFAULT %d", table, i, i), QUERY_SCHEMA_TABLE_ALTER, table, true},
+			&parseCase{fmt.Sprintf("ALTER TABLE %s ADD COLUMN d%d INT DEFAULT 'x'", table, i), INVALID, table, false},
+			&parseCase{fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", table, table), QUERY_SCHEMA_TABLE_ALTER, table, true},
+			&parseCase{fmt.Sprintf("ALTER TABLE %s DROP _id", table), INVALID, table, false},
+			&parseCase{fmt.Sprintf("DESCRIBE %s", table), QUERY_SHOW, table, true},
+			&parseCase{"SHOW TABLES LIKE 't%'", QUERY_SHOW, "", true},
+			&parseCase{fmt.Sprintf("EXPLAIN ANALYZE DELETE FROM %s WHERE _id < %d", table, i), QUERY_EXPLAIN, table, true},
+			&parseCase{fmt.Sprintf("SELECT FROM %s WHERE", table), INVALID, table, false},
+		)
+	}
+	return cases[:n]
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range generateParseCases(29) {
+		query, err := Parse(c.sql)
+		if !c.valid {
+			assert.NotEqual(t, err, nil)
+			continue
+		}
+		assert.Equal(t, err, nil)
+		assert.Equal(t, query.Type, c.queryType)
+		assert.Equal(t, query.Statement.GetTableName(), c.table)
+	}
+}
+
+func TestAlterTableAddColumn(t *testing.T) {
+	query, err := Parse("ALTER TABLE t ADD COLUMN c")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*AlterTableQuery).GetColumn(), &protocol.Column{Name: "c"})
+
+	query, err = Parse("ALTER TABLE t ADD COLUMN c INT NOT NULL DEFAULT -1")
+	assert.Equal(t, err, nil)
+	alter := query.Statement.(*AlterTableQuery)
+	assert.Equal(t, alter.Column, "c")
+	column := alter.GetColumn()
+	assert.Equal(t, column.Type, protocol.INT)
+	assert.T(t, column.NotNull)
+	assert.Equal(t, column.Default.GetIntVal(), int64(-1))
+	assert.Equal(t, query.Format(), "ALTER TABLE t ADD COLUMN c INT NOT NULL DEFAULT -1")
+
+	for _, sql := range []string{
+		"ALTER TABLE t ADD COLUMN c CHAR",
+		"ALTER TABLE t ADD COLUMN _id INT",
+		"ALTER TABLE t ADD c INT",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil, sql)
+	}
+}
+
+func TestParseDistinct(t *testing.T) {
+	for sql, distinct := range map[string]bool{
+		"SELECT a FROM t":                                     false,
+		"SELECT DISTINCT a FROM t":                            true,
+		"select distinct a, b FROM t ORDER BY b LIMIT 2":      true,
+		"SELECT DISTINCT * FROM t WHERE a > 1 OFFSET 3":       true,
+		"SELECT DISTINCT a + 1 AS b FROM t ORDER BY b":        true,
+		"SELECT DISTINCT city, COUNT(*) FROM t GROUP BY city": true,
+	} {
+		query, err := Parse(sql)
+		assert.Equal(t, err, nil, sql)
+		assert.Equal(t, query.Statement.(*SelectQuery).Distinct, distinct, sql)
+	}
+
+	for _, sql := range []string{
+		"SELECT DISTINCT FROM t",
+		"SELECT a DISTINCT FROM t",
+		"SELECT DISTINCT DISTINCT a FROM t",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil, sql)
+	}
+}
+
+func TestSelectAliases(t *testing.T) {
+	for _, c := range []struct {
+		sql    string
+		names  []string
+		fields []string
+	}{
+		{"SELECT a, b FROM t", []string{"a", "b"}, []string{"a", "b"}},
+		{"SELECT name AS n, 1 AS one, price * 2 AS double_price FROM t", []string{"n", "one", "double_price"}, []string{"name", "price"}},
+		// the same column may be selected twice under different names
+		{"SELECT a AS p1, a AS p2, a FROM t", []string{"p1", "p2", "a"}, []string{"a"}},
+		// constants are selected without reading any column
+		{"SELECT 1, 'x' AS s, NULL FROM t", []string{"1", "s", "NULL"}, []string{}},
+		{"SELECT COUNT(*) AS total, city FROM t GROUP BY city", []string{"total", "city"}, []string{"city"}},
+	} {
+		query, err := Parse(c.sql)
+		assert.Equal(t, err, nil, c.sql)
+		selectQuery := query.Statement.(*SelectQuery)
+		names := make([]string, 0, len(selectQuery.ScalarList.ScalarList))
+		for _, scalar := range selectQuery.ScalarList.ScalarList {
+			names = append(names, scalar.Name())
+		}
+		assert.Equal(t, names, c.names, c.sql)
+		fields := selectQuery.GetSelectFields()
+		sort.Strings(fields)
+		assert.Equal(t, fields, c.fields, c.sql)
+	}
+
+	for _, sql := range []string{
+		"SELECT a AS FROM t",
+		"SELECT a AS 1 FROM t",
+		"SELECT a AS b AS c FROM t",
+		"SELECT * AS x FROM t",
+		"SELECT a FROM t WHERE a AS b = 1",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil, sql)
+	}
+}
+
+// TestParseConcurrently is meant to run with -race
+func TestParseConcurrently(t *testing.T) {
+	cases := generateParseCases(400)
+	workers := 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(cases))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(cases); i += workers {
+				c := cases[i]
+				query, err := Parse(c.sql)
+				if !c.valid {
+					if err == nil {
+						errs <- fmt.Errorf("%s: expected an error", c.sql)
+					}
+					continue
+				}
+				if err != nil {
+					errs <- fmt.Errorf("%s: %s", c.sql, err)
+				} else if query.Type != c.queryType || query.Statement.GetTableName() != c.table {
+					errs <- fmt.Errorf("%s: got %v on table %s", c.sql, query.Type, query.Statement.GetTableName())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestNonReservedKeywords(t *testing.T) {
+	for _, c := range []struct {
+		sql    string
+		format string
+	}{
+		{"SELECT status, tables AS Databases FROM t WHERE status = 1 ORDER BY status",
+			"SELECT status, tables AS Databases FROM t WHERE status = 1 ORDER BY status"},
+		{"SELECT t.status FROM t JOIN status ON t.to = status._id",
+			"SELECT t.status FROM t JOIN status ON t.to = status._id"},
+		{"INSERT INTO t (add, rename) VALUES (1, 2)", "INSERT INTO t (add, rename) VALUES (1, 2)"},
+		{"UPDATE t SET default = 1 WHERE to > 2", "UPDATE t SET default = 1 WHERE to > 2"},
+		{"CREATE TABLE status (default INT DEFAULT 1, column STRING)",
+			"CREATE TABLE status (default INT DEFAULT 1, column STRING)"},
+		{"ALTER TABLE t ADD column", "ALTER TABLE t ADD COLUMN column"},
+		{"ALTER TABLE t ADD COLUMN to", "ALTER TABLE t ADD COLUMN to"},
+		{"ALTER TABLE t DROP COLUMN column", "ALTER TABLE t DROP COLUMN column"},
+		{"ALTER TABLE t RENAME TO tables", "ALTER TABLE t RENAME TO tables"},
+		{"DESCRIBE status", "DESCRIBE status"},
+		{"SHOW TABLE STATUS", "SHOW TABLE STATUS"},
+		{"SELECT timestamp, interval FROM t WHERE timestamp > TIMESTAMP '2014-05-01T00:00:00Z'",
+			"SELECT timestamp, interval FROM t WHERE timestamp > TIMESTAMP '2014-05-01T00:00:00Z'"},
+		{"SELECT timestamp.interval FROM timestamp JOIN u ON timestamp._id = u.interval ORDER BY timestamp.interval DESC",
+			"SELECT timestamp.interval FROM timestamp JOIN u ON timestamp._id = u.interval ORDER BY timestamp.interval DESC"},
+		{"CREATE TABLE interval (timestamp TIMESTAMP NOT NULL, interval INT)",
+			"CREATE TABLE interval (timestamp TIMESTAMP NOT NULL, interval INT)"},
+		{"UPDATE t SET timestamp = TIMESTAMP '2014-05-01T00:00:00Z' + INTERVAL '1h'",
+			"UPDATE t SET timestamp = TIMESTAMP '2014-05-01T00:00:00Z' + INTERVAL '1h0m0s'"},
+	} {
+		query, err := Parse(c.sql)
+		assert.Equal(t, err, nil, c.sql)
+		assert.Equal(t, query.Format(), c.format)
+	}
+	// reserved keywords still have to be quoted
+	_, err := Parse("SELECT select FROM t")
+	assert.NotEqual(t, err, nil)
+	query, err := Parse("SELECT `select` FROM t")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query.Statement.(*SelectQuery).ScalarList.ScalarList[0].Val, "select")
+}
+
+func TestLikePattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"a%", "a", true},
+		{"a%", "abc\ndef", true},
+		{"%c", "abc", true},
+		{"a%c", "ab", false},
+		{"a_c", "abc", true},
+		{"a_c", "ac", false},
+		{"a_c", "aéc", true},
+		{"100\\%", "100%", true},
+		{"100\\%", "1000", false},
+		{"a\\_c", "a_c", true},
+		{"a\\_c", "abc", false},
+		{"a\\\\b", "a\\b", true},
+		// regexp metacharacters only match themselves
+		{"a.c", "abc", false},
+		{"a.c", "a.c", true},
+		{"(x)+[y]*$^|", "(x)+[y]*$^|", true},
+		{"(x)+", "xx", false},
+		// a trailing backslash has nothing to escape, it matches itself
+		{"a\\", "a\\", true},
+		{"a\\", "a", false},
+	} {
+		expr := newPatternExpression(NewFieldLiteral(strValue(c.pattern)), true)
+		assert.Equal(t, expr.Err, nil, c.pattern)
+		assert.Equal(t, expr.Match(NewFieldLiteral(strValue(c.value))), c.match, c.pattern+" ~ "+c.value)
+	}
+	// only strings match
+	expr := newPatternExpression(NewFieldLiteral(strValue("1%")), true)
+	assert.T(t, !expr.Match(newIntNode(12)))
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	for pattern, prefix := range map[string]string{
+		"abc":     "abc",
+		"abc%":    "abc",
+		"ab_c%":   "ab",
+		"%abc":    "",
+		"a\\%b%":  "a%b",
+		"a\\_%":   "a_",
+		"a.b*%":   "a.b*",
+		"a\\\\b%": "a\\b",
+		"a\\":     "a\\",
+	} {
+		expr := newPatternExpression(NewFieldLiteral(strValue(pattern)), true)
+		assert.Equal(t, expr.LiteralPrefix(), prefix, pattern)
+	}
+	// a REGEXP has no literal prefix to narrow a scan to
+	expr := newPatternExpression(NewFieldLiteral(strValue("abc")), false)
+	assert.Equal(t, expr.LiteralPrefix(), "")
+}
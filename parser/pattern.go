@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// PatternExpression is the right side of LIKE and REGEXP. The pattern is
+// compiled once when the query is parsed and shared by every record.
+type PatternExpression struct {
+	Pattern string
+	IsLike  bool
+	Regexp  *regexp.Regexp
+	Err     error
+	// Param is the placeholder of a prepared pattern, compiled once it is bound
+	Param *ParamNode
+}
+
+func newPatternExpression(pattern LiteralNode, isLike bool) *PatternExpression {
+	if param, ok := pattern.(*ParamNode); ok {
+		return &PatternExpression{IsLike: isLike, Param: param}
+	}
+	if pattern.GetType() != protocol.STRING {
+		return &PatternExpression{
+			IsLike: isLike,
+			Err:    fmt.Errorf("syntax error: pattern %v is not a STRING", pattern.GetVal().GetValue()),
+		}
+	}
+	expr := &PatternExpression{
+		Pattern: pattern.GetVal().GetStrVal(),
+		IsLike:  isLike,
+	}
+	source := expr.Pattern
+	if isLike {
+		source = likeToRegexp(expr.Pattern)
+	}
+	expr.Regexp, expr.Err = regexp.Compile(source)
+	return expr
+}
+
+// likeToRegexp translates % and _ into an anchored regexp, a backslash
+// makes the next character literal and a trailing one matches itself
+func likeToRegexp(pattern string) string {
+	buf := bytes.NewBufferString("(?s)^")
+	escaped := false
+	for _, c := range pattern {
+		if escaped {
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '%':
+			buf.WriteString(".*")
+		case '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if escaped {
+		buf.WriteString(regexp.QuoteMeta("\\"))
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// LiteralPrefix returns the fixed prefix every value matching a LIKE pattern
+// starts with, so a scan over an index on the column can be narrowed to it
+func (self *PatternExpression) LiteralPrefix() string {
+	if !self.IsLike || self.Err != nil {
+		return ""
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(self.Pattern)))
+	escaped := false
+	for _, c := range self.Pattern {
+		if escaped {
+			buf.WriteRune(c)
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '%', '_':
+			return buf.String()
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	if escaped {
+		buf.WriteRune('\\')
+	}
+	return buf.String()
+}
+
+func (self *PatternExpression) Match(value LiteralNode) bool {
+	if value.GetType() != protocol.STRING {
+		return false
+	}
+	return self.Regexp.MatchString(value.GetVal().GetStrVal())
+}
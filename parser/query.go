@@ -3,6 +3,9 @@ package parser
 import (
 	"fmt"
 
+	"github.com/senarukana/fundb/protocol"
+	"github.com/senarukana/fundb/util"
+
 	"github.com/golang/glog"
 )
 
@@ -15,6 +18,11 @@ const (
 	QUERY_INSERT
 	QUERY_UPDATE
 	QUERY_SCHEMA_TABLE_CREATE
+	QUERY_SCHEMA_TABLE_DROP
+	QUERY_SCHEMA_TABLE_TRUNCATE
+	QUERY_SCHEMA_TABLE_ALTER
+	QUERY_SHOW
+	QUERY_EXPLAIN
 )
 
 func (self QueryType) String() string {
@@ -29,39 +37,112 @@ func (self QueryType) String() string {
 		return "QUERY_UPDATE"
 	case QUERY_SCHEMA_TABLE_CREATE:
 		return "QUERY_SCHEMA_TABLE_CREATE"
+	case QUERY_SCHEMA_TABLE_DROP:
+		return "QUERY_SCHEMA_TABLE_DROP"
+	case QUERY_SCHEMA_TABLE_TRUNCATE:
+		return "QUERY_SCHEMA_TABLE_TRUNCATE"
+	case QUERY_SCHEMA_TABLE_ALTER:
+		return "QUERY_SCHEMA_TABLE_ALTER"
+	case QUERY_SHOW:
+		return "QUERY_SHOW"
+	case QUERY_EXPLAIN:
+		return "QUERY_EXPLAIN"
 	default:
 		return "INVALID"
 	}
 }
 
-type ParserError struct {
-	Message string
+// Statement is the parsed form of one kind of statement
+type Statement interface {
+	Validate() error
+	GetTableName() string
+	// Format prints the statement as canonical SQL, which parses back to it
+	Format() string
 }
 
-func NewParserError(format string, args ...interface{}) ParserError {
-	return ParserError{fmt.Sprintf(format, args...)}
-}
+// ConflictAction is what an insert does when the _id of a record it writes
+// already exists
+type ConflictAction int
 
-func (err ParserError) Error() string {
-	return err.Message
-}
+const (
+	// CONFLICT_FAIL fails the insert, nothing is written
+	CONFLICT_FAIL ConflictAction = iota
+	// CONFLICT_UPDATE overwrites the inserted columns and keeps the others,
+	// ON CONFLICT(_id) DO UPDATE
+	CONFLICT_UPDATE
+	// CONFLICT_REPLACE deletes the existing record first, REPLACE INTO
+	CONFLICT_REPLACE
+)
 
-type Query interface {
-	Validate() error
-	GetSplitIds(splitField string) (ids []int64)
-	GetTableName() string
+func (self ConflictAction) String() string {
+	switch self {
+	case CONFLICT_UPDATE:
+		return "ON CONFLICT(_id) DO UPDATE"
+	case CONFLICT_REPLACE:
+		return "REPLACE"
+	default:
+		return "FAIL"
+	}
 }
 
+// InsertQuery writes the rows of ValueList, or of Select for INSERT ... SELECT
 type InsertQuery struct {
 	Table string
 	*ColumnFields
 	*ValueList
+	Select     *SelectQuery
+	OnConflict ConflictAction
+	// ConflictColumn is the column of ON CONFLICT (column), only _id is unique
+	ConflictColumn string
+}
+
+// NewInsertQuery builds an insert of values or of selectQuery, conflictColumn
+// is set by ON CONFLICT (column) DO UPDATE
+func NewInsertQuery(table string, fields *ColumnFields, values *ValueList, selectQuery *SelectQuery, conflictColumn string) *InsertQuery {
+	query := &InsertQuery{
+		Table:          table,
+		ColumnFields:   fields,
+		ValueList:      values,
+		Select:         selectQuery,
+		ConflictColumn: conflictColumn,
+	}
+	if conflictColumn != "" {
+		query.OnConflict = CONFLICT_UPDATE
+	}
+	return query
+}
+
+// IsReservedColumn tells the columns every table has, _id and the
+// _timestamp pseudo-column
+func IsReservedColumn(name string) bool {
+	return name == "_id" || name == TIMESTAMP_COLUMN
 }
 
 func (self *InsertQuery) Validate() error {
-	if len(self.Values[0].Items) != len(self.Fields) {
+	var fields []string
+	if self.ColumnFields != nil {
+		fields = self.Fields
+	}
+	for _, field := range fields {
+		if field == TIMESTAMP_COLUMN {
+			return fmt.Errorf("syntax error: %s is set by the database", field)
+		}
+	}
+	if self.ConflictColumn != "" && self.ConflictColumn != "_id" {
+		return fmt.Errorf("syntax error: ON CONFLICT only supports _id, %s isn't unique", self.ConflictColumn)
+	}
+	if self.Select != nil {
+		return self.validateSelect(fields)
+	}
+	if fields == nil {
+		return fmt.Errorf("syntax error: INSERT ... VALUES needs the list of columns inserted")
+	}
+	if self.OnConflict != CONFLICT_FAIL && !util.NewStringSetFromStrings(fields).Exists("_id") {
+		return fmt.Errorf("syntax error: %s needs the _id of the records inserted", self.OnConflict)
+	}
+	if len(self.Values[0].Items) != len(fields) {
 		return fmt.Errorf("syntax error: Incompatible fields(%d) and values(%d)",
-			len(self.Values[0].Items), len(self.Fields))
+			len(self.Values[0].Items), len(fields))
 	}
 
 	var paramCount = -1
@@ -78,6 +159,55 @@ func (self *InsertQuery) Validate() error {
 	return nil
 }
 
+// validateSelect checks the select list of INSERT ... SELECT against the
+// columns inserted, the columns of SELECT * are only known when it runs
+func (self *InsertQuery) validateSelect(fields []string) error {
+	if err := self.Select.Validate(); err != nil {
+		return err
+	}
+	if self.Select.IsStar {
+		return nil
+	}
+	names := make([]string, len(self.Select.ScalarList.ScalarList))
+	for i, scalar := range self.Select.ScalarList.ScalarList {
+		names[i] = scalar.Name()
+	}
+	if fields != nil && len(fields) != len(names) {
+		return fmt.Errorf("syntax error: Incompatible fields(%d) and selected values(%d)", len(fields), len(names))
+	}
+	fieldSet := util.NewStringSet()
+	for _, field := range self.GetSelectFields(names) {
+		if field == TIMESTAMP_COLUMN {
+			return fmt.Errorf("syntax error: %s is set by the database", field)
+		}
+		if fieldSet.Exists(field) {
+			return fmt.Errorf("syntax error: field %s is inserted more than once", field)
+		}
+		fieldSet.Insert(field)
+	}
+	if !fieldSet.Exists("_id") {
+		return fmt.Errorf("syntax error: INSERT ... SELECT needs _id among the selected columns")
+	}
+	return nil
+}
+
+// GetSelectFields returns the columns the rows of INSERT ... SELECT are
+// written to, given the columns selected: the column list of the insert if
+// any, otherwise the selected columns, a.x of a join is written to x
+func (self *InsertQuery) GetSelectFields(names []string) []string {
+	if self.ColumnFields != nil {
+		return self.Fields
+	}
+	fields := make([]string, len(names))
+	for i, name := range names {
+		fields[i] = name
+		if isQualifiedColumn(name) {
+			_, fields[i] = SplitColumn(name)
+		}
+	}
+	return fields
+}
+
 func (self *InsertQuery) GetSplitIds(splitField string) (ids []int64) {
 	idx := -1
 	for i, field := range self.Fields {
@@ -104,32 +234,344 @@ type SelectQuery struct {
 	Distinct bool
 	*SelectExpression
 	*TableExpression
+	GroupBy *ColumnFields
+	Having  *WhereExpression
 	*OrderByList
-	Limit int
+	Limit  int
+	Offset int
+}
+
+func (self *SelectQuery) IsAggregate() bool {
+	return self.GroupBy != nil || self.Having != nil || len(self.GetAggregates()) > 0
+}
+
+func (self *SelectQuery) Validate() error {
+	if err := self.checkColumns(); err != nil {
+		return err
+	}
+	if self.ScalarList != nil {
+		for _, scalar := range self.ScalarList.ScalarList {
+			if err := scalar.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if self.WhereExpression != nil {
+		if self.WhereExpression.HasAggregate() {
+			return fmt.Errorf("syntax error: aggregate functions are not allowed in WHERE")
+		}
+		if err := self.WhereExpression.validate(); err != nil {
+			return err
+		}
+	}
+	if self.Having != nil {
+		if err := self.Having.validate(); err != nil {
+			return err
+		}
+	}
+	if !self.IsAggregate() {
+		return nil
+	}
+
+	if self.IsStar {
+		return fmt.Errorf("syntax error: SELECT * can't be used with aggregate functions or GROUP BY")
+	}
+	groupFields := util.NewStringSet()
+	if self.GroupBy != nil {
+		groupFields = util.NewStringSetFromStrings(self.GroupBy.Fields)
+	}
+	// outside of aggregate calls only the grouped columns have a single value per group
+	columnSet := util.NewStringSet()
+	for _, scalar := range self.ScalarList.ScalarList {
+		scalar.getFields(columnSet, true)
+	}
+	if self.Having != nil {
+		self.Having.getConditionFields(columnSet, true)
+	}
+	self.getOrderByFields(columnSet)
+	for _, field := range columnSet.ConvertToStrings() {
+		if !groupFields.Exists(field) {
+			return fmt.Errorf("syntax error: field %s must appear in GROUP BY or be used in an aggregate function", field)
+		}
+	}
+	return nil
+}
+
+// After returns a copy of the query reading at most limit rows with an _id
+// greater than cursor, the next page of an _id ordered query
+func (self *SelectQuery) After(cursor int64, limit int) *SelectQuery {
+	query := *self
+	condition := NewComparisonExpression(Token{Src: ">"}, &Scalar{Type: SCALAR_IDENT, Val: "_id"},
+		&Scalar{Type: SCLAR_LITERAL, Val: newIntNode(cursor)})
+	if self.WhereExpression != nil {
+		condition = &WhereExpression{self.WhereExpression, condition, WHERE_AND, Token{Src: "AND"}}
+	}
+	query.TableExpression = &TableExpression{self.FromExpression, condition}
+	query.Limit = limit
+	return &query
 }
 
 type DeleteQuery struct {
 	*TableExpression
 }
 
+func (self *DeleteQuery) Validate() error {
+	if self.Join != nil {
+		return fmt.Errorf("syntax error: JOIN is only supported in SELECT")
+	}
+	if self.WhereExpression != nil {
+		if err := self.checkColumns(self.WhereExpression.GetConditionFields()); err != nil {
+			return err
+		}
+		return self.WhereExpression.validate()
+	}
+	return nil
+}
+
+type UpdateQuery struct {
+	*TableExpression
+	*AssignmentList
+}
+
+func (self *UpdateQuery) Validate() error {
+	fields := make(map[string]bool)
+	for _, assignment := range self.Assignments {
+		if IsReservedColumn(assignment.Field) {
+			return fmt.Errorf("syntax error: %s can't be updated", assignment.Field)
+		}
+		if fields[assignment.Field] {
+			return fmt.Errorf("syntax error: field %s is assigned more than once", assignment.Field)
+		}
+		fields[assignment.Field] = true
+		if assignment.Val.HasAggregate() {
+			return fmt.Errorf("syntax error: aggregate functions are not allowed in UPDATE")
+		}
+		if err := assignment.Val.Validate(); err != nil {
+			return err
+		}
+		if err := self.checkColumns(assignment.Val.GetFields()); err != nil {
+			return err
+		}
+	}
+	if self.WhereExpression != nil {
+		if self.WhereExpression.HasAggregate() {
+			return fmt.Errorf("syntax error: aggregate functions are not allowed in WHERE")
+		}
+		if err := self.checkColumns(self.WhereExpression.GetConditionFields()); err != nil {
+			return err
+		}
+		return self.WhereExpression.validate()
+	}
+	return nil
+}
+
+func (self *UpdateQuery) GetUpdateFields() []string {
+	fields := make([]string, 0, len(self.Assignments))
+	for _, assignment := range self.Assignments {
+		fields = append(fields, assignment.Field)
+	}
+	return fields
+}
+
+// CreateTableQuery creates a schemaless table unless Columns are given
 type CreateTableQuery struct {
+	Name    string
+	Type    TableIdType
+	Columns []*ColumnDef
+}
+
+func (self *CreateTableQuery) Validate() error {
+	columnSet := util.NewStringSet()
+	for _, column := range self.Columns {
+		if column.Err != nil {
+			return column.Err
+		}
+		if IsReservedColumn(column.Name) {
+			return fmt.Errorf("column %s can't be defined", column.Name)
+		}
+		if columnSet.Exists(column.Name) {
+			return fmt.Errorf("column %s defined twice", column.Name)
+		}
+		columnSet.Insert(column.Name)
+	}
+	return nil
+}
+
+// GetSchema is nil for a schemaless table
+func (self *CreateTableQuery) GetSchema() protocol.Schema {
+	if self.Columns == nil {
+		return nil
+	}
+	schema := make(protocol.Schema, len(self.Columns))
+	for i, column := range self.Columns {
+		schema[i] = column.Column
+	}
+	return schema
+}
+
+func (self *CreateTableQuery) GetTableName() string {
+	return self.Name
+}
+
+type DropTableQuery struct {
 	Name string
-	Type TableIdType
 }
 
-type QuerySpec struct {
-	Type  QueryType
-	Query Query
+func (self *DropTableQuery) Validate() error {
+	return nil
+}
+
+func (self *DropTableQuery) GetTableName() string {
+	return self.Name
+}
+
+// TruncateTableQuery removes every record but keeps the table and its columns
+type TruncateTableQuery struct {
+	Name string
+}
+
+func (self *TruncateTableQuery) Validate() error {
+	return nil
+}
+
+func (self *TruncateTableQuery) GetTableName() string {
+	return self.Name
 }
 
-func ParseQuery(query string) (*Query, error) {
-	lex := NewLex(query)
+type AlterType int
+
+const (
+	ALTER_ADD_COLUMN AlterType = iota
+	ALTER_DROP_COLUMN
+	ALTER_RENAME
+)
+
+// AlterTableQuery is one change of ALTER TABLE, Column is set when adding or
+// dropping a column and NewName when renaming the table
+type AlterTableQuery struct {
+	Name    string
+	Type    AlterType
+	Column  string
+	NewName string
+	// Definition is the type and constraints of the column added, a typed
+	// table needs one. It is nil when only a name was given.
+	Definition *ColumnDef
+}
+
+func (self *AlterTableQuery) Validate() error {
+	switch self.Type {
+	case ALTER_ADD_COLUMN, ALTER_DROP_COLUMN:
+		if IsReservedColumn(self.Column) {
+			return fmt.Errorf("column %s can't be added or dropped", self.Column)
+		}
+		if self.Definition != nil && self.Definition.Err != nil {
+			return self.Definition.Err
+		}
+	case ALTER_RENAME:
+		if self.NewName == self.Name {
+			return fmt.Errorf("table %s is already named %s", self.Name, self.NewName)
+		}
+	}
+	return nil
+}
+
+func (self *AlterTableQuery) GetTableName() string {
+	return self.Name
+}
+
+// GetColumn is the column added, its type is NULL when none was given
+func (self *AlterTableQuery) GetColumn() *protocol.Column {
+	if self.Definition != nil {
+		return self.Definition.Column
+	}
+	return &protocol.Column{Name: self.Column}
+}
+
+type ShowType int
+
+const (
+	SHOW_DATABASES ShowType = iota
+	SHOW_TABLES
+	SHOW_COLUMNS
+	SHOW_TABLE_STATUS
+)
+
+// ShowQuery is SHOW DATABASES, SHOW TABLES, SHOW TABLE STATUS and DESCRIBE,
+// Table is only set for DESCRIBE and Like filters the names listed by the others
+type ShowQuery struct {
+	Type  ShowType
+	Table string
+	Like  *PatternExpression
+}
+
+func (self *ShowQuery) Validate() error {
+	if self.Like != nil {
+		return self.Like.Err
+	}
+	return nil
+}
+
+func (self *ShowQuery) GetTableName() string {
+	return self.Table
+}
+
+// MatchName reports whether a database or table is listed
+func (self *ShowQuery) MatchName(name string) bool {
+	return self.Like == nil || self.Like.Regexp.MatchString(name)
+}
+
+// ExplainQuery returns the plan of a SELECT or DELETE instead of its result,
+// with Analyze the query is run and every step of the plan is measured
+type ExplainQuery struct {
+	Analyze bool
+	Query   *Query
+}
+
+func (self *ExplainQuery) Validate() error {
+	return self.Query.Validate()
+}
+
+func (self *ExplainQuery) GetTableName() string {
+	return self.Query.Statement.GetTableName()
+}
+
+// Query is a parsed statement together with its kind
+type Query struct {
+	Type      QueryType
+	Statement Statement
+}
+
+func (self *Query) Validate() error {
+	return self.Statement.Validate()
+}
+
+// parse runs the grammar over sql, every state of a parse lives in its own
+// Lex, so concurrent parses don't share anything
+func parse(sql string) (*Query, *Lex, error) {
+	lex := NewLex(sql)
 	if FunDBParse(lex) != 0 {
-		return nil, NewParserError(lex.LastError)
+		return nil, nil, lex.syntaxError()
+	}
+	if len(lex.unnegatedInts) > 0 {
+		lex.literalError(lex.unnegatedInts[0].tok, fmt.Errorf("number %s is out of range", minIntMagnitude))
+	}
+	if lex.literalErr != nil {
+		return nil, nil, lex.literalErr
+	}
+	return lex.query, lex, nil
+}
+
+// Parse parses and validates a single statement, it is safe for concurrent use
+func Parse(sql string) (*Query, error) {
+	query, lex, err := parse(sql)
+	if err != nil {
+		return nil, err
+	}
+	if lex.hasParams() {
+		return nil, NewParserError("syntax error: query has parameters, it has to be prepared")
 	}
-	parsedQuery := ParsedQuery
-	if err := parsedQuery.Validate(); err != nil {
+	if err := query.Validate(); err != nil {
 		return nil, err
 	}
-	return parsedQuery, nil
+	return query, nil
 }
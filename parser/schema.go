@@ -0,0 +1,55 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// ColumnDef is a column of CREATE TABLE t (...). An error in the definition
+// is kept in Err and reported by Validate, like the pattern of a LIKE.
+type ColumnDef struct {
+	*protocol.Column
+	Err error
+}
+
+func NewColumnDef(name, typeName string) *ColumnDef {
+	fieldType, err := protocol.ParseFieldType(typeName)
+	return &ColumnDef{
+		Column: &protocol.Column{Name: name, Type: fieldType},
+		Err:    err,
+	}
+}
+
+func (self *ColumnDef) setErr(err error) {
+	if self.Err == nil {
+		self.Err = err
+	}
+}
+
+// setDefault stores the default already coerced to the column type
+func (self *ColumnDef) setDefault(value LiteralNode) {
+	if _, ok := value.(*ParamNode); ok {
+		self.setErr(fmt.Errorf("syntax error: DEFAULT of column %s can't be a parameter", self.Name))
+		return
+	}
+	if IsNull(value) {
+		self.Default = nil
+		return
+	}
+	val, err := self.Coerce(value.GetVal())
+	if err != nil {
+		self.setErr(fmt.Errorf("invalid DEFAULT: %s", err))
+		return
+	}
+	self.Default = val
+}
+
+func (self *ColumnDef) setNegativeDefault(value LiteralNode) {
+	val, err := Arithmetic(UMINUS, value, nil)
+	if err != nil {
+		self.setErr(fmt.Errorf("invalid DEFAULT: %s", err))
+		return
+	}
+	self.setDefault(val)
+}
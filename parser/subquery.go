@@ -0,0 +1,171 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// SubqueryRowLimit caps the rows an IN subquery may return, its result is
+// kept in memory for the whole outer query
+var SubqueryRowLimit = 100000
+
+// Subquery is an uncorrelated SELECT of IN (SELECT ...) or EXISTS (SELECT ...).
+// It runs once before the outer query, Result is only set on the condition
+// ResolveSubqueries returns, so a parsed query can be run again.
+type Subquery struct {
+	Query  *SelectQuery
+	Result *SubqueryResult
+}
+
+// SubqueryResult is the set of values an IN subquery returned, EXISTS only
+// uses the number of rows
+type SubqueryResult struct {
+	Rows    int
+	values  map[string]bool
+	hasNull bool
+}
+
+// SubqueryFetcher runs the inner query of a subquery, e.g. StoreEngine.Fetch
+type SubqueryFetcher func(query *SelectQuery) (*protocol.RecordList, error)
+
+func (self *Subquery) String() string {
+	return self.Format()
+}
+
+func (self *Subquery) Format() string {
+	return self.Query.Format()
+}
+
+func (self *Subquery) validate(isIn bool) error {
+	if isIn && (self.Query.IsStar || len(self.Query.ScalarList.ScalarList) != 1) {
+		return fmt.Errorf("syntax error: the subquery of IN must select exactly one column")
+	}
+	return self.Query.Validate()
+}
+
+// HashKey is the same for the values Equal holds equal, an INT and a DOUBLE
+// of the same number included
+func HashKey(node LiteralNode) string {
+	switch node.GetType() {
+	case protocol.INT:
+		return fmt.Sprintf("n%d", node.GetVal().GetIntVal())
+	case protocol.DOUBLE:
+		val := node.GetVal().GetDoubleVal()
+		if val == math.Trunc(val) && math.Abs(val) < math.MaxInt64 {
+			return fmt.Sprintf("n%d", int64(val))
+		}
+		return fmt.Sprintf("d%v", val)
+	}
+	return fmt.Sprintf("%d:%v", node.GetType(), node.GetVal().GetValue())
+}
+
+// Contains probes the set for IN, the result is unknown when the value is
+// NULL or isn't found but the set has a NULL
+func (self *SubqueryResult) Contains(node LiteralNode) (found bool, unknown bool) {
+	if self.Rows == 0 {
+		return false, false
+	}
+	if IsNull(node) {
+		return false, true
+	}
+	if self.values[HashKey(node)] {
+		return true, false
+	}
+	return false, self.hasNull
+}
+
+func (self *SubqueryResult) Exists() bool {
+	return self.Rows > 0
+}
+
+func runSubquery(subquery *Subquery, exists bool, fetch SubqueryFetcher) (*SubqueryResult, error) {
+	query := *subquery.Query
+	if exists {
+		// one row tells
+		if !query.IsAggregate() && query.Limit == -1 {
+			query.Limit = 1
+		}
+	} else if query.Limit == -1 || query.Limit > SubqueryRowLimit {
+		// one more row than allowed is enough to know the cap is exceeded
+		query.Limit = SubqueryRowLimit + 1
+	}
+	res, err := fetch(&query)
+	if err != nil {
+		return nil, err
+	}
+	result := &SubqueryResult{Rows: len(res.Values)}
+	if exists {
+		return result, nil
+	}
+	if result.Rows > SubqueryRowLimit || res.GetTruncated() {
+		return nil, fmt.Errorf("subquery on %s returned more than %d rows, narrow it with a WHERE or a LIMIT",
+			query.Table, SubqueryRowLimit)
+	}
+	result.values = make(map[string]bool, result.Rows)
+	for _, record := range res.Values {
+		value := NewFieldLiteral(record.Values[0])
+		if IsNull(value) {
+			result.hasNull = true
+		} else {
+			result.values[HashKey(value)] = true
+		}
+	}
+	return result, nil
+}
+
+// ResolveSubqueries runs every subquery of condition once with fetch and
+// returns a copy of condition holding their results, the nodes without a
+// subquery are shared. A condition without subqueries is returned as is.
+func ResolveSubqueries(condition *WhereExpression, fetch SubqueryFetcher) (*WhereExpression, error) {
+	if condition == nil {
+		return nil, nil
+	}
+	switch condition.Type {
+	case WHERE_AND, WHERE_OR:
+		left, err := ResolveSubqueries(condition.Left.(*WhereExpression), fetch)
+		if err != nil {
+			return nil, err
+		}
+		right, err := ResolveSubqueries(condition.Right.(*WhereExpression), fetch)
+		if err != nil {
+			return nil, err
+		}
+		if left == condition.Left && right == condition.Right {
+			return condition, nil
+		}
+		return &WhereExpression{left, right, condition.Type, condition.Token}, nil
+	case WHERE_NOT:
+		inner, err := ResolveSubqueries(condition.Left.(*WhereExpression), fetch)
+		if err != nil {
+			return nil, err
+		}
+		if inner == condition.Left {
+			return condition, nil
+		}
+		return &WhereExpression{inner, nil, WHERE_NOT, condition.Token}, nil
+	case WHERE_IN_SUBQUERY, WHERE_EXISTS:
+		subquery := condition.Right.(*Subquery)
+		result, err := runSubquery(subquery, condition.Type == WHERE_EXISTS, fetch)
+		if err != nil {
+			return nil, err
+		}
+		return &WhereExpression{condition.Left, &Subquery{subquery.Query, result}, condition.Type, condition.Token}, nil
+	}
+	return condition, nil
+}
+
+// NewInSubqueryExpression builds field IN (SELECT ...), NOT IN is a WHERE_NOT around it
+func NewInSubqueryExpression(token Token, left *Scalar, query *SelectQuery) *WhereExpression {
+	var leftExpr interface{} = left
+	if left.Type == SCALAR_IDENT {
+		leftExpr = left.Val.(string)
+	}
+	return &WhereExpression{
+		Type:  WHERE_IN_SUBQUERY,
+		Left:  leftExpr,
+		Right: &Subquery{Query: query},
+		Token: token,
+	}
+}
@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+// fakeFetch returns values as a single column and counts its calls
+func fakeFetch(values []*protocol.FieldValue, calls *int) SubqueryFetcher {
+	return func(query *SelectQuery) (*protocol.RecordList, error) {
+		*calls++
+		records := make([]*protocol.Record, 0, len(values))
+		for _, value := range values {
+			if query.Limit != -1 && len(records) == query.Limit {
+				break
+			}
+			records = append(records, &protocol.Record{Values: []*protocol.FieldValue{value}})
+		}
+		return &protocol.RecordList{Name: &query.Table, Values: records}, nil
+	}
+}
+
+func intValue(val int64) *protocol.FieldValue {
+	return &protocol.FieldValue{IntVal: &val}
+}
+
+func TestParseSubquery(t *testing.T) {
+	query, err := Parse("SELECT a FROM t WHERE b IN (SELECT ref FROM u WHERE c > 1) AND NOT EXISTS (SELECT * FROM v)")
+	assert.Equal(t, err, nil)
+	where := query.Statement.(*SelectQuery).WhereExpression
+	in := where.Left.(*WhereExpression)
+	assert.Equal(t, in.Type, WHERE_IN_SUBQUERY)
+	assert.Equal(t, in.Left, "b")
+	assert.Equal(t, in.Right.(*Subquery).Query.Table, "u")
+	exists := where.Right.(*WhereExpression).Left.(*WhereExpression)
+	assert.Equal(t, exists.Type, WHERE_EXISTS)
+	assert.Equal(t, where.GetConditionFields(), []string{"b"})
+
+	query, err = Parse("DELETE FROM t WHERE b NOT IN (SELECT ref FROM u)")
+	assert.Equal(t, err, nil)
+	where = query.Statement.(*DeleteQuery).WhereExpression
+	assert.Equal(t, where.Type, WHERE_NOT)
+	assert.Equal(t, where.String(), "b NOT IN (SELECT ref FROM u)")
+
+	for sql, message := range map[string]string{
+		"SELECT a FROM t WHERE b IN (SELECT * FROM u)":                      "exactly one column",
+		"SELECT a FROM t WHERE b IN (SELECT x, y FROM u)":                   "exactly one column",
+		"SELECT a FROM t WHERE EXISTS (SELECT x FROM u WHERE count(*) > 1)": "aggregate functions are not allowed",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil)
+		assert.T(t, strings.Contains(err.Error(), message), err.Error())
+	}
+}
+
+func TestResolveSubqueries(t *testing.T) {
+	query, err := Parse("SELECT a FROM t WHERE b IN (SELECT ref FROM u) OR c = 1")
+	assert.Equal(t, err, nil)
+	where := query.Statement.(*SelectQuery).WhereExpression
+	calls := 0
+	null := &protocol.FieldValue{}
+	resolved, err := ResolveSubqueries(where, fakeFetch([]*protocol.FieldValue{intValue(1), intValue(3)}, &calls))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, calls, 1)
+	// the parsed query is left untouched so it can run again
+	assert.Equal(t, where.Left.(*WhereExpression).Right.(*Subquery).Result, (*SubqueryResult)(nil))
+	assert.T(t, resolved.Right == where.Right)
+
+	result := resolved.Left.(*WhereExpression).Right.(*Subquery).Result
+	found, unknown := result.Contains(newIntNode(3))
+	assert.T(t, found && !unknown)
+	found, unknown = result.Contains(NewLiteral(protocol.DOUBLE, "1.0"))
+	assert.T(t, found && !unknown)
+	found, unknown = result.Contains(newIntNode(2))
+	assert.T(t, !found && !unknown)
+	found, unknown = result.Contains(NewLiteral(protocol.NULL, ""))
+	assert.T(t, !found && unknown)
+
+	// a NULL in the set makes a miss unknown
+	resolved, err = ResolveSubqueries(where, fakeFetch([]*protocol.FieldValue{intValue(1), null}, &calls))
+	assert.Equal(t, err, nil)
+	found, unknown = resolved.Left.(*WhereExpression).Right.(*Subquery).Result.Contains(newIntNode(2))
+	assert.T(t, !found && unknown)
+
+	// an empty set never matches, even a NULL
+	resolved, err = ResolveSubqueries(where, fakeFetch(nil, &calls))
+	assert.Equal(t, err, nil)
+	found, unknown = resolved.Left.(*WhereExpression).Right.(*Subquery).Result.Contains(NewLiteral(protocol.NULL, ""))
+	assert.T(t, !found && !unknown)
+}
+
+func TestSubqueryRowLimit(t *testing.T) {
+	defer func(limit int) { SubqueryRowLimit = limit }(SubqueryRowLimit)
+	SubqueryRowLimit = 2
+	query, err := Parse("SELECT a FROM t WHERE b IN (SELECT ref FROM u)")
+	assert.Equal(t, err, nil)
+	where := query.Statement.(*SelectQuery).WhereExpression
+	calls := 0
+	values := []*protocol.FieldValue{intValue(1), intValue(2), intValue(3)}
+	_, err = ResolveSubqueries(where, fakeFetch(values, &calls))
+	assert.NotEqual(t, err, nil)
+	assert.T(t, strings.Contains(err.Error(), "more than 2 rows"), err.Error())
+
+	_, err = ResolveSubqueries(where, fakeFetch(values[:2], &calls))
+	assert.Equal(t, err, nil)
+}
+
+func TestExistsIdCondition(t *testing.T) {
+	query, err := Parse("SELECT a FROM t WHERE EXISTS (SELECT x FROM u WHERE x = 1)")
+	assert.Equal(t, err, nil)
+	where := query.Statement.(*SelectQuery).WhereExpression
+	var limit int
+	fetch := func(query *SelectQuery) (*protocol.RecordList, error) {
+		limit = query.Limit
+		return &protocol.RecordList{}, nil
+	}
+	resolved, err := ResolveSubqueries(where, fetch)
+	assert.Equal(t, err, nil)
+	// one row is enough to tell
+	assert.Equal(t, limit, 1)
+	condition, ranges, err := GetIdCondition(resolved)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, condition, (*WhereExpression)(nil))
+	assert.Equal(t, ranges, []*IdRange{})
+
+	calls := 0
+	resolved, err = ResolveSubqueries(where, fakeFetch([]*protocol.FieldValue{intValue(1)}, &calls))
+	assert.Equal(t, err, nil)
+	condition, ranges, err = GetIdCondition(resolved)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, condition, (*WhereExpression)(nil))
+	assert.Equal(t, ranges, fullIdRanges())
+}
+
+func TestPrepareSubquery(t *testing.T) {
+	stmt, err := Prepare("SELECT a FROM t WHERE b IN (SELECT ref FROM u WHERE c = ?)")
+	assert.Equal(t, err, nil)
+	query, err := stmt.Bind([]*protocol.FieldValue{intValue(7)})
+	assert.Equal(t, err, nil)
+	inner := query.Statement.(*SelectQuery).WhereExpression.Right.(*Subquery).Query
+	assert.Equal(t, inner.WhereExpression.String(), "c = 7")
+}
@@ -0,0 +1,252 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/senarukana/fundb/protocol"
+)
+
+// TIMESTAMP_COLUMN is the pseudo-column holding the time a record was last
+// written, it can be read like any column but not set
+const TIMESTAMP_COLUMN = "_timestamp"
+
+// TimestampNode is a point in time, in nanoseconds since the epoch
+type TimestampNode struct {
+	Type protocol.FieldType
+	*protocol.FieldValue
+}
+
+// IntervalNode is a duration, added to or subtracted from a timestamp
+type IntervalNode struct {
+	Type     protocol.FieldType
+	Duration time.Duration
+}
+
+func newTimestampNode(val int64) LiteralNode {
+	return &TimestampNode{protocol.TIMESTAMP, &protocol.FieldValue{TimestampVal: &val}}
+}
+
+func newIntervalNode(duration time.Duration) LiteralNode {
+	return &IntervalNode{protocol.INTERVAL, duration}
+}
+
+func (self *TimestampNode) GetVal() *protocol.FieldValue {
+	return self.FieldValue
+}
+
+func (self *TimestampNode) GetType() protocol.FieldType {
+	return self.Type
+}
+
+func (self *TimestampNode) Time() time.Time {
+	return time.Unix(0, self.GetTimestampVal()).UTC()
+}
+
+func (self *TimestampNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
+	switch cmpOp {
+	case EQUAL:
+		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
+	case SMALLER:
+		return self.Less(other)
+	case SMALLEREQ:
+		return self.Equal(other) || self.Less(other)
+	case GREATER:
+		return other.Less(self)
+	case GREATEREQ:
+		return self.Equal(other) || other.Less(self)
+	default:
+		panic("UNKNOWN operator")
+	}
+}
+
+func (self *TimestampNode) Equal(other LiteralNode) bool {
+	if timestampNode, ok := other.(*TimestampNode); ok {
+		return self.GetTimestampVal() == timestampNode.GetTimestampVal()
+	}
+	return false
+}
+
+func (self *TimestampNode) Less(other LiteralNode) bool {
+	if timestampNode, ok := other.(*TimestampNode); ok {
+		return self.GetTimestampVal() < timestampNode.GetTimestampVal()
+	}
+	return false
+}
+
+// GetVal shows an interval as text like 1h30m0s, intervals are never stored
+func (self *IntervalNode) GetVal() *protocol.FieldValue {
+	val := self.Duration.String()
+	return &protocol.FieldValue{StrVal: &val}
+}
+
+func (self *IntervalNode) GetType() protocol.FieldType {
+	return self.Type
+}
+
+func (self *IntervalNode) Compare(cmpOp int, other LiteralNode) bool {
+	if IsNull(other) {
+		return false
+	}
+	switch cmpOp {
+	case EQUAL:
+		return self.Equal(other)
+	case NOTEQUAL:
+		return !self.Equal(other)
+	case SMALLER:
+		return self.Less(other)
+	case SMALLEREQ:
+		return self.Equal(other) || self.Less(other)
+	case GREATER:
+		return other.Less(self)
+	case GREATEREQ:
+		return self.Equal(other) || other.Less(self)
+	default:
+		panic("UNKNOWN operator")
+	}
+}
+
+func (self *IntervalNode) Equal(other LiteralNode) bool {
+	if intervalNode, ok := other.(*IntervalNode); ok {
+		return self.Duration == intervalNode.Duration
+	}
+	return false
+}
+
+func (self *IntervalNode) Less(other LiteralNode) bool {
+	if intervalNode, ok := other.(*IntervalNode); ok {
+		return self.Duration < intervalNode.Duration
+	}
+	return false
+}
+
+// ParseInterval reads a Go duration like 1h30m, which may start with a
+// number of days, e.g. 2d or 1d12h
+func ParseInterval(value string) (time.Duration, error) {
+	src := value
+	negative := strings.HasPrefix(src, "-")
+	if negative {
+		src = src[1:]
+	}
+	var days time.Duration
+	if idx := strings.IndexByte(src, 'd'); idx != -1 {
+		n, err := strconv.ParseInt(src[:idx], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval %s", value)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		src = src[idx+1:]
+	}
+	var duration time.Duration
+	if src != "" || days == 0 {
+		var err error
+		if duration, err = time.ParseDuration(src); err != nil {
+			return 0, fmt.Errorf("invalid interval %s, expected a duration like 1h30m or 2d", value)
+		}
+	}
+	if negative {
+		return -(days + duration), nil
+	}
+	return days + duration, nil
+}
+
+// newTimestamp is the literal TIMESTAMP 'iso-8601', tok is the quoted string
+func (l *Lex) newTimestamp(tok Token) LiteralNode {
+	val, err := protocol.ParseTimestamp(unquoteString(tok.Src))
+	if err != nil {
+		l.literalError(tok, err)
+		return NewLiteral(protocol.NULL, "")
+	}
+	return newTimestampNode(val)
+}
+
+// newInterval is the literal INTERVAL 'duration', tok is the quoted string
+func (l *Lex) newInterval(tok Token) LiteralNode {
+	duration, err := ParseInterval(unquoteString(tok.Src))
+	if err != nil {
+		l.literalError(tok, err)
+		return NewLiteral(protocol.NULL, "")
+	}
+	return newIntervalNode(duration)
+}
+
+func isTemporal(node LiteralNode) bool {
+	return node.GetType() == protocol.TIMESTAMP || node.GetType() == protocol.INTERVAL
+}
+
+// temporalArithmetic moves a timestamp by an interval, subtracts timestamps
+// and adds intervals, no other operation is defined on them
+func temporalArithmetic(op int, left, right LiteralNode) (LiteralNode, error) {
+	leftType, rightType := left.GetType(), right.GetType()
+	switch {
+	case op == PLUS && leftType == protocol.TIMESTAMP && rightType == protocol.INTERVAL:
+		return newTimestampNode(left.GetVal().GetTimestampVal() + int64(right.(*IntervalNode).Duration)), nil
+	case op == PLUS && leftType == protocol.INTERVAL && rightType == protocol.TIMESTAMP:
+		return newTimestampNode(right.GetVal().GetTimestampVal() + int64(left.(*IntervalNode).Duration)), nil
+	case op == MINUS && leftType == protocol.TIMESTAMP && rightType == protocol.INTERVAL:
+		return newTimestampNode(left.GetVal().GetTimestampVal() - int64(right.(*IntervalNode).Duration)), nil
+	case op == MINUS && leftType == protocol.TIMESTAMP && rightType == protocol.TIMESTAMP:
+		return newIntervalNode(time.Duration(left.GetVal().GetTimestampVal() - right.GetVal().GetTimestampVal())), nil
+	case op == PLUS && leftType == protocol.INTERVAL && rightType == protocol.INTERVAL:
+		return newIntervalNode(left.(*IntervalNode).Duration + right.(*IntervalNode).Duration), nil
+	case op == MINUS && leftType == protocol.INTERVAL && rightType == protocol.INTERVAL:
+		return newIntervalNode(left.(*IntervalNode).Duration - right.(*IntervalNode).Duration), nil
+	}
+	return nil, fmt.Errorf("unsupported operands %v and %v for %s", leftType, rightType, ArithmeticOpMap[op])
+}
+
+// dateTruncUnits are the units DATE_TRUNC rounds down to, in UTC
+var dateTruncUnits = map[string]func(time.Time) time.Time{
+	"MICROSECOND": func(t time.Time) time.Time { return t.Truncate(time.Microsecond) },
+	"MILLISECOND": func(t time.Time) time.Time { return t.Truncate(time.Millisecond) },
+	"SECOND":      func(t time.Time) time.Time { return t.Truncate(time.Second) },
+	"MINUTE":      func(t time.Time) time.Time { return t.Truncate(time.Minute) },
+	"HOUR":        func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+	"DAY": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	},
+	"WEEK": func(t time.Time) time.Time {
+		// weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+	},
+	"MONTH": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	},
+	"YEAR": func(t time.Time) time.Time {
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	},
+}
+
+func now(args []LiteralNode) (LiteralNode, error) {
+	return newTimestampNode(time.Now().UnixNano()), nil
+}
+
+// dateTrunc is DATE_TRUNC(unit, timestamp)
+func dateTrunc(args []LiteralNode) (LiteralNode, error) {
+	unit := args[0].GetVal().GetStrVal()
+	truncate, ok := dateTruncUnits[strings.ToUpper(unit)]
+	if !ok {
+		return nil, fmt.Errorf("DATE_TRUNC unit %s not supported", unit)
+	}
+	return newTimestampNode(truncate(args[1].(*TimestampNode).Time()).UnixNano()), nil
+}
+
+// checkDateTrunc checks the unit when it is a constant
+func checkDateTrunc(args []*Scalar) error {
+	if args[0].Type != SCLAR_LITERAL || args[0].Val.(LiteralNode).GetType() != protocol.STRING {
+		return nil
+	}
+	unit := args[0].Val.(LiteralNode).GetVal().GetStrVal()
+	if _, ok := dateTruncUnits[strings.ToUpper(unit)]; !ok {
+		return fmt.Errorf("syntax error: DATE_TRUNC unit %s not supported", unit)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/senarukana/fundb/protocol"
+
+	"github.com/bmizerany/assert"
+)
+
+func evalScalar(t *testing.T, scalar *Scalar) LiteralNode {
+	switch scalar.Type {
+	case SCLAR_LITERAL:
+		return scalar.Val.(LiteralNode)
+	case SCALAR_FUNCTION:
+		function := scalar.Val.(*FunctionCall)
+		args := make([]LiteralNode, len(function.GetArgs()))
+		for i, arg := range function.GetArgs() {
+			args[i] = evalScalar(t, arg)
+		}
+		val, err := function.Call(args)
+		assert.Equal(t, err, nil)
+		return val
+	case SCALAR_EXPRESSION:
+		expr := scalar.Val.(*ArithmeticExpression)
+		var right LiteralNode
+		if expr.Right != nil {
+			right = evalScalar(t, expr.Right)
+		}
+		val, err := Arithmetic(expr.Op, evalScalar(t, expr.Left), right)
+		assert.Equal(t, err, nil)
+		return val
+	}
+	t.Fatalf("can't evaluate %s", scalar)
+	return nil
+}
+
+func selectValue(t *testing.T, sql string) LiteralNode {
+	query, err := Parse(sql)
+	assert.Equal(t, err, nil)
+	return evalScalar(t, query.Statement.(*SelectQuery).ScalarList.ScalarList[0])
+}
+
+func TestTimestampLiterals(t *testing.T) {
+	for literal, expected := range map[string]time.Time{
+		"TIMESTAMP '2014-05-01T10:20:30Z'":                      time.Date(2014, 5, 1, 10, 20, 30, 0, time.UTC),
+		"TIMESTAMP '2014-05-01T10:20:30.5+02:00'":               time.Date(2014, 5, 1, 8, 20, 30, 5e8, time.UTC),
+		"TIMESTAMP '2014-05-01 10:20:30'":                       time.Date(2014, 5, 1, 10, 20, 30, 0, time.UTC),
+		"timestamp '2014-05-01'":                                time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC),
+		"TIMESTAMP '2014-05-01' + INTERVAL '1d12h'":             time.Date(2014, 5, 2, 12, 0, 0, 0, time.UTC),
+		"TIMESTAMP '2014-05-01' - INTERVAL '90m'":               time.Date(2014, 4, 30, 22, 30, 0, 0, time.UTC),
+		"DATE_TRUNC('hour', TIMESTAMP '2014-05-01T10:20:30Z')":  time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC),
+		"DATE_TRUNC('week', TIMESTAMP '2014-05-01T10:20:30Z')":  time.Date(2014, 4, 28, 0, 0, 0, 0, time.UTC),
+		"DATE_TRUNC('Month', TIMESTAMP '2014-05-01T10:20:30Z')": time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		val := selectValue(t, "SELECT "+literal+" FROM t")
+		assert.Equal(t, val.GetType(), protocol.TIMESTAMP)
+		assert.Equal(t, val.(*TimestampNode).Time(), expected)
+	}
+
+	interval := selectValue(t, "SELECT TIMESTAMP '2014-05-02' - TIMESTAMP '2014-05-01' FROM t")
+	assert.Equal(t, interval.(*IntervalNode).Duration, 24*time.Hour)
+
+	before := time.Now()
+	now := selectValue(t, "SELECT NOW() - INTERVAL '1h' FROM t").(*TimestampNode).Time()
+	assert.T(t, !now.Before(before.Add(-time.Hour)) && !now.After(time.Now().Add(-time.Hour)))
+}
+
+func TestInvalidTimes(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT a FROM t WHERE ts > TIMESTAMP '2014-13-01'",
+		"SELECT a FROM t WHERE ts > NOW() - INTERVAL 'an hour'",
+		"SELECT DATE_TRUNC('fortnight', ts) FROM t",
+		"SELECT NOW(1) FROM t",
+		"INSERT INTO t (a, _timestamp) VALUES (1, 2)",
+		"UPDATE t SET _timestamp = NOW()",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil)
+	}
+	_, err := Parse("SELECT a FROM t WHERE\nts > TIMESTAMP 'yesterday'")
+	assert.Equal(t, err.(ParserError).Line, 2)
+	assert.Equal(t, err.(ParserError).Token, "'yesterday'")
+
+	_, err = Arithmetic(PLUS, newTimestampNode(0), newTimestampNode(0))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestTimestampColumn(t *testing.T) {
+	query, err := Parse("CREATE TABLE events (name STRING, at TIMESTAMP NOT NULL)")
+	assert.Equal(t, err, nil)
+	column := query.Statement.(*CreateTableQuery).GetSchema().GetColumn("at")
+	assert.Equal(t, column.Type, protocol.TIMESTAMP)
+
+	iso := "2014-05-01T10:20:30Z"
+	val, err := column.Coerce(&protocol.FieldValue{StrVal: &iso})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val.GetType(), protocol.TIMESTAMP)
+	assert.Equal(t, NewFieldLiteral(val).Compare(EQUAL, selectValue(t, "SELECT TIMESTAMP '"+iso+"' FROM t")), true)
+}
+
+func TestFoldNow(t *testing.T) {
+	query, err := Parse("SELECT NOW() AS n FROM t WHERE ts < NOW() AND a IN (SELECT b FROM u WHERE ts > NOW() - INTERVAL '1h')")
+	assert.Equal(t, err, nil)
+	statement := query.Statement.(*SelectQuery)
+	folded, err := Fold(statement)
+	assert.Equal(t, err, nil)
+	selectQuery := folded.(*SelectQuery)
+
+	now := selectQuery.ScalarList.ScalarList[0].Val.(*FunctionCall).Value
+	assert.NotEqual(t, now, nil)
+	// every call of the statement has the same value, subqueries included
+	where := selectQuery.WhereExpression
+	assert.Equal(t, where.Left.(*WhereExpression).Right.(*Scalar).Val.(*FunctionCall).Value, now)
+	inner := where.Right.(*WhereExpression).Right.(*Subquery).Query.WhereExpression
+	assert.Equal(t, inner.Right.(*Scalar).Val.(*ArithmeticExpression).Left.Val.(*FunctionCall).Value, now)
+	assert.Equal(t, evalScalar(t, selectQuery.ScalarList.ScalarList[0]), now)
+	// the name of the column is still that of the call
+	assert.Equal(t, selectQuery.ScalarList.ScalarList[0].Alias, "n")
+	assert.Equal(t, selectQuery.Format(), statement.Format())
+
+	// the parsed statement isn't folded and a folded one keeps its value
+	assert.Equal(t, statement.ScalarList.ScalarList[0].Val.(*FunctionCall).Value, nil)
+	time.Sleep(time.Millisecond)
+	again, err := Fold(selectQuery.After(10, 5))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, again.(*SelectQuery).ScalarList.ScalarList[0].Val.(*FunctionCall).Value, now)
+}
@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseUpdate(t *testing.T) {
+	for _, c := range []struct {
+		sql    string
+		fields []string
+		values []string
+		where  string
+	}{
+		{"UPDATE t SET a = 1", []string{"a"}, []string{"1"}, ""},
+		{"update t set a = 1, b = 'x' where _id = 3", []string{"a", "b"}, []string{"1", "'x'"}, "_id = 3"},
+		{"UPDATE t SET b = a * 2 + 1, a = NULL WHERE a > 1 OR b IS NULL", []string{"b", "a"}, []string{"(a * 2) + 1", "NULL"}, "a > 1 OR b IS NULL"},
+		{"UPDATE t SET `order` = -1.5", []string{"order"}, []string{"-1.5"}, ""},
+	} {
+		query, err := Parse(c.sql)
+		assert.Equal(t, err, nil, c.sql)
+		assert.Equal(t, query.Type, QUERY_UPDATE)
+		update := query.Statement.(*UpdateQuery)
+		assert.Equal(t, update.GetTableName(), "t")
+		assert.Equal(t, update.GetUpdateFields(), c.fields)
+		values := make([]string, 0, len(update.Assignments))
+		for _, assignment := range update.Assignments {
+			values = append(values, assignment.Val.Format())
+		}
+		assert.Equal(t, values, c.values, c.sql)
+		if c.where == "" {
+			assert.Equal(t, update.WhereExpression, (*WhereExpression)(nil), c.sql)
+		} else {
+			assert.Equal(t, update.WhereExpression.Format(), c.where, c.sql)
+		}
+	}
+}
+
+func TestInvalidUpdate(t *testing.T) {
+	for _, sql := range []string{
+		"UPDATE t",
+		"UPDATE t SET",
+		"UPDATE t SET a",
+		"UPDATE t SET a = 1,",
+		"UPDATE SET a = 1",
+		"UPDATE t SET a = 1 WHERE",
+		// _id is the key of the row
+		"UPDATE t SET _id = 1",
+		"UPDATE t SET a = 1, b = 2, a = 3",
+		"UPDATE t SET a = t.b",
+		"UPDATE t SET a = 1 WHERE t.b = 2",
+		"UPDATE t SET a = COUNT(b)",
+		"UPDATE t SET a = 1 WHERE MAX(b) > 1",
+	} {
+		_, err := Parse(sql)
+		assert.NotEqual(t, err, nil, sql)
+	}
+}
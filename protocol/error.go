@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is sent with every error of the HTTP and TCP APIs, clients
+// should match on the code rather than on the message
+type ErrorCode string
+
+const (
+	E_BAD_PROTOCOL         ErrorCode = "E_BAD_PROTOCOL"
+	E_INVALID_COMMAND      ErrorCode = "E_INVALID_COMMAND"
+	E_BAD_BODY             ErrorCode = "E_BAD_BODY"
+	E_BAD_PARAMS           ErrorCode = "E_BAD_PARAMS"
+	E_MISSING_ARG_DB       ErrorCode = "E_MISSING_ARG_DB"
+	E_MISSING_ARG_TABLE    ErrorCode = "E_MISSING_ARG_TABLE"
+	E_MISSING_ARG_COLUMN   ErrorCode = "E_MISSING_ARG_COLUMN"
+	E_MISSING_ARG_NAME     ErrorCode = "E_MISSING_ARG_NAME"
+	E_INVALID_TABLE_FORMAT ErrorCode = "E_INVALID_TABLE_FORMAT"
+	E_PARSE_ERROR          ErrorCode = "E_PARSE_ERROR"
+	E_INVALID_QUERY        ErrorCode = "E_INVALID_QUERY"
+	E_NOT_FOUND            ErrorCode = "E_NOT_FOUND"
+	E_INTERNAL             ErrorCode = "E_INTERNAL"
+)
+
+// HTTPStatus is the status an error with this code is answered with
+func (self ErrorCode) HTTPStatus() int {
+	switch self {
+	case E_NOT_FOUND:
+		return http.StatusNotFound
+	case E_INTERNAL:
+		return http.StatusInternalServerError
+	default:
+		// everything else is the client's fault
+		return http.StatusBadRequest
+	}
+}
+
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{code, fmt.Sprintf(format, args...)}
+}
+
+// Error is the form the TCP API sends, the code followed by the message
+func (self *Error) Error() string {
+	return fmt.Sprintf("%s %s", self.Code, self.Message)
+}
@@ -1,6 +1,15 @@
 package protocol
 
+import (
+	"time"
+)
+
+// GetValue returns the value as a Go value, a TIMESTAMP is a UTC time.Time
 func (self *FieldValue) GetValue() interface{} {
+	if self.TimestampVal != nil {
+		return time.Unix(0, *self.TimestampVal).UTC()
+	}
+
 	if self.StrVal != nil {
 		return *self.StrVal
 	}
@@ -19,6 +28,24 @@ func (self *FieldValue) GetValue() interface{} {
 	return nil
 }
 
+func (self *FieldValue) GetType() FieldType {
+	switch {
+	case self == nil:
+		return NULL
+	case self.TimestampVal != nil:
+		return TIMESTAMP
+	case self.StrVal != nil:
+		return STRING
+	case self.DoubleVal != nil:
+		return DOUBLE
+	case self.IntVal != nil:
+		return INT
+	case self.BoolVal != nil:
+		return BOOL
+	}
+	return NULL
+}
+
 func (self *Record) GetFieldValue(idx int) interface{} {
 	return self.Values[idx].GetValue()
 }
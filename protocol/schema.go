@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// Column is a typed column of a table, a nil Default leaves the column NULL
+// when an insert doesn't set it
+type Column struct {
+	Name    string
+	Type    FieldType
+	NotNull bool
+	Default *FieldValue
+}
+
+// Schema is the columns of a typed table, schemaless tables have none
+type Schema []*Column
+
+func (self Schema) GetColumn(name string) *Column {
+	for _, column := range self {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+// AddColumn returns the schema with column at the end, the schema itself is
+// left as it is
+func (self Schema) AddColumn(column *Column) (Schema, error) {
+	if column.Type == NULL {
+		return nil, fmt.Errorf("column %s needs a type", column.Name)
+	}
+	if self.GetColumn(column.Name) != nil {
+		return nil, fmt.Errorf("column %s already exists", column.Name)
+	}
+	return append(append(Schema{}, self...), column), nil
+}
+
+// Coerce checks a value against the column, an INT stored in a DOUBLE
+// column and an ISO-8601 STRING stored in a TIMESTAMP column are converted,
+// any other mismatch is an error
+func (self *Column) Coerce(value *FieldValue) (*FieldValue, error) {
+	valueType := value.GetType()
+	switch {
+	case valueType == NULL:
+		if self.NotNull {
+			return nil, fmt.Errorf("column %s can't be NULL", self.Name)
+		}
+		return &FieldValue{}, nil
+	case valueType == self.Type:
+		return value, nil
+	case valueType == INT && self.Type == DOUBLE:
+		val := float64(value.GetIntVal())
+		return &FieldValue{DoubleVal: &val}, nil
+	case valueType == STRING && self.Type == TIMESTAMP:
+		val, err := ParseTimestamp(value.GetStrVal())
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", self.Name, err)
+		}
+		return &FieldValue{TimestampVal: &val}, nil
+	}
+	return nil, fmt.Errorf("column %s is %v, got %v %v", self.Name, self.Type, valueType, value.GetValue())
+}
+
+// DefaultValue is the value of the column when an insert leaves it out
+func (self *Column) DefaultValue() (*FieldValue, error) {
+	return self.Coerce(self.Default)
+}
@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSchemaAddColumn(t *testing.T) {
+	schema := Schema{&Column{Name: "a", Type: INT}}
+	extended, err := schema.AddColumn(&Column{Name: "b", Type: STRING, NotNull: true})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(extended), 2)
+	assert.Equal(t, extended.GetColumn("b").Type, STRING)
+	// the schema added to is left as it is
+	assert.Equal(t, len(schema), 1)
+	assert.Equal(t, schema.GetColumn("b"), (*Column)(nil))
+
+	_, err = schema.AddColumn(&Column{Name: "a", Type: DOUBLE})
+	assert.Equal(t, err.Error(), "column a already exists")
+	_, err = schema.AddColumn(&Column{Name: "c"})
+	assert.Equal(t, err.Error(), "column c needs a type")
+}
@@ -1,5 +1,11 @@
 package protocol
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type FieldType int
 
 const (
@@ -8,4 +14,58 @@ const (
 	DOUBLE
 	STRING
 	BOOL
+	TIMESTAMP
+	// INTERVAL is the difference of two timestamps, it only exists in queries
+	// and can't be stored
+	INTERVAL
 )
+
+func (self FieldType) String() string {
+	switch self {
+	case NULL:
+		return "NULL"
+	case INT:
+		return "INT"
+	case DOUBLE:
+		return "DOUBLE"
+	case STRING:
+		return "STRING"
+	case BOOL:
+		return "BOOL"
+	case TIMESTAMP:
+		return "TIMESTAMP"
+	case INTERVAL:
+		return "INTERVAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func ParseFieldType(name string) (FieldType, error) {
+	for _, fieldType := range []FieldType{INT, DOUBLE, STRING, BOOL, TIMESTAMP} {
+		if strings.EqualFold(name, fieldType.String()) {
+			return fieldType, nil
+		}
+	}
+	return NULL, fmt.Errorf("unknown type %s", name)
+}
+
+// timestampLayouts are the ISO-8601 forms ParseTimestamp accepts, a time
+// without a zone is UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTimestamp returns the nanoseconds since the epoch of an ISO-8601 time
+func ParseTimestamp(value string) (int64, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid timestamp %s, expected ISO-8601 like 2006-01-02T15:04:05Z", value)
+}
@@ -11,6 +11,7 @@ import (
 )
 
 const (
+	database       = "test"
 	insertFileName = "insert.sql"
 	deleteFileName = "delete.sql"
 	selectFileName = "select.sql"
@@ -18,8 +19,8 @@ const (
 
 func create_table(engine *core.QueryEngine) {
 	createQuery := "CREATE TABLE test INCREMENT"
-	response := engine.Query(createQuery)
-	if response.Error != nil {
+	response := engine.Query(database, createQuery)
+	if response.Error != "" {
 		log.Printf("Query Error:%s\n", response.Error)
 	}
 }
@@ -34,8 +35,8 @@ func insertTest(engine *core.QueryEngine) {
 		if insertSql == "" {
 			continue
 		}
-		response := engine.Query(insertSql)
-		if response.Error != nil {
+		response := engine.Query(database, insertSql)
+		if response.Error != "" {
 			log.Fatalf("Query Error:%s\n", response.Error)
 		}
 	}
@@ -43,9 +44,9 @@ func insertTest(engine *core.QueryEngine) {
 
 func fetch(engine *core.QueryEngine, sql string) {
 
-	response := engine.Query(sql)
+	response := engine.Query(database, sql)
 
-	if response.Error != nil {
+	if response.Error != "" {
 		log.Fatalf("Query Error:%s\n", response.Error)
 	}
 	fmt.Printf("SQL : %s\n", sql)
@@ -67,8 +68,8 @@ func fetch(engine *core.QueryEngine, sql string) {
 func delete(engine *core.QueryEngine) {
 	fmt.Println("----------------DELETE----------------")
 	deleteQuery := "DELETE FROM test WHERE name = 'li'"
-	response := engine.Query(deleteQuery)
-	if response.Error != nil {
+	response := engine.Query(database, deleteQuery)
+	if response.Error != "" {
 		log.Fatalf("Query Error:%s\n", response.Error)
 	}
 	fmt.Printf("SQL : %s\n", deleteQuery)
@@ -84,6 +85,9 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if err := engine.CreateDatabase(database); err != nil {
+		log.Printf("Create Database Error:%s\n", err)
+	}
 	create_table(engine)
 	insertTest(engine)
 